@@ -0,0 +1,329 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bin
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const blockUntilURL = "../../bin/block-until-url"
+
+// script is a running block-until-url
+type script struct {
+	cmd    *exec.Cmd
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	done   chan error
+}
+
+func start(t *testing.T, env []string, args ...string) *script {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl not found")
+	}
+
+	s := &script{
+		cmd:  exec.Command(blockUntilURL, args...),
+		done: make(chan error, 1),
+	}
+	// keep proxy settings from the environment away from curl
+	s.cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, env...)
+	s.cmd.Stdout = &s.stdout
+	s.cmd.Stderr = &s.stderr
+	if err := s.cmd.Start(); err != nil {
+		t.Fatalf("starting %s: %v", blockUntilURL, err)
+	}
+	go func() {
+		s.done <- s.cmd.Wait()
+	}()
+	return s
+}
+
+// wait waits for the script to exit and returns its exit status
+func (s *script) wait(t *testing.T, timeout time.Duration) error {
+	select {
+	case err := <-s.done:
+		return err
+	case <-time.After(timeout):
+		s.cmd.Process.Kill()
+		<-s.done
+		t.Fatalf("block-until-url didn't exit within %v", timeout)
+	}
+	return nil
+}
+
+// blocking checks that the script keeps waiting for d
+func (s *script) blocking(t *testing.T, d time.Duration) {
+	select {
+	case err := <-s.done:
+		s.done <- err
+		t.Fatalf("block-until-url exited early: %v: %s", err, s.stderr.String())
+	case <-time.After(d):
+	}
+}
+
+// terminate sends SIGTERM and checks the script is killed by it
+func (s *script) terminate(t *testing.T) {
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("sending SIGTERM: %v", err)
+	}
+	err := s.wait(t, 5*time.Second)
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("expected block-until-url to be terminated, received %v", err)
+	}
+	status := exitErr.Sys().(syscall.WaitStatus)
+	if !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Fatalf("expected block-until-url to be killed by SIGTERM, received %v", err)
+	}
+}
+
+func (s *script) checkSuccess(t *testing.T, timeout time.Duration) {
+	if err := s.wait(t, timeout); err != nil {
+		t.Fatalf("block-until-url failed: %v: %s", err, s.stderr.String())
+	}
+	s.checkQuiet(t)
+}
+
+func (s *script) checkQuiet(t *testing.T) {
+	if s.stdout.Len() != 0 || s.stderr.Len() != 0 {
+		t.Fatalf("unexpected output: stdout %q, stderr %q", s.stdout.String(), s.stderr.String())
+	}
+}
+
+// recorder serves a test handler and records the requests it receives
+type recorder struct {
+	mu       sync.Mutex
+	requests []string
+	handler  http.HandlerFunc
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mu.Unlock()
+	r.handler(w, req)
+}
+
+func (r *recorder) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+// hangUp closes the connection without sending a response
+func hangUp(w http.ResponseWriter, req *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+func TestInvalidURL(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{""},
+		{"fooshizzle"},
+		{"ftp://localhost/"},
+		{"localhost:80"},
+	} {
+		s := start(t, nil, args...)
+		err := s.wait(t, 5*time.Second)
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || exitErr.Sys().(syscall.WaitStatus).ExitStatus() != 1 {
+			t.Fatalf("%q: expected exit status 1, received %v", args, err)
+		}
+		if s.stdout.Len() != 0 {
+			t.Fatalf("%q: unexpected stdout %q", args, s.stdout.String())
+		}
+		if !strings.Contains(s.stderr.String(), "invalid url") {
+			t.Fatalf("%q: expected an invalid url error, received %q", args, s.stderr.String())
+		}
+	}
+}
+
+func TestResponse(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError} {
+		r := &recorder{handler: func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(status)
+		}}
+		server := httptest.NewServer(r)
+
+		s := start(t, nil, server.URL+"/path")
+		s.checkSuccess(t, 5*time.Second)
+		server.Close()
+
+		if requests := r.received(); len(requests) != 1 || requests[0] != "HEAD /path" {
+			t.Fatalf("%d: expected a single HEAD /path, received %q", status, requests)
+		}
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	r := &recorder{handler: hangUp}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	s := start(t, nil, server.URL+"/bogus")
+	s.blocking(t, 2*time.Second)
+	s.terminate(t)
+	s.checkQuiet(t)
+
+	// it keeps retrying while waiting
+	if requests := r.received(); len(requests) < 2 {
+		t.Fatalf("expected repeated requests, received %q", requests)
+	}
+}
+
+func TestServerAppearsLater(t *testing.T) {
+	// reserve a port which nothing listens on yet
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := start(t, nil, "http://"+addr+"/")
+	s.blocking(t, 2*time.Second)
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		s.cmd.Process.Kill()
+		t.Fatalf("listening on %s: %v", addr, err)
+	}
+	r := &recorder{handler: func(w http.ResponseWriter, req *http.Request) {}}
+	server := &httptest.Server{Listener: l, Config: &http.Server{Handler: r}}
+	server.Start()
+	defer server.Close()
+
+	s.checkSuccess(t, 5*time.Second)
+	if requests := r.received(); len(requests) != 1 {
+		t.Fatalf("expected a single request, received %q", requests)
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	r := &recorder{handler: func(w http.ResponseWriter, req *http.Request) {}}
+	server := httptest.NewUnstartedServer(r)
+	// curl hanging up on the untrusted certificate isn't interesting
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	// the test server's self-signed certificate is its own CA
+	dir, err := ioutil.TempDir("", "block-until-url")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing the server certificate: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatalf("writing %s: %v", caFile, err)
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		s := start(t, nil, server.URL+"/")
+		s.blocking(t, 2*time.Second)
+		s.terminate(t)
+		s.checkQuiet(t)
+
+		if requests := r.received(); len(requests) != 0 {
+			t.Fatalf("request made over an untrusted connection: %q", requests)
+		}
+	})
+
+	t.Run("local CA", func(t *testing.T) {
+		s := start(t, []string{"CURL_CA_BUNDLE=" + caFile}, server.URL+"/")
+		s.checkSuccess(t, 5*time.Second)
+
+		if requests := r.received(); len(requests) != 1 || requests[0] != "HEAD /" {
+			t.Fatalf("expected a single HEAD /, received %q", requests)
+		}
+	})
+}
+
+func TestRedirect(t *testing.T) {
+	r := &recorder{handler: func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/redirect" {
+			http.Redirect(w, req, "/target", http.StatusFound)
+			return
+		}
+		hangUp(w, req)
+	}}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	// the redirect is a response, it isn't followed
+	s := start(t, nil, server.URL+"/redirect")
+	s.checkSuccess(t, 5*time.Second)
+
+	if requests := r.received(); len(requests) != 1 || requests[0] != "HEAD /redirect" {
+		t.Fatalf("expected a single HEAD /redirect, received %q", requests)
+	}
+}
+
+func TestMaxTime(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for curl's 5s timeout")
+	}
+
+	release := make(chan struct{})
+	var once sync.Once
+	r := &recorder{}
+	r.handler = func(w http.ResponseWriter, req *http.Request) {
+		// the first request never gets an answer
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			<-release
+		}
+	}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	defer close(release)
+
+	begin := time.Now()
+	s := start(t, nil, server.URL+"/")
+	s.blocking(t, 4*time.Second)
+	s.checkSuccess(t, 5*time.Second)
+
+	if elapsed := time.Since(begin); elapsed < 5*time.Second {
+		t.Fatalf("block-until-url gave up on the first request after %v", elapsed)
+	}
+	if requests := r.received(); len(requests) != 2 {
+		t.Fatalf("expected a retry after the timeout, received %q", requests)
+	}
+}
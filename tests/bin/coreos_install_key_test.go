@@ -0,0 +1,313 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bin
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const coreosInstall = "../../bin/coreos-install"
+
+// keyExpiry only fails the tests in the key expiry CI job, so an expired
+// key doesn't break every run.
+var keyExpiry = flag.String("key-expiry", "warn", `what to do if no signing subkey of the coreos-install key is valid, "warn" or "fail"`)
+
+// signingKey is the image signing key embedded in coreos-install.
+type signingKey struct {
+	primary *packet.PublicKey
+	subkeys []subkey
+}
+
+// subkey is a subkey with the state its signatures give it.
+type subkey struct {
+	key     *packet.PublicKey
+	binding *packet.Signature
+	// nil unless the subkey was revoked
+	revocation *packet.Signature
+}
+
+func (s subkey) capabilities() string {
+	var caps string
+	for _, c := range []struct {
+		flag bool
+		cap  string
+	}{
+		{s.binding.FlagSign, "S"},
+		{s.binding.FlagCertify, "C"},
+		{s.binding.FlagEncryptCommunications || s.binding.FlagEncryptStorage, "E"},
+	} {
+		if c.flag {
+			caps += c.cap
+		}
+	}
+	return caps
+}
+
+// expires returns when the subkey expires, or the zero time if it doesn't.
+func (s subkey) expires() time.Time {
+	if s.binding.KeyLifetimeSecs == nil || *s.binding.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return s.key.CreationTime.Add(time.Duration(*s.binding.KeyLifetimeSecs) * time.Second)
+}
+
+func (s subkey) validForSigning(now time.Time) bool {
+	expires := s.expires()
+	return s.binding.FlagsValid && s.binding.FlagSign && s.revocation == nil &&
+		(expires.IsZero() || now.Before(expires))
+}
+
+// keyComment is the gpg2 --list-keys listing in the comment above GPG_KEY.
+type keyComment struct {
+	fingerprint string
+	created     string
+	subkeys     []subkeyComment
+}
+
+// subkeyComment is one "sub" line of the listing.
+type subkeyComment struct {
+	algorithm string
+	keyID     string
+	created   string
+	caps      string
+	// "expired", "expires", "revoked" or empty
+	status string
+	date   string
+}
+
+// readScriptKey returns the GPG_LONG_ID, the comment describing the key and
+// the armored GPG_KEY of coreos-install.
+func readScriptKey(t *testing.T) (string, string, string) {
+	data, err := ioutil.ReadFile(coreosInstall)
+	if err != nil {
+		t.Fatalf("reading %s: %v", coreosInstall, err)
+	}
+
+	match := regexp.MustCompile(`(?s)\n((?:#[^\n]*\n)+)GPG_LONG_ID="([0-9A-F]+)"\nGPG_KEY="([^"]*)"`).FindSubmatch(data)
+	if match == nil {
+		t.Fatalf("no commented GPG_LONG_ID and GPG_KEY found in %s", coreosInstall)
+	}
+	return string(match[2]), string(match[1]), string(match[3])
+}
+
+func parseSigningKey(armored string) (*signingKey, error) {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("decoding armor: %v", err)
+	}
+	if block.Type != "PGP PUBLIC KEY BLOCK" {
+		return nil, fmt.Errorf("unexpected armor type %q", block.Type)
+	}
+
+	var key signingKey
+	packets := packet.NewReader(block.Body)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading packets: %v", err)
+		}
+
+		switch p := p.(type) {
+		case *packet.PublicKey:
+			if !p.IsSubkey {
+				if key.primary != nil {
+					return nil, fmt.Errorf("more than one primary key")
+				}
+				key.primary = p
+				continue
+			}
+			if key.primary == nil {
+				return nil, fmt.Errorf("subkey %s before the primary key", p.KeyIdString())
+			}
+			key.subkeys = append(key.subkeys, subkey{key: p})
+		case *packet.Signature:
+			if len(key.subkeys) == 0 || (p.SigType != packet.SigTypeSubkeyBinding && p.SigType != packet.SigTypeSubkeyRevocation) {
+				// self-signatures of the primary key and its user ids
+				continue
+			}
+			sub := &key.subkeys[len(key.subkeys)-1]
+			if err := key.primary.VerifyKeySignature(sub.key, p); err != nil {
+				return nil, fmt.Errorf("subkey %s: bad signature: %v", sub.key.KeyIdString(), err)
+			}
+			if p.SigType == packet.SigTypeSubkeyRevocation {
+				sub.revocation = p
+			} else if sub.binding == nil || p.CreationTime.After(sub.binding.CreationTime) {
+				sub.binding = p
+			}
+		}
+	}
+
+	if key.primary == nil {
+		return nil, fmt.Errorf("no primary key")
+	}
+	for _, sub := range key.subkeys {
+		if sub.binding == nil {
+			return nil, fmt.Errorf("subkey %s has no binding signature", sub.key.KeyIdString())
+		}
+	}
+	return &key, nil
+}
+
+func parseKeyComment(comment string) (*keyComment, error) {
+	var parsed keyComment
+	pub := regexp.MustCompile(`(?m)^#\s+pub\s+\S+ (\d{4}-\d{2}-\d{2}) \[\w+\]\n#\s+([0-9A-F]{40})$`).FindStringSubmatch(comment)
+	if pub == nil {
+		return nil, fmt.Errorf("no pub line with a fingerprint")
+	}
+	parsed.created, parsed.fingerprint = pub[1], pub[2]
+
+	subRe := regexp.MustCompile(`^#\s+sub\s+([a-z]+\d*)/([0-9A-F]{8}) (\d{4}-\d{2}-\d{2}) \[(\w+)\](?: \[(expired|expires|revoked): (\d{4}-\d{2}-\d{2})\])?$`)
+	for _, line := range strings.Split(comment, "\n") {
+		if !regexp.MustCompile(`^#\s+sub\s`).MatchString(line) {
+			continue
+		}
+		sub := subRe.FindStringSubmatch(line)
+		if sub == nil {
+			return nil, fmt.Errorf("unparseable line %q", line)
+		}
+		parsed.subkeys = append(parsed.subkeys, subkeyComment{
+			algorithm: sub[1],
+			keyID:     sub[2],
+			created:   sub[3],
+			caps:      sub[4],
+			status:    sub[5],
+			date:      sub[6],
+		})
+	}
+	return &parsed, nil
+}
+
+// algorithm formats the algorithm of a key the way gpg2 does.
+func algorithm(key *packet.PublicKey) string {
+	bits, err := key.BitLength()
+	if err != nil {
+		return "unknown"
+	}
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSASignOnly:
+		return fmt.Sprintf("rsa%d", bits)
+	case packet.PubKeyAlgoDSA:
+		return fmt.Sprintf("dsa%d", bits)
+	default:
+		return fmt.Sprintf("algo%d", key.PubKeyAlgo)
+	}
+}
+
+func date(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func TestCoreosInstallKey(t *testing.T) {
+	if *keyExpiry != "fail" && *keyExpiry != "warn" {
+		t.Fatalf(`-key-expiry must be "fail" or "warn", not %q`, *keyExpiry)
+	}
+
+	longID, _, armored := readScriptKey(t)
+
+	key, err := parseSigningKey(armored)
+	if err != nil {
+		t.Fatalf("parsing GPG_KEY: %v", err)
+	}
+	if key.primary.KeyIdString() != longID {
+		t.Fatalf("GPG_LONG_ID %s doesn't match the primary key %s", longID, key.primary.KeyIdString())
+	}
+
+	now := time.Now()
+	var valid []string
+	for _, sub := range key.subkeys {
+		state := "valid"
+		if expires := sub.expires(); sub.revocation != nil {
+			state = "revoked " + date(sub.revocation.CreationTime)
+		} else if !expires.IsZero() && !now.Before(expires) {
+			state = "expired " + date(expires)
+		} else if !expires.IsZero() {
+			state = "valid until " + date(expires)
+		}
+		t.Logf("subkey %s created %s [%s] %s", sub.key.KeyIdString(), date(sub.key.CreationTime), sub.capabilities(), state)
+
+		if sub.validForSigning(now) {
+			valid = append(valid, sub.key.KeyIdString())
+		}
+	}
+
+	if len(valid) == 0 {
+		msg := fmt.Sprintf("no signing subkey of %s is valid, images can no longer be verified", longID)
+		if *keyExpiry == "warn" {
+			t.Logf("WARNING: %s", msg)
+		} else {
+			t.Errorf("%s", msg)
+		}
+	}
+}
+
+func TestCoreosInstallKeyComment(t *testing.T) {
+	_, comment, armored := readScriptKey(t)
+
+	key, err := parseSigningKey(armored)
+	if err != nil {
+		t.Fatalf("parsing GPG_KEY: %v", err)
+	}
+	listing, err := parseKeyComment(comment)
+	if err != nil {
+		t.Fatalf("parsing the key comment: %v", err)
+	}
+
+	fingerprint := fmt.Sprintf("%X", key.primary.Fingerprint)
+	if listing.fingerprint != fingerprint || listing.created != date(key.primary.CreationTime) {
+		t.Errorf("pub line describes %s created %s, the key is %s created %s",
+			listing.fingerprint, listing.created, fingerprint, date(key.primary.CreationTime))
+	}
+
+	if len(listing.subkeys) != len(key.subkeys) {
+		t.Fatalf("the comment lists %d subkeys, the key has %d", len(listing.subkeys), len(key.subkeys))
+	}
+	for i, sub := range key.subkeys {
+		var status, statusDate string
+		if expires := sub.expires(); sub.revocation != nil {
+			status, statusDate = "revoked", date(sub.revocation.CreationTime)
+		} else if !expires.IsZero() {
+			// whether gpg said expired or expires depends on when it ran
+			status, statusDate = "expire", date(expires)
+		}
+
+		listed := listing.subkeys[i]
+		actual := subkeyComment{
+			algorithm: algorithm(sub.key),
+			keyID:     sub.key.KeyIdShortString(),
+			created:   date(sub.key.CreationTime),
+			caps:      sub.capabilities(),
+			status:    status,
+			date:      statusDate,
+		}
+		if strings.HasPrefix(listed.status, "expire") {
+			listed.status = "expire"
+		}
+		if listed != actual {
+			t.Errorf("subkey %d: comment lists %+v, the key is %+v", i+1, listed, actual)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	logrotateConfig  = "../../configs/logrotate.conf"
+	logrotateService = "../../systemd/system/logrotate.service"
+	logrotateTimer   = "../../systemd/system/logrotate.timer"
+	// where the Makefile installs logrotate.conf
+	logrotateInstalled = "/usr/share/logrotate/logrotate.conf"
+)
+
+// unitValues returns the values of key in a unit file
+func unitValues(t *testing.T, path, key string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	var values []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, key+"=") {
+			values = append(values, strings.TrimPrefix(line, key+"="))
+		}
+	}
+	return values
+}
+
+func TestLogrotateTimer(t *testing.T) {
+	execStart := unitValues(t, logrotateService, "ExecStart")
+	if len(execStart) != 1 || !strings.HasSuffix(execStart[0], " "+logrotateInstalled) {
+		t.Fatalf("logrotate.service doesn't run %s: %q", logrotateInstalled, execStart)
+	}
+
+	calendars := unitValues(t, logrotateTimer, "OnCalendar")
+	if len(calendars) == 0 {
+		t.Fatalf("logrotate.timer has no OnCalendar")
+	}
+	if persistent := unitValues(t, logrotateTimer, "Persistent"); len(persistent) != 1 || persistent[0] != "true" {
+		t.Fatalf("logrotate.timer must catch up on missed runs: Persistent=%q", persistent)
+	}
+
+	if _, err := exec.LookPath("systemd-analyze"); err != nil {
+		t.Skip("systemd-analyze not found")
+	}
+	for _, calendar := range calendars {
+		out, err := exec.Command("systemd-analyze", "calendar", calendar).CombinedOutput()
+		if err != nil {
+			t.Fatalf("invalid OnCalendar=%s: %v: %s", calendar, err, out)
+		}
+		if !strings.Contains(string(out), "Normalized form: *-*-* 00:00:00") {
+			t.Fatalf("OnCalendar=%s isn't daily: %s", calendar, out)
+		}
+	}
+}
+
+// rotation is what logrotate --debug decided for a single log
+type rotation struct {
+	rotate      bool
+	missing     bool
+	rotateCount string
+	compress    bool
+}
+
+var (
+	considerRegexp = regexp.MustCompile(`^considering log (\S+)`)
+	countRegexp    = regexp.MustCompile(`log->rotateCount is (\d+)`)
+	missingRegexp  = regexp.MustCompile(`log (\S+) does not exist -- skipping`)
+)
+
+// parseLogrotateDebug groups the debug output by rotation pattern and
+// returns the decision for every log considered.
+func parseLogrotateDebug(output string) map[string]*rotation {
+	logs := map[string]*rotation{}
+	var group []*rotation
+	var current *rotation
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "rotating pattern:"):
+			group = nil
+			current = nil
+		case considerRegexp.MatchString(line):
+			current = &rotation{}
+			logs[considerRegexp.FindStringSubmatch(line)[1]] = current
+			group = append(group, current)
+		case missingRegexp.MatchString(line):
+			r := &rotation{missing: true}
+			logs[missingRegexp.FindStringSubmatch(line)[1]] = r
+		case strings.HasPrefix(line, "log needs rotating"):
+			if current != nil {
+				current.rotate = true
+			}
+		case countRegexp.MatchString(line):
+			for _, r := range group {
+				r.rotateCount = countRegexp.FindStringSubmatch(line)[1]
+			}
+		case strings.HasPrefix(line, "compressing log with"):
+			for _, r := range group {
+				r.compress = true
+			}
+		}
+	}
+	return logs
+}
+
+func writeLog(t *testing.T, path string, size int) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("creating %s: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
+
+func TestLogrotateConfig(t *testing.T) {
+	logrotate, err := exec.LookPath("logrotate")
+	if err != nil {
+		t.Skip("logrotate not found")
+	}
+
+	root, err := ioutil.TempDir("", "logrotate")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	// the shipped config with its absolute paths moved into root
+	data, err := ioutil.ReadFile(logrotateConfig)
+	if err != nil {
+		t.Fatalf("reading %s: %v", logrotateConfig, err)
+	}
+	config := strings.NewReplacer(
+		"include /etc/", "include "+root+"/etc/",
+		"/var/log/", root+"/var/log/",
+	).Replace(string(data))
+	configPath := filepath.Join(root, "logrotate.conf")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("writing %s: %v", configPath, err)
+	}
+
+	// a user config relying on the global defaults
+	log := func(name string) string { return filepath.Join(root, "var/log", name) }
+	userConfig := fmt.Sprintf("%s %s {\n    daily\n}\n", log("app/app.log"), log("app/missing.log"))
+	if err := os.MkdirAll(filepath.Join(root, "etc/logrotate.d"), 0755); err != nil {
+		t.Fatalf("creating logrotate.d: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "etc/logrotate.d/app"), []byte(userConfig), 0644); err != nil {
+		t.Fatalf("writing user config: %v", err)
+	}
+
+	writeLog(t, log("wtmp"), 2<<20)
+	writeLog(t, log("btmp"), 0)
+	writeLog(t, log("app/app.log"), 1024)
+
+	// app.log was last rotated two days ago
+	statePath := filepath.Join(root, "logrotate.status")
+	lastRun := time.Now().AddDate(0, 0, -2).Format("2006-1-2-15:4:5")
+	state := fmt.Sprintf("logrotate state -- version 2\n\"%s\" %s\n", log("app/app.log"), lastRun)
+	if err := ioutil.WriteFile(statePath, []byte(state), 0644); err != nil {
+		t.Fatalf("writing %s: %v", statePath, err)
+	}
+
+	out, err := exec.Command(logrotate, "--debug", "--state", statePath, configPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("logrotate --debug failed: %v: %s", err, out)
+	}
+	if strings.Contains(string(out), "error:") {
+		t.Fatalf("logrotate reported errors: %s", out)
+	}
+
+	expected := map[string]rotation{
+		// over the 1M size limit
+		log("wtmp"): {rotate: true, rotateCount: "1", compress: true},
+		// notifempty
+		log("btmp"): {},
+		// daily, with the global rotate 1 and compress
+		log("app/app.log"): {rotate: true, rotateCount: "1", compress: true},
+		// missingok
+		log("app/missing.log"): {missing: true},
+	}
+	logs := parseLogrotateDebug(string(out))
+	for path, e := range expected {
+		r, ok := logs[path]
+		if !ok {
+			t.Errorf("%s wasn't considered:\n%s", path, out)
+			continue
+		}
+		if *r != e {
+			t.Errorf("%s: expected %+v, received %+v", path, e, *r)
+		}
+	}
+	if t.Failed() {
+		t.Logf("logrotate --debug output:\n%s", out)
+	}
+
+	// --debug must not touch anything
+	if info, err := os.Stat(log("wtmp")); err != nil || info.Size() != 2<<20 {
+		t.Fatalf("wtmp was modified: %v", err)
+	}
+}
+
+func TestParseLogrotateDebug(t *testing.T) {
+	output := `reading config file /tmp/logrotate.conf
+including /tmp/etc/logrotate.d
+Handling 2 logs
+
+rotating pattern: /tmp/var/log/wtmp  1048576 bytes (1 rotations)
+empty log files are not rotated, old logs are removed
+considering log /tmp/var/log/wtmp
+  Now: 2017-10-19 16:00
+  Last rotated at 2017-10-19 16:00
+  log needs rotating
+rotating log /tmp/var/log/wtmp, log->rotateCount is 1
+dateext suffix '-20171019'
+compressing log with: /bin/gzip
+
+rotating pattern: /tmp/var/log/app/app.log /tmp/var/log/app/missing.log  after 1 days (1 rotations)
+considering log /tmp/var/log/app/app.log
+  log does not need rotating (log has been rotated at 2017-10-19 16:00, which is less than a day ago)
+  log /tmp/var/log/app/missing.log does not exist -- skipping
+`
+	logs := parseLogrotateDebug(output)
+	expected := map[string]rotation{
+		"/tmp/var/log/wtmp":            {rotate: true, rotateCount: "1", compress: true},
+		"/tmp/var/log/app/app.log":     {},
+		"/tmp/var/log/app/missing.log": {missing: true},
+	}
+	if len(logs) != len(expected) {
+		t.Fatalf("expected %d logs, received %d", len(expected), len(logs))
+	}
+	for path, e := range expected {
+		if r := logs[path]; r == nil || *r != e {
+			t.Errorf("%s: expected %+v, received %+v", path, e, r)
+		}
+	}
+}
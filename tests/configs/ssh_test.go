@@ -0,0 +1,264 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configs
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coreos/init/tests/coreos-install/util"
+)
+
+const (
+	sshdConfig = "../../configs/sshd_config"
+	sshConfig  = "../../configs/ssh_config"
+)
+
+// rule is a policy for a single directive, as printed by sshd -T and
+// ssh -G. Exactly one of oneOf and subsetOf is set.
+type rule struct {
+	// the value must be one of these
+	oneOf []string
+	// every item of the comma separated list must be one of these
+	subsetOf []string
+	// the config file must set the directive
+	required bool
+}
+
+var (
+	allowedCiphers = []string{
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+	}
+	allowedMACs = []string{
+		"umac-64-etm@openssh.com", "umac-128-etm@openssh.com",
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha1-etm@openssh.com",
+		"umac-64@openssh.com", "umac-128@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1",
+	}
+	allowedKex = []string{
+		"mlkem768x25519-sha256",
+		"sntrup761x25519-sha512", "sntrup761x25519-sha512@openssh.com",
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group-exchange-sha256",
+		"diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+	}
+)
+
+var sshdPolicy = map[string]rule{
+	"ciphers":                 {subsetOf: allowedCiphers},
+	"macs":                    {subsetOf: allowedMACs},
+	"kexalgorithms":           {subsetOf: allowedKex},
+	"permitrootlogin":         {oneOf: []string{"no", "prohibit-password", "without-password"}},
+	"permitemptypasswords":    {oneOf: []string{"no"}},
+	"passwordauthentication":  {oneOf: []string{"yes"}},
+	"usepam":                  {oneOf: []string{"yes"}, required: true},
+	"useprivilegeseparation":  {oneOf: []string{"yes", "sandbox"}},
+	"usedns":                  {oneOf: []string{"no"}, required: true},
+	"clientaliveinterval":     {oneOf: []string{"180"}, required: true},
+	"clientalivecountmax":     {oneOf: []string{"3"}},
+	"printmotd":               {oneOf: []string{"no"}, required: true},
+	"printlastlog":            {oneOf: []string{"no"}, required: true},
+	"subsystem":               {oneOf: []string{"sftp internal-sftp"}, required: true},
+	"protocol":                {oneOf: []string{"2"}},
+	"hostbasedauthentication": {oneOf: []string{"no"}},
+	"permituserenvironment":   {oneOf: []string{"no"}},
+}
+
+var sshPolicy = map[string]rule{
+	"ciphers":                 {subsetOf: allowedCiphers},
+	"macs":                    {subsetOf: allowedMACs},
+	"kexalgorithms":           {subsetOf: allowedKex},
+	"forwardagent":            {oneOf: []string{"no"}},
+	"forwardx11":              {oneOf: []string{"no"}},
+	"hostbasedauthentication": {oneOf: []string{"no"}},
+	"stricthostkeychecking":   {oneOf: []string{"ask", "true", "yes"}},
+	"protocol":                {oneOf: []string{"2"}},
+	"permitlocalcommand":      {oneOf: []string{"no"}},
+}
+
+// parseSettings parses "key value" lines, merging repeated keys
+func parseSettings(output string) map[string][]string {
+	settings := map[string][]string{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.ToLower(fields[0])
+		settings[key] = append(settings[key], fields[1])
+	}
+	return settings
+}
+
+// checkPolicy returns the directives of settings which violate policy.
+// Directives missing from settings, e.g. because this OpenSSH version
+// no longer knows them, pass unless the settings were read from the config
+// file and the policy requires them.
+func checkPolicy(source string, settings map[string][]string, policy map[string]rule, file bool) []error {
+	var directives []string
+	for directive := range policy {
+		directives = append(directives, directive)
+	}
+	sort.Strings(directives)
+
+	var errs []error
+	for _, directive := range directives {
+		r := policy[directive]
+		if file && r.required && len(settings[directive]) == 0 {
+			errs = append(errs, fmt.Errorf("%s: missing directive %s", source, directive))
+		}
+		for _, value := range settings[directive] {
+			switch {
+			case r.oneOf != nil:
+				if !contains(r.oneOf, value) {
+					errs = append(errs, fmt.Errorf("%s: %s %s violates policy, expected one of %q", source, directive, value, r.oneOf))
+				}
+			case r.subsetOf != nil:
+				for _, item := range strings.Split(value, ",") {
+					if !contains(r.subsetOf, item) {
+						errs = append(errs, fmt.Errorf("%s: %s contains %s, which isn't allowed", source, directive, item))
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// configDirectives returns the directives set in a config file, to check
+// the file itself rather than what the local OpenSSH makes of it.
+func configDirectives(t *testing.T, path string) map[string][]string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	return parseSettings(strings.Join(lines, "\n"))
+}
+
+func TestSSHDConfigPolicy(t *testing.T) {
+	// the file alone, e.g. a deprecated UsePrivilegeSeparation no
+	for _, err := range checkPolicy(sshdConfig, configDirectives(t, sshdConfig), sshdPolicy, true) {
+		t.Error(err)
+	}
+
+	sshd, err := exec.LookPath("sshd")
+	if err != nil {
+		t.Skip("sshd not found")
+	}
+
+	dir, err := ioutil.TempDir("", "sshd-config")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var args []string
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		key := filepath.Join(dir, "ssh_host_"+keyType+"_key")
+		util.MustRun(t, "ssh-keygen", "-q", "-t", keyType, "-N", "", "-f", key)
+		args = append(args, "-h", key)
+	}
+	args = append([]string{"-f", sshdConfig}, args...)
+
+	// -t reports syntax errors, -T prints the effective settings for a
+	// typical connection
+	util.MustRun(t, sshd, append([]string{"-t"}, args...)...)
+	out := util.MustRun(t, sshd, append([]string{"-T", "-C", "user=core,host=client.example.com,addr=192.0.2.1"}, args...)...)
+
+	for _, err := range checkPolicy("sshd -T", parseSettings(string(out)), sshdPolicy, false) {
+		t.Error(err)
+	}
+}
+
+func TestSSHConfigPolicy(t *testing.T) {
+	for _, err := range checkPolicy(sshConfig, configDirectives(t, sshConfig), sshPolicy, true) {
+		t.Error(err)
+	}
+
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not found")
+	}
+
+	out := util.MustRun(t, "ssh", "-G", "-F", sshConfig, "core@host.example.com")
+	for _, err := range checkPolicy("ssh -G", parseSettings(string(out)), sshPolicy, false) {
+		t.Error(err)
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	settings := parseSettings(`Ciphers aes256-ctr,3des-cbc,arcfour
+PermitRootLogin yes
+UseDNS no
+`)
+	policy := map[string]rule{
+		"ciphers":         {subsetOf: allowedCiphers},
+		"permitrootlogin": {oneOf: []string{"no"}},
+		"usedns":          {oneOf: []string{"no"}},
+		"usepam":          {oneOf: []string{"yes"}, required: true},
+	}
+
+	expected := []string{
+		"test: ciphers contains 3des-cbc, which isn't allowed",
+		"test: ciphers contains arcfour, which isn't allowed",
+		`test: permitrootlogin yes violates policy, expected one of ["no"]`,
+	}
+	var received []string
+	for _, err := range checkPolicy("test", settings, policy, false) {
+		received = append(received, err.Error())
+	}
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected errors: expected %q, received %q", expected, received)
+	}
+
+	// a config file must set the required directives
+	expected = append(expected, "test: missing directive usepam")
+	received = nil
+	for _, err := range checkPolicy("test", settings, policy, true) {
+		received = append(received, err.Error())
+	}
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected errors: expected %q, received %q", expected, received)
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
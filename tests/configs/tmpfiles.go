@@ -0,0 +1,208 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package configs holds helpers for testing the files in configs. The
+// tmpfiles.d interpreter covers just the line types used there, for
+// hosts without systemd-tmpfiles.
+package configs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TmpfilesEntry is a single line of a tmpfiles.d file.
+type TmpfilesEntry struct {
+	Line     int
+	Type     string
+	Path     string
+	Mode     string
+	User     string
+	Group    string
+	Age      string
+	Argument string
+}
+
+// tmpfilesFieldsRegexp matches the fields before the argument of a line.
+var tmpfilesFieldsRegexp = regexp.MustCompile(`^(?:\S+\s+){6}`)
+
+// ParseTmpfiles parses a tmpfiles.d file read from r.
+func ParseTmpfiles(name string, r io.Reader) ([]TmpfilesEntry, error) {
+	var entries []TmpfilesEntry
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing path", name, lineno)
+		}
+		// the argument is the rest of the line, whitespace included
+		if len(fields) > 7 {
+			start := tmpfilesFieldsRegexp.FindStringIndex(line)[1]
+			fields[6] = line[start:]
+			fields = fields[:7]
+		}
+		for len(fields) < 7 {
+			fields = append(fields, "-")
+		}
+
+		entry := TmpfilesEntry{
+			Line:     lineno,
+			Type:     fields[0],
+			Path:     fields[1],
+			Mode:     fields[2],
+			User:     fields[3],
+			Group:    fields[4],
+			Age:      fields[5],
+			Argument: fields[6],
+		}
+		if entry.Argument == "-" {
+			entry.Argument = ""
+		}
+		if !filepath.IsAbs(entry.Path) {
+			return nil, fmt.Errorf("%s:%d: path %q is not absolute", name, lineno, entry.Path)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", name, err)
+	}
+
+	return entries, nil
+}
+
+// ApplyTmpfiles creates the entries below root, like
+// systemd-tmpfiles --root=root --create. Only the d, D, f, f+, L and L+
+// types are supported.
+func ApplyTmpfiles(root string, entries []TmpfilesEntry) error {
+	for _, entry := range entries {
+		if err := apply(root, entry); err != nil {
+			return fmt.Errorf("line %d: %s: %v", entry.Line, entry.Path, err)
+		}
+	}
+	return nil
+}
+
+func apply(root string, entry TmpfilesEntry) error {
+	path := filepath.Join(root, entry.Path)
+
+	switch entry.Type {
+	case "d", "D":
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		err := os.Mkdir(path, 0755)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		return setAttrs(path, entry, 0755, err == nil)
+	case "f", "f+":
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if entry.Type == "f+" {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(path, flags, 0644)
+		if os.IsExist(err) {
+			return setAttrs(path, entry, 0644, false)
+		} else if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(entry.Argument); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return setAttrs(path, entry, 0644, true)
+	case "L", "L+":
+		if entry.Argument == "" {
+			return fmt.Errorf("symlink without a target")
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if entry.Type == "L+" {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+		if err := os.Symlink(entry.Argument, path); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %q", entry.Type)
+	}
+}
+
+// setAttrs applies the mode and owner of entry to path. The default mode
+// only applies to paths which were just created.
+func setAttrs(path string, entry TmpfilesEntry, defaultMode os.FileMode, created bool) error {
+	if entry.Mode != "-" || created {
+		mode := defaultMode
+		if entry.Mode != "-" {
+			m, err := strconv.ParseUint(entry.Mode, 8, 32)
+			if err != nil {
+				return fmt.Errorf("invalid mode %q", entry.Mode)
+			}
+			mode = os.FileMode(m)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+
+	uid, err := lookupID(entry.User)
+	if err != nil {
+		return err
+	}
+	gid, err := lookupID(entry.Group)
+	if err != nil {
+		return err
+	}
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// lookupID resolves numeric ids and root, the passwd of the root being
+// configured isn't consulted. It returns -1 for "-".
+func lookupID(name string) (int, error) {
+	switch name {
+	case "-":
+		return -1, nil
+	case "root":
+		return 0, nil
+	}
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported user or group %q", name)
+	}
+	return id, nil
+}
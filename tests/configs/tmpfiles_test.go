@@ -0,0 +1,312 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configs
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/coreos/init/tests/coreos-install/util"
+)
+
+const tmpfilesDir = "../../configs/tmpfiles.d"
+
+type manifestEntry struct {
+	path   string
+	typ    string
+	mode   string
+	target string
+}
+
+func readManifest(t *testing.T, path string) []manifestEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			t.Fatalf("invalid manifest line %q", line)
+		}
+		entries = append(entries, manifestEntry{fields[0], fields[1], fields[2], fields[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return entries
+}
+
+func tmpfilesConfigs(t *testing.T) []string {
+	// systemd-tmpfiles resolves relative paths against --root
+	dir, err := filepath.Abs(tmpfilesDir)
+	if err != nil {
+		t.Fatalf("resolving %s: %v", tmpfilesDir, err)
+	}
+	configs, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil || len(configs) == 0 {
+		t.Fatalf("no configs in %s: %v", dir, err)
+	}
+	return configs
+}
+
+// appliers apply the given tmpfiles.d files below a root
+var appliers = []struct {
+	name  string
+	apply func(t *testing.T, root string, configs []string)
+}{
+	{
+		name: "systemd-tmpfiles",
+		apply: func(t *testing.T, root string, configs []string) {
+			if _, err := exec.LookPath("systemd-tmpfiles"); err != nil {
+				t.Skip("systemd-tmpfiles not found")
+			}
+			args := append([]string{"--root=" + root, "--create"}, configs...)
+			util.MustRun(t, "systemd-tmpfiles", args...)
+		},
+	},
+	{
+		name: "builtin",
+		apply: func(t *testing.T, root string, configs []string) {
+			for _, config := range configs {
+				f, err := os.Open(config)
+				if err != nil {
+					t.Fatalf("opening %s: %v", config, err)
+				}
+				entries, err := ParseTmpfiles(filepath.Base(config), f)
+				f.Close()
+				if err != nil {
+					t.Fatalf("parsing: %v", err)
+				}
+				if err := ApplyTmpfiles(root, entries); err != nil {
+					t.Fatalf("applying %s: %v", config, err)
+				}
+			}
+		},
+	},
+}
+
+// freshRoot returns a root with nothing but /usr/share/ssh, where the
+// Makefile installs the ssh configs.
+func freshRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "tmpfiles")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	for _, name := range []string{"ssh_config", "sshd_config"} {
+		target := filepath.Join(root, "usr/share/ssh", name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatalf("creating %s: %v", filepath.Dir(target), err)
+		}
+		util.MustRun(t, "cp", filepath.Join("../../configs", name), target)
+	}
+	return root
+}
+
+// walk lists everything below root outside of /usr
+func walk(t *testing.T, root string) []string {
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(path, root), "/")
+		if rel == "/" || rel == "/usr" {
+			if rel == "/usr" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking %s: %v", root, err)
+	}
+	return paths
+}
+
+func checkManifest(t *testing.T, root string, manifest []manifestEntry) {
+	var expected []string
+	for _, entry := range manifest {
+		expected = append(expected, entry.path)
+		path := filepath.Join(root, entry.path)
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Errorf("%s: %v", entry.path, err)
+			continue
+		}
+		if st := info.Sys().(*syscall.Stat_t); int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid() {
+			t.Errorf("%s: expected owner %d:%d, received %d:%d", entry.path, os.Getuid(), os.Getgid(), st.Uid, st.Gid)
+		}
+
+		switch entry.typ {
+		case "d":
+			if !info.IsDir() {
+				t.Errorf("%s: expected a directory, received %v", entry.path, info.Mode())
+			}
+		case "f":
+			if !info.Mode().IsRegular() {
+				t.Errorf("%s: expected a file, received %v", entry.path, info.Mode())
+			}
+		case "L":
+			if info.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("%s: expected a symlink, received %v", entry.path, info.Mode())
+				continue
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				t.Errorf("%s: %v", entry.path, err)
+			} else if target != entry.target {
+				t.Errorf("%s: expected target %s, received %s", entry.path, entry.target, target)
+			}
+			// links into /usr must not dangle on a fresh root
+			if strings.HasPrefix(target, "/usr/") {
+				if _, err := os.Stat(filepath.Join(root, target)); err != nil {
+					t.Errorf("%s: dangling link: %v", entry.path, err)
+				}
+			}
+		default:
+			t.Fatalf("%s: unknown manifest type %q", entry.path, entry.typ)
+		}
+
+		if entry.mode != "-" {
+			mode, err := strconv.ParseUint(entry.mode, 8, 32)
+			if err != nil {
+				t.Fatalf("%s: invalid manifest mode %q", entry.path, entry.mode)
+			}
+			if info.Mode().Perm() != os.FileMode(mode) {
+				t.Errorf("%s: expected mode %#o, received %#o", entry.path, mode, info.Mode().Perm())
+			}
+		}
+	}
+
+	// nothing beyond the manifest
+	received := walk(t, root)
+	sort.Strings(expected)
+	sort.Strings(received)
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected paths: expected %q, received %q", expected, received)
+	}
+}
+
+func TestTmpfiles(t *testing.T) {
+	manifest := readManifest(t, "testdata/tmpfiles.manifest")
+	configs := tmpfilesConfigs(t)
+
+	for _, applier := range appliers {
+		t.Run(applier.name, func(t *testing.T) {
+			root := freshRoot(t)
+			defer os.RemoveAll(root)
+
+			applier.apply(t, root, configs)
+			checkManifest(t, root, manifest)
+
+			// applying again at the next boot changes nothing
+			applier.apply(t, root, configs)
+			checkManifest(t, root, manifest)
+		})
+	}
+}
+
+func TestTmpfilesKeepsCustomizations(t *testing.T) {
+	configs := tmpfilesConfigs(t)
+
+	for _, applier := range appliers {
+		t.Run(applier.name, func(t *testing.T) {
+			root := freshRoot(t)
+			defer os.RemoveAll(root)
+
+			// a user replaced the link with their own sshd_config
+			sshdConfig := filepath.Join(root, "etc/ssh/sshd_config")
+			if err := os.MkdirAll(filepath.Dir(sshdConfig), 0700); err != nil {
+				t.Fatalf("creating %s: %v", filepath.Dir(sshdConfig), err)
+			}
+			if err := ioutil.WriteFile(sshdConfig, []byte("PermitRootLogin no\n"), 0600); err != nil {
+				t.Fatalf("writing %s: %v", sshdConfig, err)
+			}
+
+			applier.apply(t, root, configs)
+
+			data, err := ioutil.ReadFile(sshdConfig)
+			if err != nil {
+				t.Fatalf("reading %s: %v", sshdConfig, err)
+			}
+			if string(data) != "PermitRootLogin no\n" {
+				t.Fatalf("customized sshd_config was replaced: %q", data)
+			}
+			// without a mode, an existing directory keeps its own
+			info, err := os.Stat(filepath.Dir(sshdConfig))
+			if err != nil {
+				t.Fatalf("checking /etc/ssh: %v", err)
+			}
+			if info.Mode().Perm() != 0700 {
+				t.Fatalf("expected /etc/ssh to keep mode 0700, received %#o", info.Mode().Perm())
+			}
+
+			// the untouched link is still created
+			if target, err := os.Readlink(filepath.Join(root, "etc/ssh/ssh_config")); err != nil || target != "/usr/share/ssh/ssh_config" {
+				t.Fatalf("unexpected ssh_config link: %q, %v", target, err)
+			}
+		})
+	}
+}
+
+func TestParseTmpfiles(t *testing.T) {
+	entries, err := ParseTmpfiles("test.conf", strings.NewReader(`# comment
+
+d /var/lib/foo 0700 core core 10d
+f /etc/motd.d/foo.conf - - - - Hello  world
+L /etc/foo
+`))
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	expected := []TmpfilesEntry{
+		{Line: 3, Type: "d", Path: "/var/lib/foo", Mode: "0700", User: "core", Group: "core", Age: "10d"},
+		{Line: 4, Type: "f", Path: "/etc/motd.d/foo.conf", Mode: "-", User: "-", Group: "-", Age: "-", Argument: "Hello  world"},
+		{Line: 5, Type: "L", Path: "/etc/foo", Mode: "-", User: "-", Group: "-", Age: "-"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, received %+v", len(expected), entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("expected %+v, received %+v", expected[i], entries[i])
+		}
+	}
+
+	for _, line := range []string{"d", "d relative/path"} {
+		if _, err := ParseTmpfiles("test.conf", strings.NewReader(line)); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
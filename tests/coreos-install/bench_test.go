@@ -0,0 +1,176 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/init/tests/coreos-install/installer"
+	"github.com/coreos/init/tests/coreos-install/metrics"
+	"github.com/coreos/init/tests/coreos-install/register"
+	"github.com/coreos/init/tests/coreos-install/util"
+)
+
+var flagBenchLimits string
+
+func init() {
+	flag.StringVar(&flagBenchLimits, "bench-limits", "0", "comma separated server bandwidths in MB/s to benchmark mirror installs with, 0 for unlimited")
+}
+
+// benchImage is downloaded once for all benchmarks and removed by TestMain.
+var benchImage struct {
+	once sync.Once
+	dir  string
+}
+
+func benchImageDir(b *testing.B) string {
+	capabilities := register.ProbeCapabilities()
+	if reason := capabilities.Missing(register.CapNetwork, register.CapRoot, register.CapLoop,
+		register.CapLoopPartitions, register.CapInstallTools); reason != "" {
+		b.Skip(reason)
+	}
+
+	benchImage.once.Do(func() {
+		benchImage.dir = util.FetchLocalImage(b)
+	})
+	if benchImage.dir == "" {
+		b.Fatalf("no image to install")
+	}
+	return benchImage.dir
+}
+
+// BenchmarkInstallLocalFile installs the image with -f, which measures
+// decompressing and writing alone.
+func BenchmarkInstallLocalFile(b *testing.B) {
+	opts := installer.Options{
+		BinaryPath: flagBinaryPath,
+		ImageFile:  filepath.Join(benchImageDir(b), "coreos_production_image.bin.bz2"),
+	}
+	benchmarkInstall(b, opts, nil)
+}
+
+// BenchmarkInstallMirror installs the image from the local server, which
+// adds downloading and verifying, at each bandwidth of -bench-limits.
+func BenchmarkInstallMirror(b *testing.B) {
+	dir := benchImageDir(b)
+	for _, field := range strings.Split(flagBenchLimits, ",") {
+		limit, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || limit < 0 {
+			b.Fatalf("invalid bandwidth %q in -bench-limits", field)
+		}
+
+		name := "unlimited"
+		if limit > 0 {
+			name = fmt.Sprintf("%gMBps", limit)
+		}
+		server := &util.HTTPServer{
+			FileDir: dir,
+			Limit:   int64(limit * metrics.MB),
+		}
+		opts := installer.Options{
+			BinaryPath: flagBinaryPath,
+			BaseURL:    server.Start(b),
+			Version:    "current",
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmarkInstall(b, opts, server.BytesServed)
+		})
+	}
+}
+
+// benchmarkInstall installs to a new disk b.N times, timing only
+// coreos-install. The bytes per operation are those written to the disk,
+// so the MB/s reported are of decompressed data.
+func benchmarkInstall(b *testing.B, opts installer.Options, bytesServed func() int64) {
+	tmpDir := os.Getenv("TMPDIR")
+	if tmpDir == "" {
+		// the disks are too large for a tmpfs /tmp
+		tmpDir = "/var/tmp"
+	}
+	dir, err := ioutil.TempDir(tmpDir, "coreos-install-bench")
+	if err != nil {
+		b.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	if err := os.Setenv("TMPDIR", dir); err != nil {
+		b.Fatalf("couldn't set TMPDIR env var: %v", err)
+	}
+
+	var test register.Test
+	var written, served int64
+	var user, system time.Duration
+	var writeMBps float64
+
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		diskFile, loopDevice := test.CreateDevice(b)
+		opts.Device = loopDevice
+		recorder := metrics.NewRecorder()
+		opts.Output = recorder.Line
+		writtenBefore, err := metrics.BytesWritten(loopDevice)
+		if err != nil {
+			test.CleanupDisk(b, diskFile, loopDevice)
+			b.Fatalf("reading bytes written: %v", err)
+		}
+		var servedBefore int64
+		if bytesServed != nil {
+			servedBefore = bytesServed()
+		}
+
+		b.StartTimer()
+		res, err := installer.Run(context.Background(), opts)
+		b.StopTimer()
+
+		if err != nil {
+			test.CleanupDisk(b, diskFile, loopDevice)
+			b.Fatalf("install failed: %v", err)
+		}
+		writtenAfter, err := metrics.BytesWritten(loopDevice)
+		if err != nil {
+			test.CleanupDisk(b, diskFile, loopDevice)
+			b.Fatalf("reading bytes written: %v", err)
+		}
+		var servedAfter int64
+		if bytesServed != nil {
+			servedAfter = bytesServed()
+		}
+		test.CleanupDisk(b, diskFile, loopDevice)
+		os.Remove(diskFile)
+
+		m := recorder.Finish(writtenAfter-writtenBefore, servedAfter-servedBefore)
+		written += m.BytesWritten
+		served += m.BytesServed
+		writeMBps += m.WriteMBps
+		user += res.UserTime
+		system += res.SystemTime
+	}
+
+	n := int64(b.N)
+	b.SetBytes(written / n)
+	b.Logf("%d installs: %d MB written, %d MB served, %.1f MB/s while writing, CPU %v user %v system per install",
+		b.N, written/n/metrics.MB, served/n/metrics.MB, writeMBps/float64(n),
+		user/time.Duration(n), system/time.Duration(n))
+}
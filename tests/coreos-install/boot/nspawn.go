@@ -0,0 +1,237 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package boot boots an installed Container Linux root and collects what
+// the units shipped in this repository produced.
+package boot
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Units are the units whose state is collected after booting.
+var Units = []string{
+	"issuegen.service",
+	"motdgen.service",
+	"sshd-keygen.service",
+	"remount-root.service",
+	"setup-nsswitch.service",
+}
+
+// Files are the generated files collected after booting.
+var Files = []string{
+	"/run/issue",
+	"/run/coreos/motd",
+	"/etc/nsswitch.conf",
+	"/etc/ssh/ssh_host_rsa_key.pub",
+	"/etc/ssh/ssh_host_ecdsa_key.pub",
+	"/etc/ssh/ssh_host_ed25519_key.pub",
+}
+
+// UnitState is the state of a unit as reported by systemctl show.
+type UnitState struct {
+	ActiveState     string
+	Result          string
+	ConditionResult string
+}
+
+// Report is what a booted system looked like once multi-user.target was
+// reached.
+type Report struct {
+	// Failed lists the units reported by systemctl --failed.
+	Failed []string
+	// Units maps each of Units to its state.
+	Units map[string]UnitState
+	// Files maps each of Files which existed to its contents.
+	Files map[string]string
+	// Console is the output of the container.
+	Console string
+}
+
+// resultsDir is where the results directory is bound in the container
+const resultsDir = "/var/lib/coreos-install-boot"
+
+const checkUnit = "coreos-install-boot-check.service"
+
+// the collecting unit runs once multi-user.target is reached and powers
+// the container off when it is done
+const checkUnitData = `[Unit]
+Description=Collect coreos-install boot test results
+After=multi-user.target
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh ` + resultsDir + `/collect.sh
+ExecStopPost=/usr/bin/systemctl poweroff --no-block
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const collectScript = `set -u
+cd "$(dirname "$0")"
+systemctl --failed --no-legend --plain | cut -d' ' -f1 > failed
+mkdir -p units files
+for unit in $UNITS; do
+	systemctl show -p ActiveState -p Result -p ConditionResult "$unit" > "units/$unit"
+done
+for file in $FILES; do
+	if [ -e "$file" ]; then
+		cp "$file" "files/$(echo "${file#/}" | tr / _)"
+	fi
+done
+touch done
+`
+
+// Nspawn boots root, a mounted installation with /usr and the OEM
+// partition mounted below it, with systemd-nspawn and waits up to timeout
+// for multi-user.target. The collecting unit is left installed in root.
+func Nspawn(root string, timeout time.Duration) (*Report, error) {
+	nspawn, err := exec.LookPath("systemd-nspawn")
+	if err != nil {
+		return nil, fmt.Errorf("systemd-nspawn not found: %v", err)
+	}
+
+	results, err := ioutil.TempDir("", "coreos-install-boot")
+	if err != nil {
+		return nil, fmt.Errorf("creating results dir: %v", err)
+	}
+	defer os.RemoveAll(results)
+
+	script := fmt.Sprintf("UNITS=%q\nFILES=%q\n%s", strings.Join(Units, " "), strings.Join(Files, " "), collectScript)
+	if err := ioutil.WriteFile(filepath.Join(results, "collect.sh"), []byte(script), 0755); err != nil {
+		return nil, fmt.Errorf("writing collect.sh: %v", err)
+	}
+	if err := installCheckUnit(root); err != nil {
+		return nil, err
+	}
+
+	var console bytes.Buffer
+	cmd := exec.Command(nspawn,
+		"--quiet",
+		"--boot",
+		"--register=no",
+		"--directory="+root,
+		"--machine="+fmt.Sprintf("coreos-install-%d", os.Getpid()),
+		"--bind="+results+":"+resultsDir)
+	cmd.Stdout = &console
+	cmd.Stderr = &console
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting systemd-nspawn: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		// nspawn shuts the container down cleanly on SIGTERM
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			cmd.Process.Kill()
+			<-done
+		}
+		return nil, fmt.Errorf("multi-user.target wasn't reached within %v:\n%s", timeout, console.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("systemd-nspawn failed: %v:\n%s", err, console.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(results, "done")); err != nil {
+		return nil, fmt.Errorf("the container shut down without collecting results:\n%s", console.String())
+	}
+	report, err := readResults(results)
+	if err != nil {
+		return nil, err
+	}
+	report.Console = console.String()
+	return report, nil
+}
+
+func installCheckUnit(root string) error {
+	unitDir := filepath.Join(root, "etc", "systemd", "system")
+	wantsDir := filepath.Join(unitDir, "multi-user.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return fmt.Errorf("creating %s: %v", wantsDir, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(unitDir, checkUnit), []byte(checkUnitData), 0644); err != nil {
+		return fmt.Errorf("writing %s: %v", checkUnit, err)
+	}
+	link := filepath.Join(wantsDir, checkUnit)
+	os.Remove(link)
+	if err := os.Symlink("../"+checkUnit, link); err != nil {
+		return fmt.Errorf("enabling %s: %v", checkUnit, err)
+	}
+	return nil
+}
+
+func readResults(dir string) (*Report, error) {
+	report := &Report{
+		Units: map[string]UnitState{},
+		Files: map[string]string{},
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "failed"))
+	if err != nil {
+		return nil, fmt.Errorf("reading failed units: %v", err)
+	}
+	report.Failed = strings.Fields(string(data))
+
+	for _, unit := range Units {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "units", unit))
+		if err != nil {
+			return nil, fmt.Errorf("reading state of %s: %v", unit, err)
+		}
+		var state UnitState
+		for _, line := range strings.Split(string(data), "\n") {
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "ActiveState":
+				state.ActiveState = parts[1]
+			case "Result":
+				state.Result = parts[1]
+			case "ConditionResult":
+				state.ConditionResult = parts[1]
+			}
+		}
+		report.Units[unit] = state
+	}
+
+	for _, file := range Files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "files", strings.Replace(strings.TrimPrefix(file, "/"), "/", "_", -1)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", file, err)
+		}
+		report.Files[file] = string(data)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,293 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package boot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firmware selects how QEMU boots the disk.
+type Firmware string
+
+const (
+	BIOS Firmware = "bios"
+	UEFI Firmware = "uefi"
+)
+
+// DefaultOVMF is where most distributions ship the OVMF firmware.
+const DefaultOVMF = "/usr/share/OVMF/OVMF_CODE.fd"
+
+// the shell prompt of the autologin console
+var promptRegexp = regexp.MustCompile(`core@[^ ]+ [^ ]+ \$ $`)
+
+// QEMUOptions configures a QEMU boot.
+type QEMUOptions struct {
+	// Disk is the installed disk image or device.
+	Disk     string
+	Firmware Firmware
+	// OVMF is the UEFI firmware, defaults to DefaultOVMF.
+	OVMF string
+	// MemoryMB defaults to 2048.
+	MemoryMB int
+	// Console receives everything written to the serial console.
+	Console io.Writer
+}
+
+// EnableAutologin makes the installed system log in core on the serial
+// console by appending to grub.cfg on the mounted OEM partition oemDir.
+func EnableAutologin(oemDir string) error {
+	path := filepath.Join(oemDir, "grub.cfg")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(`
+# added by the coreos-install boot tests
+set linux_console="console=ttyS0,115200n8"
+set linux_append="$linux_append coreos.autologin=ttyS0"
+`)
+	if err != nil {
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// Machine is a running QEMU virtual machine driven through its serial
+// console.
+type Machine struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	started time.Time
+	done    chan error
+	varsDir string
+
+	mu      sync.Mutex
+	console bytes.Buffer
+	// console output before offset was consumed by Expect
+	offset int
+	exited bool
+
+	commands int
+}
+
+// QEMU boots opts.Disk with TCG, so no KVM is required.
+func QEMU(opts QEMUOptions) (*Machine, error) {
+	qemu, err := exec.LookPath("qemu-system-x86_64")
+	if err != nil {
+		return nil, fmt.Errorf("qemu-system-x86_64 not found: %v", err)
+	}
+	if opts.MemoryMB == 0 {
+		opts.MemoryMB = 2048
+	}
+
+	m := &Machine{done: make(chan error, 1)}
+	args := []string{
+		"-machine", "accel=tcg",
+		"-m", strconv.Itoa(opts.MemoryMB),
+		"-nodefaults",
+		"-display", "none",
+		"-serial", "stdio",
+		"-no-reboot",
+		"-drive", "if=virtio,format=raw,cache=unsafe,file=" + opts.Disk,
+		"-netdev", "user,id=net0",
+		"-device", "virtio-net-pci,netdev=net0",
+	}
+
+	switch opts.Firmware {
+	case BIOS, "":
+	case UEFI:
+		if opts.OVMF == "" {
+			opts.OVMF = DefaultOVMF
+		}
+		if _, err := os.Stat(opts.OVMF); err != nil {
+			return nil, fmt.Errorf("OVMF firmware not found: %v", err)
+		}
+		varsTemplate := filepath.Join(filepath.Dir(opts.OVMF), "OVMF_VARS.fd")
+		vars, err := ioutil.ReadFile(varsTemplate)
+		if os.IsNotExist(err) {
+			// a combined image with its own variable store
+			args = append(args, "-bios", opts.OVMF)
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", varsTemplate, err)
+		}
+		// the firmware variables are written to, use a scratch copy
+		m.varsDir, err = ioutil.TempDir("", "coreos-install-ovmf")
+		if err != nil {
+			return nil, fmt.Errorf("creating OVMF vars dir: %v", err)
+		}
+		varsPath := filepath.Join(m.varsDir, "OVMF_VARS.fd")
+		if err := ioutil.WriteFile(varsPath, vars, 0644); err != nil {
+			m.cleanup()
+			return nil, fmt.Errorf("writing OVMF vars: %v", err)
+		}
+		args = append(args,
+			"-drive", "if=pflash,format=raw,readonly=on,file="+opts.OVMF,
+			"-drive", "if=pflash,format=raw,file="+varsPath)
+	default:
+		return nil, fmt.Errorf("unknown firmware %q", opts.Firmware)
+	}
+
+	m.cmd = exec.Command(qemu, args...)
+	m.stdin, err = m.cmd.StdinPipe()
+	if err != nil {
+		m.cleanup()
+		return nil, err
+	}
+	stdout, err := m.cmd.StdoutPipe()
+	if err != nil {
+		m.cleanup()
+		return nil, err
+	}
+	m.cmd.Stderr = m.cmd.Stdout
+
+	if err := m.cmd.Start(); err != nil {
+		m.cleanup()
+		return nil, fmt.Errorf("starting qemu: %v", err)
+	}
+	m.started = time.Now()
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				m.mu.Lock()
+				m.console.Write(buf[:n])
+				m.mu.Unlock()
+				if opts.Console != nil {
+					opts.Console.Write(buf[:n])
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		err := m.cmd.Wait()
+		m.mu.Lock()
+		m.exited = true
+		m.mu.Unlock()
+		m.done <- err
+	}()
+
+	return m, nil
+}
+
+// Expect waits for re to match the console output following the previous
+// match and returns the matching text.
+func (m *Machine) Expect(re *regexp.Regexp, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		m.mu.Lock()
+		unread := m.console.Bytes()[m.offset:]
+		if loc := re.FindIndex(unread); loc != nil {
+			match := string(unread[loc[0]:loc[1]])
+			m.offset += loc[1]
+			m.mu.Unlock()
+			return match, nil
+		}
+		exited := m.exited
+		m.mu.Unlock()
+
+		if exited {
+			return "", fmt.Errorf("qemu exited while waiting for %q", re)
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out after %v waiting for %q", timeout, re)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// WaitForLogin waits for the autologin shell prompt and returns the boot
+// time.
+func (m *Machine) WaitForLogin(timeout time.Duration) (time.Duration, error) {
+	if _, err := m.Expect(promptRegexp, timeout); err != nil {
+		return 0, err
+	}
+	return time.Since(m.started), nil
+}
+
+// Run runs command in the autologin shell and returns its output and exit
+// status.
+func (m *Machine) Run(command string, timeout time.Duration) (string, int, error) {
+	m.commands++
+	marker := fmt.Sprintf("@@rc-%d:", m.commands)
+	// the echoed command line shows $? rather than a number
+	if _, err := io.WriteString(m.stdin, command+"; echo \""+marker+"$?@@\"\n"); err != nil {
+		return "", 0, fmt.Errorf("writing to the console: %v", err)
+	}
+
+	re := regexp.MustCompile(`(?s)^(.*?)` + regexp.QuoteMeta(marker) + `(\d+)@@`)
+	match, err := m.Expect(re, timeout)
+	if err != nil {
+		return "", 0, fmt.Errorf("running %q: %v", command, err)
+	}
+	parts := re.FindStringSubmatch(match)
+	status, _ := strconv.Atoi(parts[2])
+
+	// drop the echoed command line
+	out := strings.Replace(parts[1], "\r\n", "\n", -1)
+	if i := strings.IndexByte(out, '\n'); i >= 0 {
+		out = out[i+1:]
+	}
+
+	if _, err := m.Expect(promptRegexp, timeout); err != nil {
+		return "", 0, fmt.Errorf("waiting for the prompt after %q: %v", command, err)
+	}
+	return out, status, nil
+}
+
+// Console returns everything written to the serial console so far.
+func (m *Machine) Console() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.console.String()
+}
+
+// Shutdown powers the machine off, killing it if it doesn't stop within
+// timeout.
+func (m *Machine) Shutdown(timeout time.Duration) error {
+	defer m.cleanup()
+	io.WriteString(m.stdin, "sudo systemctl poweroff\n")
+
+	select {
+	case err := <-m.done:
+		return err
+	case <-time.After(timeout):
+		m.cmd.Process.Kill()
+		<-m.done
+		return fmt.Errorf("machine didn't power off within %v", timeout)
+	}
+}
+
+func (m *Machine) cleanup() {
+	if m.varsDir != "" {
+		os.RemoveAll(m.varsDir)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// coreos-install-inspect prints a JSON report of what coreos-install
+// installed on a disk, for auditing disks before they are put in service.
+//
+// The partitions are mounted read-only, so it must run as root:
+//
+//	coreos-install-inspect -d /dev/sdX
+//
+// An installed root which is already mounted can be inspected with -r,
+// in which case the partition table is not reported.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/coreos/init/tests/coreos-install/inspect"
+)
+
+func main() {
+	device := flag.String("d", "", "installed disk to inspect")
+	root := flag.String("r", "", "inspect an already mounted root instead of a disk")
+	flag.Parse()
+
+	if (*device == "") == (*root == "") || flag.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s -d DEVICE | -r ROOT\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var report *inspect.Report
+	var err error
+	if *device != "" {
+		report, err = inspectDevice(*device)
+	} else {
+		report, err = inspect.Inspect(*root)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: encoding report: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+func inspectDevice(device string) (report *inspect.Report, err error) {
+	table, err := inspect.ReadPartitionTable(device)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "coreos-install-inspect")
+	if err != nil {
+		return nil, fmt.Errorf("creating mount point: %v", err)
+	}
+	defer os.Remove(dir)
+
+	unmount, err := inspect.Mount(table, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if unmountErr := unmount(); unmountErr != nil && err == nil {
+			report, err = nil, unmountErr
+		}
+	}()
+
+	report, err = inspect.Inspect(dir)
+	if err != nil {
+		return nil, err
+	}
+	report.Device = device
+	report.PartitionTable = table
+	return report, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// coreos-install-mirror adds a release to a mirror coreos-install can
+// install from with -b, for installing without access to the release
+// servers:
+//
+//	coreos-install-mirror -o /srv/mirror -version-txt version.txt \
+//		coreos_production_image.bin.bz2 \
+//		packet=coreos_production_packet_image.bin.bz2
+//
+// Images are named for their OEM and their signatures are read from
+// IMAGE.sig, unless -sign-key is given to sign them with an internal key
+// instead. The public half of that key is written to the mirror as
+// image-signing-key.asc for use with coreos-install -k.
+//
+// With -check the mirror is served locally and coreos-install is run
+// against it to install the added release, as a dry run and then for real
+// on the given device for every image. The device is overwritten.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/init/tests/coreos-install/installer"
+	"github.com/coreos/init/tests/coreos-install/mirror"
+)
+
+// keyName is where the public key of -sign-key is written in the mirror.
+const keyName = "image-signing-key.asc"
+
+func main() {
+	dir := flag.String("o", "", "mirror directory to add the release to")
+	board := flag.String("board", "amd64-usr", "board of the images")
+	versionTxt := flag.String("version-txt", "", "version.txt of the release")
+	signKey := flag.String("sign-key", "", "armored private key to sign the images with")
+	check := flag.String("check", "", "device to test install the release to from the mirror")
+	binary := flag.String("coreos-install", "coreos-install", "coreos-install to check the mirror with")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -o DIR -version-txt FILE [options] [OEM=]IMAGE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *dir == "" || *versionTxt == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	release := mirror.Release{
+		Board:      *board,
+		VersionTxt: *versionTxt,
+	}
+	for _, arg := range flag.Args() {
+		var image mirror.Image
+		if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
+			image.OEM, image.Path = parts[0], parts[1]
+		} else {
+			image.Path = arg
+		}
+		image.Signature = image.Path + ".sig"
+		release.Images = append(release.Images, image)
+	}
+
+	var signer *mirror.Signer
+	var keyFile string
+	if *signKey != "" {
+		var err error
+		if signer, err = readSigner(*signKey); err != nil {
+			fail("%v", err)
+		}
+		keyFile = filepath.Join(*dir, keyName)
+		if err := writePublicKey(signer, keyFile); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	version, err := mirror.Add(*dir, release, signer)
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Printf("added %s %s to %s\n", *board, version, *dir)
+
+	if *check != "" {
+		if err := checkMirror(*dir, release, version, *check, *binary, keyFile); err != nil {
+			fail("checking mirror: %v", err)
+		}
+	}
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func readSigner(path string) (*mirror.Signer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return mirror.NewSigner(file)
+}
+
+func writePublicKey(signer *mirror.Signer, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := signer.WritePublicKey(file); err != nil {
+		file.Close()
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	return file.Close()
+}
+
+// checkMirror serves the mirror and installs every image of the release
+// of the board from it, after checking each image and its signature are
+// served.
+func checkMirror(dir string, release mirror.Release, version, device, binary, keyFile string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("creating listener: %v", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, http.FileServer(http.Dir(dir)))
+
+	baseURL := fmt.Sprintf("http://%s/%s", listener.Addr(), release.Board)
+	for _, image := range release.Images {
+		name := mirror.ImageName(image.OEM)
+		for _, file := range []string{name, name + ".sig"} {
+			if err := checkServed(fmt.Sprintf("%s/%s/%s", baseURL, version, file)); err != nil {
+				return err
+			}
+		}
+
+		opts := installer.Options{
+			BinaryPath: binary,
+			Device:     device,
+			BaseURL:    baseURL,
+			Board:      release.Board,
+			Version:    version,
+			OEM:        image.OEM,
+			KeyFile:    keyFile,
+			DryRun:     true,
+		}
+		res, err := installer.Run(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		if !containsLine(res.Output, "BASEURL:", baseURL) {
+			return fmt.Errorf("dry run of %s doesn't use %s", name, baseURL)
+		}
+	}
+
+	// each install overwrites the last, but downloads and verifies its image
+	for _, image := range release.Images {
+		opts := installer.Options{
+			BinaryPath: binary,
+			Device:     device,
+			BaseURL:    baseURL,
+			Board:      release.Board,
+			Version:    version,
+			OEM:        image.OEM,
+			KeyFile:    keyFile,
+			Output: func(line string) {
+				fmt.Println(line)
+			},
+		}
+		res, err := installer.Run(context.Background(), opts)
+		if err != nil {
+			return fmt.Errorf("installing %s: %v", mirror.ImageName(image.OEM), err)
+		}
+		fmt.Printf("installed %s on %s from %s\n", res.Summary, res.Device, baseURL)
+	}
+	return nil
+}
+
+// checkServed checks a file of the mirror can be downloaded.
+func checkServed(url string) error {
+	resp, err := http.Head(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// containsLine reports whether a line of output has the key and value.
+func containsLine(output []string, key, value string) bool {
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key && fields[1] == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ext2, ext3 and ext4 are read the same way, the only difference which
+// matters here is whether files are mapped by extents or block maps.
+const (
+	extMagic        = 0xef53
+	extRootInode    = 2
+	extIncompat64   = 0x80
+	extExtentsFlag  = 0x80000
+	extInlineFlag   = 0x10000000
+	extExtentMagic  = 0xf30a
+	extModeType     = 0xf000
+	extModeDir      = 0x4000
+	extModeRegular  = 0x8000
+	extModeSymlink  = 0xa000
+	extDirectBlocks = 12
+)
+
+type extFS struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup uint32
+	descSize       int64
+	descBlock      int64
+	is64           bool
+}
+
+type extInode struct {
+	mode  uint16
+	size  int64
+	flags uint32
+	block []byte
+}
+
+func openExt(r io.ReaderAt) (*extFS, error) {
+	sb := make([]byte, 1024)
+	if _, err := r.ReadAt(sb, 1024); err != nil {
+		return nil, fmt.Errorf("reading superblock: %v", err)
+	}
+	if binary.LittleEndian.Uint16(sb[56:]) != extMagic {
+		return nil, fmt.Errorf("no ext2/3/4 superblock found")
+	}
+
+	fs := &extFS{
+		r:              r,
+		blockSize:      1024 << binary.LittleEndian.Uint32(sb[24:]),
+		inodeSize:      128,
+		inodesPerGroup: binary.LittleEndian.Uint32(sb[40:]),
+		descSize:       32,
+		descBlock:      int64(binary.LittleEndian.Uint32(sb[20:])) + 1,
+	}
+	if binary.LittleEndian.Uint32(sb[76:]) >= 1 {
+		fs.inodeSize = int64(binary.LittleEndian.Uint16(sb[88:]))
+	}
+	if binary.LittleEndian.Uint32(sb[96:])&extIncompat64 != 0 {
+		fs.is64 = true
+		fs.descSize = int64(binary.LittleEndian.Uint16(sb[254:]))
+	}
+	if fs.inodesPerGroup == 0 || fs.inodeSize < 128 || fs.descSize < 32 {
+		return nil, fmt.Errorf("bad superblock")
+	}
+	return fs, nil
+}
+
+func (fs *extFS) readBlock(n uint64) ([]byte, error) {
+	block := make([]byte, fs.blockSize)
+	if _, err := fs.r.ReadAt(block, int64(n)*fs.blockSize); err != nil {
+		return nil, fmt.Errorf("reading block %d: %v", n, err)
+	}
+	return block, nil
+}
+
+func (fs *extFS) inode(n uint32) (*extInode, error) {
+	group := int64((n - 1) / fs.inodesPerGroup)
+	index := int64((n - 1) % fs.inodesPerGroup)
+
+	desc := make([]byte, fs.descSize)
+	if _, err := fs.r.ReadAt(desc, fs.descBlock*fs.blockSize+group*fs.descSize); err != nil {
+		return nil, fmt.Errorf("reading group descriptor %d: %v", group, err)
+	}
+	table := uint64(binary.LittleEndian.Uint32(desc[8:]))
+	if fs.is64 && fs.descSize >= 64 {
+		table |= uint64(binary.LittleEndian.Uint32(desc[40:])) << 32
+	}
+
+	raw := make([]byte, fs.inodeSize)
+	if _, err := fs.r.ReadAt(raw, int64(table)*fs.blockSize+index*fs.inodeSize); err != nil {
+		return nil, fmt.Errorf("reading inode %d: %v", n, err)
+	}
+	return &extInode{
+		mode:  binary.LittleEndian.Uint16(raw[0:]),
+		size:  int64(binary.LittleEndian.Uint32(raw[4:])) | int64(binary.LittleEndian.Uint32(raw[108:]))<<32,
+		flags: binary.LittleEndian.Uint32(raw[32:]),
+		block: raw[40:100],
+	}, nil
+}
+
+// data reads the contents of an inode.
+func (fs *extFS) data(ino *extInode) ([]byte, error) {
+	if ino.size > maxFileSize {
+		return nil, fmt.Errorf("file of %d bytes is too large", ino.size)
+	}
+	buf := make([]byte, ino.size)
+
+	switch {
+	case ino.flags&extInlineFlag != 0:
+		if ino.size > int64(len(ino.block)) {
+			return nil, fmt.Errorf("inline data in extended attributes is not supported")
+		}
+		copy(buf, ino.block)
+		return buf, nil
+	case ino.mode&extModeType == extModeSymlink && ino.flags&extExtentsFlag == 0 && ino.size < int64(len(ino.block)):
+		// fast symlinks keep the target in place of the block map
+		copy(buf, ino.block)
+		return buf, nil
+	case ino.flags&extExtentsFlag != 0:
+		return buf, fs.readExtents(ino.block, buf)
+	default:
+		for i := 0; i < extDirectBlocks; i++ {
+			if err := fs.readMapped(0, binary.LittleEndian.Uint32(ino.block[i*4:]), int64(i), buf); err != nil {
+				return nil, err
+			}
+		}
+		perBlock := fs.blockSize / 4
+		logical := int64(extDirectBlocks)
+		for depth := 1; depth <= 3; depth++ {
+			if err := fs.readMapped(depth, binary.LittleEndian.Uint32(ino.block[(extDirectBlocks+depth-1)*4:]), logical, buf); err != nil {
+				return nil, err
+			}
+			span := int64(1)
+			for i := 0; i < depth; i++ {
+				span *= perBlock
+			}
+			logical += span
+		}
+		return buf, nil
+	}
+}
+
+// readMapped copies the data of block n of a block map into buf. Blocks of
+// depth greater than zero are indirect blocks. logical is the first block
+// of the file they map.
+func (fs *extFS) readMapped(depth int, n uint32, logical int64, buf []byte) error {
+	if n == 0 || logical*fs.blockSize >= int64(len(buf)) {
+		return nil
+	}
+	block, err := fs.readBlock(uint64(n))
+	if err != nil {
+		return err
+	}
+	if depth == 0 {
+		copy(buf[logical*fs.blockSize:], block)
+		return nil
+	}
+
+	span := int64(1)
+	for i := 1; i < depth; i++ {
+		span *= fs.blockSize / 4
+	}
+	for i := int64(0); i < fs.blockSize/4; i++ {
+		if err := fs.readMapped(depth-1, binary.LittleEndian.Uint32(block[i*4:]), logical+i*span, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExtents copies the data mapped by the extent tree node into buf.
+func (fs *extFS) readExtents(node []byte, buf []byte) error {
+	if binary.LittleEndian.Uint16(node[0:]) != extExtentMagic {
+		return fmt.Errorf("bad extent header")
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	depth := binary.LittleEndian.Uint16(node[6:])
+	if 12+entries*12 > len(node) {
+		return fmt.Errorf("bad extent header")
+	}
+
+	for i := 0; i < entries; i++ {
+		entry := node[12+i*12:]
+		if depth > 0 {
+			leaf := uint64(binary.LittleEndian.Uint32(entry[4:])) | uint64(binary.LittleEndian.Uint16(entry[8:]))<<32
+			child, err := fs.readBlock(leaf)
+			if err != nil {
+				return err
+			}
+			if err := fs.readExtents(child, buf); err != nil {
+				return err
+			}
+			continue
+		}
+
+		logical := int64(binary.LittleEndian.Uint32(entry[0:]))
+		length := int64(binary.LittleEndian.Uint16(entry[4:]))
+		start := uint64(binary.LittleEndian.Uint16(entry[6:]))<<32 | uint64(binary.LittleEndian.Uint32(entry[8:]))
+		if length > 32768 {
+			// uninitialized extents read as zeros
+			continue
+		}
+		for j := int64(0); j < length && (logical+j)*fs.blockSize < int64(len(buf)); j++ {
+			block, err := fs.readBlock(start + uint64(j))
+			if err != nil {
+				return err
+			}
+			copy(buf[(logical+j)*fs.blockSize:], block)
+		}
+	}
+	return nil
+}
+
+// lookupDir returns the inode number of name in the directory.
+func (fs *extFS) lookupDir(dir *extInode, name string) (uint32, error) {
+	data, err := fs.data(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// hashed directories keep a linear layout readable this way too
+	for off := 0; off+8 <= len(data); {
+		inode := binary.LittleEndian.Uint32(data[off:])
+		recLen := int(binary.LittleEndian.Uint16(data[off+4:]))
+		nameLen := int(data[off+6])
+		if recLen < 8 || off+recLen > len(data) || 8+nameLen > recLen {
+			return 0, fmt.Errorf("bad directory entry")
+		}
+		if inode != 0 && string(data[off+8:off+8+nameLen]) == name {
+			return inode, nil
+		}
+		off += recLen
+	}
+	return 0, os.ErrNotExist
+}
+
+func (fs *extFS) readFile(path string) ([]byte, error) {
+	n := uint32(extRootInode)
+	var walked []string
+	for components := splitPath(path); len(components) > 0; {
+		dir, err := fs.inode(n)
+		if err != nil {
+			return nil, err
+		}
+		if dir.mode&extModeType != extModeDir {
+			return nil, fmt.Errorf("not a directory")
+		}
+
+		if n, err = fs.lookupDir(dir, components[0]); err != nil {
+			return nil, err
+		}
+		ino, err := fs.inode(n)
+		if err != nil {
+			return nil, err
+		}
+		if ino.mode&extModeType != extModeSymlink {
+			walked = append(walked, components[0])
+			components = components[1:]
+			continue
+		}
+
+		// links are resolved by the image as they may lead to other
+		// partitions
+		target, err := fs.data(ino)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &linkError{
+			dir:    strings.Join(walked, "/"),
+			target: string(target),
+			rest:   strings.Join(components[1:], "/"),
+		}
+	}
+
+	ino, err := fs.inode(n)
+	if err != nil {
+		return nil, err
+	}
+	if ino.mode&extModeType != extModeRegular {
+		return nil, fmt.Errorf("not a regular file")
+	}
+	return fs.data(ino)
+}
@@ -0,0 +1,318 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	fatAttrDirectory = 0x10
+	fatAttrVolumeID  = 0x08
+	fatAttrLongName  = 0x0f
+	fatDirEntrySize  = 32
+	fatLastLongEntry = 0x40
+)
+
+type fatFS struct {
+	r           io.ReaderAt
+	bits        int // 12, 16 or 32
+	clusterSize int64
+	clusters    uint32
+	fatOffset   int64
+	dataOffset  int64
+	// FAT12 and FAT16 have a fixed root directory, FAT32 a cluster chain
+	rootOffset  int64
+	rootSize    int64
+	rootCluster uint32
+}
+
+// fatEntry is a directory entry, with its long name if it has one.
+type fatEntry struct {
+	name      string
+	shortName string
+	attr      byte
+	cluster   uint32
+	size      int64
+}
+
+func openFAT(r io.ReaderAt) (*fatFS, error) {
+	bs := make([]byte, 512)
+	if _, err := r.ReadAt(bs, 0); err != nil {
+		return nil, fmt.Errorf("reading boot sector: %v", err)
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, fmt.Errorf("no FAT boot sector found")
+	}
+
+	bytesPerSector := int64(binary.LittleEndian.Uint16(bs[11:]))
+	sectorsPerCluster := int64(bs[13])
+	reserved := int64(binary.LittleEndian.Uint16(bs[14:]))
+	numFATs := int64(bs[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[17:]))
+	totalSectors := int64(binary.LittleEndian.Uint16(bs[19:]))
+	if totalSectors == 0 {
+		totalSectors = int64(binary.LittleEndian.Uint32(bs[32:]))
+	}
+	fatSize := int64(binary.LittleEndian.Uint16(bs[22:]))
+	if fatSize == 0 {
+		fatSize = int64(binary.LittleEndian.Uint32(bs[36:]))
+	}
+	if bytesPerSector < 512 || sectorsPerCluster == 0 || numFATs == 0 || fatSize == 0 {
+		return nil, fmt.Errorf("bad FAT boot sector")
+	}
+
+	rootSectors := (rootEntries*fatDirEntrySize + bytesPerSector - 1) / bytesPerSector
+	firstDataSector := reserved + numFATs*fatSize + rootSectors
+	if totalSectors <= firstDataSector {
+		return nil, fmt.Errorf("bad FAT boot sector")
+	}
+
+	fs := &fatFS{
+		r:           r,
+		clusterSize: sectorsPerCluster * bytesPerSector,
+		clusters:    uint32((totalSectors - firstDataSector) / sectorsPerCluster),
+		fatOffset:   reserved * bytesPerSector,
+		dataOffset:  firstDataSector * bytesPerSector,
+		rootOffset:  (reserved + numFATs*fatSize) * bytesPerSector,
+		rootSize:    rootEntries * fatDirEntrySize,
+	}
+	// the FAT type is determined by the cluster count alone
+	switch {
+	case fs.clusters < 4085:
+		fs.bits = 12
+	case fs.clusters < 65525:
+		fs.bits = 16
+	default:
+		fs.bits = 32
+		fs.rootCluster = binary.LittleEndian.Uint32(bs[44:])
+	}
+	return fs, nil
+}
+
+// next returns the cluster following n in its chain and whether there is
+// one.
+func (fs *fatFS) next(n uint32) (uint32, bool, error) {
+	var buf [4]byte
+	var value, end uint32
+	switch fs.bits {
+	case 12:
+		if _, err := fs.r.ReadAt(buf[:2], fs.fatOffset+int64(n+n/2)); err != nil {
+			return 0, false, err
+		}
+		value = uint32(binary.LittleEndian.Uint16(buf[:]))
+		if n%2 == 1 {
+			value >>= 4
+		}
+		value &= 0xfff
+		end = 0xff8
+	case 16:
+		if _, err := fs.r.ReadAt(buf[:2], fs.fatOffset+int64(n)*2); err != nil {
+			return 0, false, err
+		}
+		value = uint32(binary.LittleEndian.Uint16(buf[:]))
+		end = 0xfff8
+	default:
+		if _, err := fs.r.ReadAt(buf[:], fs.fatOffset+int64(n)*4); err != nil {
+			return 0, false, err
+		}
+		value = binary.LittleEndian.Uint32(buf[:]) & 0x0fffffff
+		end = 0x0ffffff8
+	}
+	if value >= end {
+		return 0, false, nil
+	}
+	if value < 2 || value >= fs.clusters+2 {
+		return 0, false, fmt.Errorf("bad cluster %d in chain", value)
+	}
+	return value, true, nil
+}
+
+// readChain reads the clusters chained from first, up to size bytes if
+// size is not negative.
+func (fs *fatFS) readChain(first uint32, size int64) ([]byte, error) {
+	if size > maxFileSize {
+		return nil, fmt.Errorf("file of %d bytes is too large", size)
+	}
+
+	var data []byte
+	for n, ok, i := first, first != 0, uint32(0); ok && (size < 0 || int64(len(data)) < size); i++ {
+		if i > fs.clusters || n < 2 {
+			return nil, fmt.Errorf("bad cluster chain")
+		}
+		cluster := make([]byte, fs.clusterSize)
+		if _, err := fs.r.ReadAt(cluster, fs.dataOffset+int64(n-2)*fs.clusterSize); err != nil {
+			return nil, fmt.Errorf("reading cluster %d: %v", n, err)
+		}
+		data = append(data, cluster...)
+
+		var err error
+		if n, ok, err = fs.next(n); err != nil {
+			return nil, err
+		}
+	}
+
+	if size >= 0 {
+		if int64(len(data)) < size {
+			return nil, fmt.Errorf("cluster chain shorter than the file")
+		}
+		data = data[:size]
+	}
+	return data, nil
+}
+
+func (fs *fatFS) rootDir() ([]byte, error) {
+	if fs.bits == 32 {
+		return fs.readChain(fs.rootCluster, -1)
+	}
+	data := make([]byte, fs.rootSize)
+	if _, err := fs.r.ReadAt(data, fs.rootOffset); err != nil {
+		return nil, fmt.Errorf("reading root directory: %v", err)
+	}
+	return data, nil
+}
+
+// entries parses the entries of a directory.
+func (fs *fatFS) entries(data []byte) []fatEntry {
+	var entries []fatEntry
+	var longName []uint16
+	var checksum byte
+
+	for off := 0; off+fatDirEntrySize <= len(data); off += fatDirEntrySize {
+		raw := data[off : off+fatDirEntrySize]
+		if raw[0] == 0 {
+			break
+		}
+		if raw[0] == 0xe5 {
+			longName = nil
+			continue
+		}
+
+		attr := raw[11]
+		if attr&0x3f == fatAttrLongName {
+			order := int(raw[0] & 0x1f)
+			if raw[0]&fatLastLongEntry != 0 {
+				longName = make([]uint16, order*13)
+				checksum = raw[13]
+			}
+			if order == 0 || order*13 > len(longName) || raw[13] != checksum {
+				longName = nil
+				continue
+			}
+			chars := longName[(order-1)*13:]
+			for i, pos := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars[i] = binary.LittleEndian.Uint16(raw[pos:])
+			}
+			continue
+		}
+		if attr&fatAttrVolumeID != 0 {
+			longName = nil
+			continue
+		}
+
+		entry := fatEntry{
+			shortName: shortName(raw[:11]),
+			attr:      attr,
+			cluster:   uint32(binary.LittleEndian.Uint16(raw[20:]))<<16 | uint32(binary.LittleEndian.Uint16(raw[26:])),
+			size:      int64(binary.LittleEndian.Uint32(raw[28:])),
+		}
+		entry.name = entry.shortName
+		if longName != nil && shortNameChecksum(raw[:11]) == checksum {
+			entry.name = decodeLongName(longName)
+		}
+		longName = nil
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func shortName(raw []byte) string {
+	name := make([]byte, 11)
+	copy(name, raw)
+	if name[0] == 0x05 {
+		name[0] = 0xe5
+	}
+	base := strings.TrimRight(string(name[:8]), " ")
+	if ext := strings.TrimRight(string(name[8:]), " "); ext != "" {
+		return base + "." + ext
+	}
+	return base
+}
+
+func shortNameChecksum(raw []byte) byte {
+	var sum byte
+	for _, c := range raw {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+func decodeLongName(chars []uint16) string {
+	for i, c := range chars {
+		if c == 0 || c == 0xffff {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+func (fs *fatFS) readFile(path string) ([]byte, error) {
+	dir, err := fs.rootDir()
+	if err != nil {
+		return nil, err
+	}
+
+	components := splitPath(path)
+	for i, component := range components {
+		var found *fatEntry
+		for _, entry := range fs.entries(dir) {
+			// FAT names are case insensitive
+			if strings.EqualFold(entry.name, component) || strings.EqualFold(entry.shortName, component) {
+				found = &entry
+				break
+			}
+		}
+		if found == nil {
+			return nil, os.ErrNotExist
+		}
+
+		last := i == len(components)-1
+		isDir := found.attr&fatAttrDirectory != 0
+		switch {
+		case last && isDir:
+			return nil, fmt.Errorf("not a regular file")
+		case last:
+			return fs.readChain(found.cluster, found.size)
+		case !isDir:
+			return nil, fmt.Errorf("not a directory")
+		case found.cluster == 0:
+			// ".." entries refer to the root directory as cluster 0
+			if dir, err = fs.rootDir(); err != nil {
+				return nil, err
+			}
+		default:
+			if dir, err = fs.readChain(found.cluster, -1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, fmt.Errorf("not a regular file")
+}
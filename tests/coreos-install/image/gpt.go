@@ -0,0 +1,127 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+// SectorSize is the logical sector size of Container Linux images.
+const SectorSize = 512
+
+const gptSignature = "EFI PART"
+
+// Partition is an entry of the GPT of an image.
+type Partition struct {
+	Number int
+	Name   string
+	Type   string
+	UUID   string
+	// in sectors, FirstLBA and LastLBA are inclusive
+	FirstLBA uint64
+	LastLBA  uint64
+}
+
+// Offset is the offset in bytes of the partition in the image.
+func (p Partition) Offset() int64 {
+	return int64(p.FirstLBA) * SectorSize
+}
+
+// Size is the size in bytes of the partition.
+func (p Partition) Size() int64 {
+	return int64(p.LastLBA-p.FirstLBA+1) * SectorSize
+}
+
+// readGPT reads the primary GPT following the protective MBR.
+func readGPT(r io.ReaderAt) ([]Partition, error) {
+	header := make([]byte, SectorSize)
+	if _, err := r.ReadAt(header, SectorSize); err != nil {
+		return nil, fmt.Errorf("reading GPT header: %v", err)
+	}
+	if string(header[:8]) != gptSignature {
+		return nil, fmt.Errorf("no GPT header found")
+	}
+
+	headerSize := binary.LittleEndian.Uint32(header[12:])
+	if headerSize < 92 || headerSize > SectorSize {
+		return nil, fmt.Errorf("bad GPT header size %d", headerSize)
+	}
+	// the checksum is calculated with its own field zeroed
+	checked := append([]byte(nil), header[:headerSize]...)
+	copy(checked[16:20], []byte{0, 0, 0, 0})
+	if crc32.ChecksumIEEE(checked) != binary.LittleEndian.Uint32(header[16:]) {
+		return nil, fmt.Errorf("GPT header checksum mismatch")
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:])
+	numEntries := binary.LittleEndian.Uint32(header[80:])
+	entrySize := binary.LittleEndian.Uint32(header[84:])
+	if entrySize < 128 || numEntries > 1024 {
+		return nil, fmt.Errorf("bad GPT partition array of %d entries of %d bytes", numEntries, entrySize)
+	}
+
+	entries := make([]byte, numEntries*entrySize)
+	if _, err := r.ReadAt(entries, int64(entriesLBA)*SectorSize); err != nil {
+		return nil, fmt.Errorf("reading GPT partition entries: %v", err)
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+		return nil, fmt.Errorf("GPT partition entries checksum mismatch")
+	}
+
+	var partitions []Partition
+	for i := uint32(0); i < numEntries; i++ {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			continue
+		}
+		partitions = append(partitions, Partition{
+			Number:   int(i) + 1,
+			Type:     formatGUID(entry[0:16]),
+			UUID:     formatGUID(entry[16:32]),
+			FirstLBA: binary.LittleEndian.Uint64(entry[32:]),
+			LastLBA:  binary.LittleEndian.Uint64(entry[40:]),
+			Name:     decodeUTF16(entry[56:128]),
+		})
+	}
+	return partitions, nil
+}
+
+// formatGUID formats a GUID stored with its first three fields little
+// endian, as GPT does.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+// decodeUTF16 decodes a NUL terminated little endian UTF-16 string.
+func decodeUTF16(b []byte) string {
+	var chars []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars))
+}
@@ -0,0 +1,291 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package image reads Container Linux disk images, raw or bzip2 compressed,
+// entirely in userspace. The GPT is parsed and files are read from the
+// ext2/3/4 and FAT partitions directly, so images can be checked without
+// root, loop devices or mounting anything.
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// files larger than this are not read into memory
+	maxFileSize = 64 * 1024 * 1024
+	maxLinkHops = 40
+	// runs of zeros this long are left as holes when decompressing
+	sparseBlockSize = 64 * 1024
+)
+
+// mounts maps where partitions are mounted on a booted system to the
+// labels of the partitions. Longer paths come first.
+var mounts = []struct {
+	path      string
+	partition string
+}{
+	{"/usr/share/oem", "OEM"},
+	{"/boot", "EFI-SYSTEM"},
+	{"/usr", "USR-A"},
+	{"/", "ROOT"},
+}
+
+// Image is a Container Linux disk image.
+type Image struct {
+	Partitions []Partition
+
+	r      io.ReaderAt
+	closer func() error
+}
+
+// Info is what identifies the release an image contains.
+type Info struct {
+	Version string
+	Board   string
+	// OEM is the oem_id set by the grub.cfg of the OEM partition, empty
+	// for generic images
+	OEM string
+
+	OSRelease map[string]string
+	// GrubConfig is the grub.cfg of the OEM partition
+	GrubConfig string
+}
+
+// filesystem is a read-only filesystem of one partition.
+type filesystem interface {
+	readFile(path string) ([]byte, error)
+}
+
+// linkError is returned by filesystems when a path traverses a symlink,
+// which may lead to another partition.
+type linkError struct {
+	// dir is the directory of the link relative to the partition
+	dir    string
+	target string
+	// rest is the remainder of the path after the link
+	rest string
+}
+
+func (e *linkError) Error() string {
+	return fmt.Sprintf("symlink to %s", e.target)
+}
+
+// Open opens a raw or bzip2 compressed image file.
+func Open(name string) (*Image, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 3)
+	if _, err := file.ReadAt(magic, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading %s: %v", name, err)
+	}
+	if string(magic) == "BZh" {
+		defer file.Close()
+		return Read(bzip2.NewReader(bufio.NewReader(file)))
+	}
+
+	img, err := newImage(file, file.Close)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return img, nil
+}
+
+// Read reads a raw image from a stream, for example a decompressing one.
+// As partitions need random access the image is buffered in a sparse
+// temporary file.
+func Read(r io.Reader) (*Image, error) {
+	file, err := ioutil.TempFile("", "coreos-image")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp file: %v", err)
+	}
+	closer := func() error {
+		err := file.Close()
+		if removeErr := os.Remove(file.Name()); err == nil {
+			err = removeErr
+		}
+		return err
+	}
+
+	if err := copySparse(file, r); err != nil {
+		closer()
+		return nil, fmt.Errorf("reading image: %v", err)
+	}
+
+	img, err := newImage(file, closer)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// copySparse copies r into file, seeking over blocks of zeros.
+func copySparse(file *os.File, r io.Reader) error {
+	block := make([]byte, sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			if bytes.Equal(block[:n], zeros[:n]) {
+				if _, err := file.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := file.Write(block[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// trailing holes need the size to be set explicitly
+	return file.Truncate(size)
+}
+
+func newImage(r io.ReaderAt, closer func() error) (*Image, error) {
+	partitions, err := readGPT(r)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	return &Image{Partitions: partitions, r: r, closer: closer}, nil
+}
+
+// Close releases the image and any temporary file backing it.
+func (img *Image) Close() error {
+	return img.closer()
+}
+
+// Partition returns the partition with the given GPT name.
+func (img *Image) Partition(name string) (*Partition, error) {
+	for i, partition := range img.Partitions {
+		if partition.Name == name {
+			return &img.Partitions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no %s partition", name)
+}
+
+// filesystem opens the filesystem of a partition.
+func (img *Image) filesystem(name string) (filesystem, error) {
+	partition, err := img.Partition(name)
+	if err != nil {
+		return nil, err
+	}
+	r := io.NewSectionReader(img.r, partition.Offset(), partition.Size())
+
+	if fs, err := openExt(r); err == nil {
+		return fs, nil
+	}
+	if fs, err := openFAT(r); err == nil {
+		return fs, nil
+	}
+	return nil, fmt.Errorf("%s partition has no supported filesystem", name)
+}
+
+// ReadFile reads the file at name as it would be found on a system booted
+// from the image, e.g. /usr/lib/os-release from the USR-A partition.
+func (img *Image) ReadFile(name string) ([]byte, error) {
+	name = path.Clean("/" + name)
+	for hops := 0; hops <= maxLinkHops; hops++ {
+		var mountPath, partition string
+		for _, mount := range mounts {
+			if name == mount.path || strings.HasPrefix(name, strings.TrimSuffix(mount.path, "/")+"/") {
+				mountPath, partition = mount.path, mount.partition
+				break
+			}
+		}
+
+		fs, err := img.filesystem(partition)
+		if err != nil {
+			return nil, err
+		}
+		data, err := fs.readFile(strings.TrimPrefix(name, mountPath))
+		if linkErr, ok := err.(*linkError); ok {
+			if strings.HasPrefix(linkErr.target, "/") {
+				name = path.Join(linkErr.target, linkErr.rest)
+			} else {
+				name = path.Join(mountPath, linkErr.dir, linkErr.target, linkErr.rest)
+			}
+			continue
+		} else if err == os.ErrNotExist {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		} else if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", name, err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("reading %s: too many levels of symbolic links", name)
+}
+
+// Info reads the release of the image from /usr/lib/os-release and the
+// OEM grub.cfg.
+func (img *Image) Info() (*Info, error) {
+	data, err := img.ReadFile("/usr/lib/os-release")
+	if err != nil {
+		return nil, err
+	}
+	info := Info{OSRelease: parseOSRelease(data)}
+	info.Version = info.OSRelease["VERSION_ID"]
+	info.Board = info.OSRelease["COREOS_BOARD"]
+
+	grub, err := img.ReadFile("/usr/share/oem/grub.cfg")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	info.GrubConfig = string(grub)
+	if match := regexp.MustCompile(`oem_id="(.*)"`).FindSubmatch(grub); match != nil {
+		info.OEM = string(match[1])
+	}
+	return &info, nil
+}
+
+func parseOSRelease(data []byte) map[string]string {
+	vars := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		vars[parts[0]] = strings.Trim(parts[1], `"'`)
+	}
+	return vars
+}
+
+func splitPath(p string) []string {
+	var components []string
+	for _, component := range strings.Split(p, "/") {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+	return components
+}
@@ -0,0 +1,466 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const osRelease = `NAME="Container Linux by CoreOS"
+ID=coreos
+VERSION=1465.7.0
+VERSION_ID=1465.7.0
+BUILD_ID=2017-08-16-0012
+PRETTY_NAME="Container Linux by CoreOS 1465.7.0 (Ladybug)"
+COREOS_BOARD="amd64-usr"
+`
+
+const oemGrub = `# CoreOS GRUB settings for EC2
+
+set oem_id="ec2"
+`
+
+// a file spanning double indirect blocks of a 1k block map
+var largeFile = strings.Repeat("0123456789abcdef", 300*1024/16)
+
+// testPartition is a partition of a test image and how to build it.
+type testPartition struct {
+	name     string
+	typeGUID string
+	fsType   string // an mke2fs type or "vfat"
+	files    map[string]string
+	links    map[string]string
+}
+
+var testPartitions = []testPartition{
+	{
+		name:     "EFI-SYSTEM",
+		typeGUID: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b",
+		fsType:   "vfat",
+		files: map[string]string{
+			"coreos/grub/grub.cfg.tar":   "not really a tarball",
+			"EFI/boot/bootx64.efi":       "MZ",
+			"coreos/vmlinuz-a":           largeFile,
+			"coreos/first_boot_settings": "",
+		},
+	},
+	{
+		name:     "USR-A",
+		typeGUID: "5dfbf5f4-2848-4bac-aa5e-0d9a20b745a6",
+		fsType:   "ext2",
+		files: map[string]string{
+			"lib/os-release":        osRelease,
+			"share/coreos/large":    largeFile,
+			"share/coreos/release":  "COREOS_RELEASE_VERSION=1465.7.0\n",
+			"share/oem/placeholder": "",
+		},
+		links: map[string]string{
+			"share/coreos/os-release": "../../lib/os-release",
+			"share/coreos/absolute":   "/usr/lib/os-release",
+			"share/coreos/loop":       "loop",
+		},
+	},
+	{
+		name:     "OEM",
+		typeGUID: "0fc63daf-8483-4772-8e79-3d69d8477de4",
+		fsType:   "ext4",
+		files: map[string]string{
+			"grub.cfg": oemGrub,
+		},
+	},
+	{
+		name:     "ROOT",
+		typeGUID: "3884dd41-8582-4404-b9a8-e9b84f2df50e",
+		fsType:   "ext4",
+		files: map[string]string{
+			"etc/hostname": "localhost\n",
+		},
+		links: map[string]string{
+			"etc/os-release": "../usr/lib/os-release",
+		},
+	},
+}
+
+const partitionSectors = 16 * 1024 * 1024 / SectorSize
+
+// buildImage writes a GPT disk image of testPartitions.
+func buildImage(t *testing.T, dir string) string {
+	if _, err := exec.LookPath("mke2fs"); err != nil {
+		t.Skipf("mke2fs is needed to build test filesystems")
+	}
+
+	var contents [][]byte
+	for _, partition := range testPartitions {
+		var data []byte
+		if partition.fsType == "vfat" {
+			data = buildFAT(t, partition.files)
+		} else {
+			data = buildExt(t, dir, partition)
+		}
+		contents = append(contents, data)
+	}
+
+	path := filepath.Join(dir, "coreos_production_image.bin")
+	if err := ioutil.WriteFile(path, buildGPT(t, contents), 0644); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+	return path
+}
+
+func buildExt(t *testing.T, dir string, partition testPartition) []byte {
+	tree := filepath.Join(dir, partition.name)
+	for name, data := range partition.files {
+		path := filepath.Join(tree, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("creating %s: %v", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	for name, target := range partition.links {
+		path := filepath.Join(tree, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("creating %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatalf("linking %s: %v", path, err)
+		}
+	}
+
+	fsImage := filepath.Join(dir, partition.name+".img")
+	// 1k blocks so that the large file needs indirect blocks
+	out, err := exec.Command("mke2fs", "-q", "-F", "-t", partition.fsType, "-b", "1024",
+		"-L", partition.name, "-d", tree, fsImage, "16M").CombinedOutput()
+	if err != nil {
+		t.Fatalf("mke2fs failed: %v: %s", err, out)
+	}
+	data, err := ioutil.ReadFile(fsImage)
+	if err != nil {
+		t.Fatalf("reading %s: %v", fsImage, err)
+	}
+	return data
+}
+
+// buildGPT lays out partitions after a GPT with 128 entries.
+func buildGPT(t *testing.T, partitions [][]byte) []byte {
+	const firstLBA = 2048
+	disk := make([]byte, (firstLBA+len(partitions)*partitionSectors+34)*SectorSize)
+
+	entries := make([]byte, 128*128)
+	for i, data := range partitions {
+		start := uint64(firstLBA + i*partitionSectors)
+		entry := entries[i*128:]
+		copy(entry[0:], guidBytes(t, testPartitions[i].typeGUID))
+		copy(entry[16:], guidBytes(t, "00000000-0000-0000-0000-00000000000"+string('1'+byte(i))))
+		binary.LittleEndian.PutUint64(entry[32:], start)
+		binary.LittleEndian.PutUint64(entry[40:], start+partitionSectors-1)
+		for j, c := range utf16.Encode([]rune(testPartitions[i].name)) {
+			binary.LittleEndian.PutUint16(entry[56+j*2:], c)
+		}
+		copy(disk[start*SectorSize:], data)
+	}
+	copy(disk[2*SectorSize:], entries)
+
+	header := disk[SectorSize : SectorSize+92]
+	copy(header, gptSignature)
+	binary.LittleEndian.PutUint32(header[8:], 0x00010000)
+	binary.LittleEndian.PutUint32(header[12:], 92)
+	binary.LittleEndian.PutUint64(header[24:], 1)
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+	binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header))
+	return disk
+}
+
+func guidBytes(t *testing.T, guid string) []byte {
+	b, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		t.Fatalf("bad GUID %s", guid)
+	}
+	// the first three fields are little endian
+	for _, field := range [][]byte{b[0:4], b[4:6], b[6:8]} {
+		for i, j := 0, len(field)-1; i < j; i, j = i+1, j-1 {
+			field[i], field[j] = field[j], field[i]
+		}
+	}
+	return b
+}
+
+// buildFAT formats a FAT16 filesystem holding files, with long names for
+// all of them.
+func buildFAT(t *testing.T, files map[string]string) []byte {
+	const (
+		reserved    = 1
+		numFATs     = 2
+		rootEntries = 512
+		fatSectors  = 128
+		dataStart   = reserved + numFATs*fatSectors + rootEntries*32/512
+	)
+	fs := make([]byte, partitionSectors*SectorSize)
+	bs := fs[:512]
+	copy(bs[3:], "mkfs.fat")
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 1
+	binary.LittleEndian.PutUint16(bs[14:], reserved)
+	bs[16] = numFATs
+	binary.LittleEndian.PutUint16(bs[17:], rootEntries)
+	binary.LittleEndian.PutUint16(bs[19:], partitionSectors)
+	bs[21] = 0xf8
+	binary.LittleEndian.PutUint16(bs[22:], fatSectors)
+	bs[510], bs[511] = 0x55, 0xaa
+
+	next := uint16(2)
+	alloc := func(data []byte) uint16 {
+		if len(data) == 0 {
+			return 0
+		}
+		first := next
+		for off := 0; off < len(data); off += 512 {
+			copy(fs[(dataStart+int(next)-2)*512:], data[off:])
+			link := next + 1
+			if off+512 >= len(data) {
+				link = 0xffff
+			}
+			for i := 0; i < numFATs; i++ {
+				binary.LittleEndian.PutUint16(fs[(reserved+i*fatSectors)*512+int(next)*2:], link)
+			}
+			next++
+		}
+		return first
+	}
+
+	// write directories depth first so their contents are allocated
+	var writeDir func(prefix string) []byte
+	writeDir = func(prefix string) []byte {
+		children := map[string]bool{}
+		for name := range files {
+			if strings.HasPrefix(name, prefix) {
+				children[strings.SplitN(strings.TrimPrefix(name, prefix), "/", 2)[0]] = true
+			}
+		}
+		var names []string
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var dir []byte
+		for i, name := range names {
+			data, isFile := files[prefix+name]
+			attr := byte(0)
+			var cluster uint16
+			if isFile {
+				cluster = alloc([]byte(data))
+			} else {
+				attr = fatAttrDirectory
+				cluster = alloc(writeDir(prefix + name + "/"))
+			}
+			dir = append(dir, fatDirEntry(name, i, attr, cluster, len(data))...)
+		}
+		return dir
+	}
+	copy(fs[(reserved+numFATs*fatSectors)*512:], writeDir(""))
+	return fs
+}
+
+// fatDirEntry encodes a long name followed by the short entry.
+func fatDirEntry(name string, index int, attr byte, cluster uint16, size int) []byte {
+	base, ext := name, ""
+	if dot := strings.LastIndex(name, "."); dot > 0 {
+		base, ext = name[:dot], name[dot+1:]
+	}
+	base = strings.ToUpper(base)
+	if len(base) > 8 {
+		base = base[:6] + "~" + string('1'+byte(index))
+	}
+	short := []byte(strings.ToUpper(base + strings.Repeat(" ", 8-len(base)) + ext + strings.Repeat(" ", 3-len(ext))))
+	checksum := shortNameChecksum(short)
+
+	chars := append(utf16.Encode([]rune(name)), 0)
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xffff)
+	}
+	var entries []byte
+	for order := len(chars) / 13; order > 0; order-- {
+		entry := make([]byte, 32)
+		entry[0] = byte(order)
+		if order == len(chars)/13 {
+			entry[0] |= fatLastLongEntry
+		}
+		entry[11] = fatAttrLongName
+		entry[13] = checksum
+		for i, pos := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(entry[pos:], chars[(order-1)*13+i])
+		}
+		entries = append(entries, entry...)
+	}
+
+	entry := make([]byte, 32)
+	copy(entry, short)
+	entry[11] = attr
+	binary.LittleEndian.PutUint16(entry[26:], cluster)
+	binary.LittleEndian.PutUint32(entry[28:], uint32(size))
+	return append(entries, entry...)
+}
+
+func checkImage(t *testing.T, img *Image) {
+	var names []string
+	for _, partition := range img.Partitions {
+		names = append(names, partition.Name)
+	}
+	if expected := []string{"EFI-SYSTEM", "USR-A", "OEM", "ROOT"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected partitions: expected %q, received %q", expected, names)
+	}
+	usr, err := img.Partition("USR-A")
+	if err != nil {
+		t.Fatalf("finding USR-A: %v", err)
+	}
+	if usr.Number != 2 || usr.Type != "5dfbf5f4-2848-4bac-aa5e-0d9a20b745a6" || usr.FirstLBA != 2048+partitionSectors {
+		t.Fatalf("unexpected USR-A partition: %+v", usr)
+	}
+
+	files := map[string]string{
+		"/usr/lib/os-release":              osRelease,
+		"/usr/share/coreos/large":          largeFile,
+		"/usr/share/coreos/os-release":     osRelease,
+		"/usr/share/coreos/absolute":       osRelease,
+		"/usr/share/oem/grub.cfg":          oemGrub,
+		"/etc/os-release":                  osRelease,
+		"/etc/hostname":                    "localhost\n",
+		"/boot/coreos/vmlinuz-a":           largeFile,
+		"/boot/COREOS/GRUB/grub.cfg.tar":   "not really a tarball",
+		"/boot/coreos/first_boot_settings": "",
+		"/boot/efi/boot/BOOTX64.EFI":       "MZ",
+	}
+	for name, expected := range files {
+		data, err := img.ReadFile(name)
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if string(data) != expected {
+			t.Errorf("%s differs: expected %d bytes, received %d", name, len(expected), len(data))
+		}
+	}
+
+	for _, name := range []string{"/usr/lib/missing", "/boot/coreos/missing", "/missing/os-release"} {
+		if _, err := img.ReadFile(name); !os.IsNotExist(err) {
+			t.Errorf("%s: expected it not to exist, received %v", name, err)
+		}
+	}
+	for _, name := range []string{"/usr/share/coreos/loop", "/usr/lib", "/boot/coreos", "/etc/hostname/x"} {
+		if _, err := img.ReadFile(name); err == nil || os.IsNotExist(err) {
+			t.Errorf("%s: expected an error, received %v", name, err)
+		}
+	}
+
+	info, err := img.Info()
+	if err != nil {
+		t.Fatalf("reading image info: %v", err)
+	}
+	if info.Version != "1465.7.0" || info.Board != "amd64-usr" || info.OEM != "ec2" || info.GrubConfig != oemGrub {
+		t.Fatalf("unexpected image info: %+v", info)
+	}
+}
+
+func TestOpenRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	img, err := Open(buildImage(t, dir))
+	if err != nil {
+		t.Fatalf("opening image: %v", err)
+	}
+	defer img.Close()
+
+	checkImage(t, img)
+}
+
+func TestOpenBzip2(t *testing.T) {
+	if _, err := exec.LookPath("bzip2"); err != nil {
+		t.Skipf("bzip2 is needed to compress the test image")
+	}
+
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := buildImage(t, dir)
+	if out, err := exec.Command("bzip2", path).CombinedOutput(); err != nil {
+		t.Fatalf("bzip2 failed: %v: %s", err, out)
+	}
+
+	img, err := Open(path + ".bz2")
+	if err != nil {
+		t.Fatalf("opening image: %v", err)
+	}
+	checkImage(t, img)
+
+	temp := img.r.(*os.File).Name()
+	if err := img.Close(); err != nil {
+		t.Fatalf("closing image: %v", err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Fatalf("decompressed image %s was left behind", temp)
+	}
+}
+
+func TestBadGPT(t *testing.T) {
+	var partitions [][]byte
+	for range testPartitions {
+		partitions = append(partitions, nil)
+	}
+	disk := buildGPT(t, partitions)
+
+	img, err := Read(bytes.NewReader(disk))
+	if err != nil {
+		t.Fatalf("reading image: %v", err)
+	}
+	img.Close()
+
+	tests := []struct {
+		offset int
+		err    string
+	}{
+		{SectorSize, "no GPT header found"},
+		{SectorSize + 40, "GPT header checksum mismatch"},
+		{2*SectorSize + 56, "GPT partition entries checksum mismatch"},
+	}
+	for _, test := range tests {
+		corrupt := append([]byte(nil), disk...)
+		corrupt[test.offset]++
+		if _, err := Read(bytes.NewReader(corrupt)); err == nil || err.Error() != test.err {
+			t.Errorf("corrupting byte %d: expected error %q, received %v", test.offset, test.err, err)
+		}
+	}
+}
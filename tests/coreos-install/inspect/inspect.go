@@ -0,0 +1,312 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inspect reports what coreos-install left on a disk: the installed
+// release, its update channel and OEM, the configs and network units that
+// were copied and the partition table.
+package inspect
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Report describes an installed disk.
+type Report struct {
+	Device string `json:"device,omitempty"`
+
+	Version string `json:"version"`
+	Board   string `json:"board"`
+	Channel string `json:"channel"`
+	OEM     string `json:"oem"`
+
+	Ignition     *File  `json:"ignition"`
+	CloudConfig  *File  `json:"cloud_config"`
+	NetworkUnits []File `json:"network_units"`
+
+	PartitionTable *PartitionTable `json:"partition_table,omitempty"`
+}
+
+// File is a file installed on the disk.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// PartitionTable summarizes the partition table of the disk.
+type PartitionTable struct {
+	Type       string      `json:"type"`
+	UUID       string      `json:"uuid"`
+	Partitions []Partition `json:"partitions"`
+}
+
+// Partition is one entry of the partition table. Offsets and sizes are in
+// 512 byte sectors.
+type Partition struct {
+	Number int    `json:"number"`
+	Device string `json:"device"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	UUID   string `json:"uuid"`
+	Start  int64  `json:"start"`
+	Size   int64  `json:"size"`
+
+	FSType  string `json:"fs_type,omitempty"`
+	FSLabel string `json:"fs_label,omitempty"`
+}
+
+// paths of the installed files, relative to the mounted root
+var (
+	osReleasePath   = filepath.Join("usr", "lib", "os-release")
+	updateConfPath  = filepath.Join("etc", "coreos", "update.conf")
+	oemGrubPath     = filepath.Join("usr", "share", "oem", "grub.cfg")
+	oemReleasePath  = filepath.Join("usr", "share", "oem", "oem-release")
+	ignitionPath    = filepath.Join("usr", "share", "oem", "config.ign")
+	cloudConfigPath = filepath.Join("var", "lib", "coreos-install", "user_data")
+	networkPath     = filepath.Join("etc", "systemd", "network")
+)
+
+// Inspect reads the installed files from root, which is laid out the way
+// Mount lays out an installed disk.
+func Inspect(root string) (*Report, error) {
+	var report Report
+
+	osRelease, err := readVars(filepath.Join(root, osReleasePath))
+	if err != nil {
+		return nil, err
+	}
+	report.Version = osRelease["VERSION_ID"]
+	report.Board = osRelease["COREOS_BOARD"]
+
+	// update.conf is only written when the channel differs from the
+	// default one in /usr
+	updateConf, err := readVars(filepath.Join(root, updateConfPath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	report.Channel = updateConf["GROUP"]
+
+	if report.OEM, err = readOEM(root); err != nil {
+		return nil, err
+	}
+
+	if report.Ignition, err = hashFile(root, ignitionPath); err != nil {
+		return nil, err
+	}
+	if report.CloudConfig, err = hashFile(root, cloudConfigPath); err != nil {
+		return nil, err
+	}
+
+	units, err := ioutil.ReadDir(filepath.Join(root, networkPath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading /%s: %v", networkPath, err)
+	}
+	report.NetworkUnits = []File{}
+	for _, unit := range units {
+		if unit.IsDir() {
+			continue
+		}
+		file, err := hashFile(root, filepath.Join(networkPath, unit.Name()))
+		if err != nil {
+			return nil, err
+		}
+		report.NetworkUnits = append(report.NetworkUnits, *file)
+	}
+
+	return &report, nil
+}
+
+// readOEM returns the OEM id from the OEM grub.cfg, falling back to the
+// oem-release shipped by OEM images which don't set one.
+func readOEM(root string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, oemGrubPath))
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("reading /%s: %v", oemGrubPath, err)
+	}
+	if match := regexp.MustCompile(`oem_id="(.*)"`).FindSubmatch(data); match != nil {
+		return string(match[1]), nil
+	}
+
+	oemRelease, err := readVars(filepath.Join(root, oemReleasePath))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return oemRelease["ID"], nil
+}
+
+// readVars parses a file of shell style variable assignments.
+func readVars(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return parseVars(data), nil
+}
+
+func parseVars(data []byte) map[string]string {
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		vars[parts[0]] = strings.Trim(parts[1], `"'`)
+	}
+	return vars
+}
+
+// hashFile describes the file at path relative to root, or returns nil if
+// it doesn't exist.
+func hashFile(root, path string) (*File, error) {
+	data, err := ioutil.ReadFile(filepath.Join(root, path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading /%s: %v", path, err)
+	}
+
+	sum := sha256.Sum256(data)
+	return &File{
+		Path:   "/" + path,
+		Size:   int64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// ReadPartitionTable probes the partition table of device with blkid.
+func ReadPartitionTable(device string) (*PartitionTable, error) {
+	out, err := blkid(device)
+	if err != nil {
+		return nil, err
+	}
+	disk := parseVars(out)
+	if disk["PTTYPE"] == "" {
+		return nil, fmt.Errorf("%s has no partition table", device)
+	}
+
+	table := PartitionTable{
+		Type:       disk["PTTYPE"],
+		UUID:       disk["PTUUID"],
+		Partitions: []Partition{},
+	}
+
+	nodes, err := partitionNodes(device)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		out, err := blkid(node)
+		if err != nil {
+			return nil, err
+		}
+		partition, err := parsePartition(node, parseVars(out))
+		if err != nil {
+			return nil, err
+		}
+		table.Partitions = append(table.Partitions, partition)
+	}
+
+	sort.Slice(table.Partitions, func(i, j int) bool {
+		return table.Partitions[i].Number < table.Partitions[j].Number
+	})
+	return &table, nil
+}
+
+// blkid runs a low-level probe of device, ignoring the exit status 2 blkid
+// uses for devices without any recognized content.
+func blkid(device string) ([]byte, error) {
+	out, err := exec.Command("blkid", "-p", "-o", "export", device).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 2 {
+			return out, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("probing %s: %v", device, err)
+	}
+	return out, nil
+}
+
+func parsePartition(node string, vars map[string]string) (Partition, error) {
+	var err error
+	partition := Partition{
+		Device:  node,
+		Name:    vars["PART_ENTRY_NAME"],
+		Type:    vars["PART_ENTRY_TYPE"],
+		UUID:    vars["PART_ENTRY_UUID"],
+		FSType:  vars["TYPE"],
+		FSLabel: vars["LABEL"],
+	}
+	if partition.Number, err = strconv.Atoi(vars["PART_ENTRY_NUMBER"]); err != nil {
+		return partition, fmt.Errorf("%s: bad partition number: %v", node, err)
+	}
+	if partition.Start, err = strconv.ParseInt(vars["PART_ENTRY_OFFSET"], 10, 64); err != nil {
+		return partition, fmt.Errorf("%s: bad partition offset: %v", node, err)
+	}
+	if partition.Size, err = strconv.ParseInt(vars["PART_ENTRY_SIZE"], 10, 64); err != nil {
+		return partition, fmt.Errorf("%s: bad partition size: %v", node, err)
+	}
+	return partition, nil
+}
+
+// partitionNodes lists the device nodes of the partitions of device as the
+// kernel sees them.
+func partitionNodes(device string) ([]string, error) {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(device)
+
+	entries, err := ioutil.ReadDir(filepath.Join("/sys/class/block", name))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a block device: %v", device, err)
+	}
+
+	var nodes []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		_, err := os.Stat(filepath.Join("/sys/class/block", name, entry.Name(), "partition"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, filepath.Join(filepath.Dir(device), entry.Name()))
+	}
+	return nodes, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const osRelease = `NAME="Container Linux by CoreOS"
+ID=coreos
+VERSION=1465.7.0
+VERSION_ID=1465.7.0
+BUILD_ID=2017-08-16-0012
+PRETTY_NAME="Container Linux by CoreOS 1465.7.0 (Ladybug)"
+ANSI_COLOR="38;5;75"
+HOME_URL="https://coreos.com/"
+BUG_REPORT_URL="https://issues.coreos.com"
+COREOS_BOARD="amd64-usr"
+`
+
+// writeRoot lays out files, keyed by their path relative to the root, in
+// a new temp dir.
+func writeRoot(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "inspect")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			os.RemoveAll(root)
+			t.Fatalf("creating %s: %v", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			os.RemoveAll(root)
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	return root
+}
+
+func TestInspect(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		report Report
+	}{
+		{
+			name:  "plain install",
+			files: map[string]string{"usr/lib/os-release": osRelease},
+			report: Report{
+				Version:      "1465.7.0",
+				Board:        "amd64-usr",
+				NetworkUnits: []File{},
+			},
+		},
+		{
+			name: "everything",
+			files: map[string]string{
+				"usr/lib/os-release":                    osRelease,
+				"etc/coreos/update.conf":                "GROUP=beta\n",
+				"usr/share/oem/grub.cfg":                "# CoreOS GRUB settings\n\nset oem_id=\"ec2\"\n",
+				"usr/share/oem/config.ign":              "{}",
+				"var/lib/coreos-install/user_data":      "#cloud-config\n",
+				"etc/systemd/network/static.network":    "[Match]\nName=eth0\n",
+				"etc/systemd/network/00-bond.netdev":    "[NetDev]\nName=bond0\nKind=bond\n",
+				"etc/systemd/network/resolv.d/dns.conf": "ignored, not a unit",
+			},
+			report: Report{
+				Version: "1465.7.0",
+				Board:   "amd64-usr",
+				Channel: "beta",
+				OEM:     "ec2",
+				Ignition: &File{
+					Path:   "/usr/share/oem/config.ign",
+					Size:   2,
+					SHA256: "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+				},
+				CloudConfig: &File{
+					Path:   "/var/lib/coreos-install/user_data",
+					Size:   14,
+					SHA256: "88c95955b024402aa9572b663f7eeb134f01343bb92af27b50e97e72b22c565f",
+				},
+				NetworkUnits: []File{
+					{
+						Path:   "/etc/systemd/network/00-bond.netdev",
+						Size:   30,
+						SHA256: "89997e3a1841be380a98f0d8ecccbeca5b4db7e5a074d164655d3509232bb849",
+					},
+					{
+						Path:   "/etc/systemd/network/static.network",
+						Size:   18,
+						SHA256: "429a43c0cd81b16c81b0d96e4c9cc6c8dffcaac1d80a4453be183d1f925453f3",
+					},
+				},
+			},
+		},
+		{
+			name: "oem-release",
+			files: map[string]string{
+				"usr/lib/os-release":        osRelease,
+				"usr/share/oem/grub.cfg":    "set linux_append=\"console=ttyS0\"\n",
+				"usr/share/oem/oem-release": "ID=packet\nVERSION_ID=0.0.6\nNAME=\"Packet\"\n",
+			},
+			report: Report{
+				Version:      "1465.7.0",
+				Board:        "amd64-usr",
+				OEM:          "packet",
+				NetworkUnits: []File{},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := writeRoot(t, test.files)
+			defer os.RemoveAll(root)
+
+			report, err := Inspect(root)
+			if err != nil {
+				t.Fatalf("inspecting: %v", err)
+			}
+			if !reflect.DeepEqual(*report, test.report) {
+				t.Fatalf("unexpected report: expected %+v, received %+v", test.report, *report)
+			}
+		})
+	}
+}
+
+func TestInspectNotInstalled(t *testing.T) {
+	root := writeRoot(t, map[string]string{"etc/coreos/update.conf": "GROUP=beta\n"})
+	defer os.RemoveAll(root)
+
+	if _, err := Inspect(root); !os.IsNotExist(err) {
+		t.Fatalf("expected os-release to be missing, received %v", err)
+	}
+}
+
+func TestParsePartition(t *testing.T) {
+	// blkid -p -o export /dev/loop0p9 of a fresh install
+	vars := parseVars([]byte(`DEVNAME=/dev/loop0p9
+UUID=2cb0efd7-1ae6-4b61-b2c9-3c6c2c0a1f65
+VERSION=1.0
+BLOCK_SIZE=4096
+TYPE=ext4
+USAGE=filesystem
+LABEL=ROOT
+PART_ENTRY_SCHEME=gpt
+PART_ENTRY_NAME=ROOT
+PART_ENTRY_UUID=4bc26d7d-1ac4-4d6e-8a59-1f4a6f5c8e01
+PART_ENTRY_TYPE=3884dd41-8582-4404-b9a8-e9b84f2df50e
+PART_ENTRY_NUMBER=9
+PART_ENTRY_OFFSET=4427776
+PART_ENTRY_SIZE=4194304
+PART_ENTRY_DISK=7:0
+`))
+
+	partition, err := parsePartition("/dev/loop0p9", vars)
+	if err != nil {
+		t.Fatalf("parsing partition: %v", err)
+	}
+
+	expected := Partition{
+		Number:  9,
+		Device:  "/dev/loop0p9",
+		Name:    "ROOT",
+		Type:    "3884dd41-8582-4404-b9a8-e9b84f2df50e",
+		UUID:    "4bc26d7d-1ac4-4d6e-8a59-1f4a6f5c8e01",
+		Start:   4427776,
+		Size:    4194304,
+		FSType:  "ext4",
+		FSLabel: "ROOT",
+	}
+	if partition != expected {
+		t.Fatalf("unexpected partition: expected %+v, received %+v", expected, partition)
+	}
+
+	delete(vars, "PART_ENTRY_NUMBER")
+	if _, err := parsePartition("/dev/loop0p9", vars); err == nil {
+		t.Fatalf("parsed a partition without a number")
+	}
+}
+
+func TestFindPartition(t *testing.T) {
+	table := &PartitionTable{Partitions: []Partition{
+		{Number: 1, Name: "EFI-SYSTEM", FSType: "vfat", FSLabel: "EFI-SYSTEM"},
+		{Number: 3, Name: "USR-A", FSType: "ext4", FSLabel: "USR-A"},
+		{Number: 4, Name: "USR-B"},
+		{Number: 6, Name: "OEM", FSType: "btrfs", FSLabel: "OEM"},
+		{Number: 9, Name: "ROOT", FSType: "btrfs", FSLabel: "ROOT"},
+	}}
+
+	expected := map[string]int{"/": 9, "/boot": 1, "/usr": 3, "/usr/share/oem": 6}
+	options := map[string]string{"/": "ro,subvol=root", "/boot": "ro", "/usr": "ro,noload", "/usr/share/oem": "ro"}
+	for _, mp := range mountPoints {
+		partition := findPartition(table, mp)
+		if partition == nil || partition.Number != expected[mp.path] {
+			t.Errorf("%s: expected partition %d, received %+v", mp.path, expected[mp.path], partition)
+			continue
+		}
+		if opts := mountOptions(mp, partition.FSType); opts != options[mp.path] {
+			t.Errorf("%s: expected options %q, received %q", mp.path, options[mp.path], opts)
+		}
+	}
+
+	if partition := findPartition(&PartitionTable{}, mountPoints[0]); partition != nil {
+		t.Errorf("found %+v in an empty table", partition)
+	}
+}
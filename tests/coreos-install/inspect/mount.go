@@ -0,0 +1,97 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// mountPoint is where a partition is mounted relative to the root. Like
+// coreos-install, partitions are found by label rather than by number.
+type mountPoint struct {
+	path string
+	// only one of these is set
+	fsLabel   string
+	partLabel string
+}
+
+var mountPoints = []mountPoint{
+	{path: "/", fsLabel: "ROOT"},
+	{path: "/boot", partLabel: "EFI-SYSTEM"},
+	{path: "/usr", partLabel: "USR-A"},
+	{path: "/usr/share/oem", fsLabel: "OEM"},
+}
+
+// Mount mounts the partitions of the installed disk on table read-only
+// under dir. The returned function unmounts them again.
+func Mount(table *PartitionTable, dir string) (func() error, error) {
+	var mounted []string
+	unmount := func() error {
+		var firstErr error
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if out, err := exec.Command("umount", mounted[i]).CombinedOutput(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("unmounting %s: %v: %s", mounted[i], err, out)
+			}
+		}
+		return firstErr
+	}
+
+	for _, mp := range mountPoints {
+		partition := findPartition(table, mp)
+		if partition == nil {
+			unmount()
+			return nil, fmt.Errorf("no partition to mount on %s", mp.path)
+		}
+
+		target := filepath.Join(dir, mp.path)
+		args := []string{"-o", mountOptions(mp, partition.FSType), partition.Device, target}
+		if partition.FSType != "" {
+			args = append([]string{"-t", partition.FSType}, args...)
+		}
+		if out, err := exec.Command("mount", args...).CombinedOutput(); err != nil {
+			unmount()
+			return nil, fmt.Errorf("mounting %s on %s: %v: %s", partition.Device, mp.path, err, out)
+		}
+		mounted = append(mounted, target)
+	}
+
+	return unmount, nil
+}
+
+func findPartition(table *PartitionTable, mp mountPoint) *Partition {
+	for i, partition := range table.Partitions {
+		if (mp.fsLabel != "" && partition.FSLabel == mp.fsLabel) ||
+			(mp.partLabel != "" && partition.Name == mp.partLabel) {
+			return &table.Partitions[i]
+		}
+	}
+	return nil
+}
+
+// mountOptions returns options which keep the filesystem untouched, not
+// even replaying its journal.
+func mountOptions(mp mountPoint, fsType string) string {
+	switch {
+	case fsType == "ext3" || fsType == "ext4":
+		return "ro,noload"
+	case fsType == "btrfs" && mp.path == "/":
+		// the same subvolume coreos-install writes to
+		return "ro,subvol=root"
+	default:
+		return "ro"
+	}
+}
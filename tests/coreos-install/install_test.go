@@ -16,28 +16,97 @@ package tests
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/coreos/init/tests/coreos-install/boot"
+	"github.com/coreos/init/tests/coreos-install/metrics"
 	"github.com/coreos/init/tests/coreos-install/register"
+	"github.com/coreos/init/tests/coreos-install/report"
 	"github.com/coreos/init/tests/coreos-install/util"
 
 	_ "github.com/coreos/init/tests/coreos-install/registry"
 )
 
-var flagBinaryPath string
+var (
+	flagBinaryPath  string
+	flagNspawnBoot  bool
+	flagQEMUBoot    bool
+	flagOVMFPath    string
+	flagArtifactDir string
+	flagThresholds  metrics.Thresholds
+	flagKeepDisk    bool
+	flagJUnit       string
+	flagJSONReport  string
+	flagTagsInclude string
+	flagTagsExclude string
+
+	// parsed from the tag flags
+	tagsInclude, tagsExclude []string
+)
 
 func init() {
 	flag.StringVar(&flagBinaryPath, "coreos-install", "coreos-install", "path to coreos-install binary")
+	flag.BoolVar(&flagNspawnBoot, "nspawn-boot", false, "boot installed disks with systemd-nspawn")
+	flag.BoolVar(&flagQEMUBoot, "qemu-boot", false, "boot installed disks with QEMU")
+	flag.StringVar(&flagOVMFPath, "ovmf", boot.DefaultOVMF, "path to the OVMF firmware for UEFI boots")
+	flag.StringVar(&flagArtifactDir, "artifact-dir", "", "directory to save test artifacts, e.g. console logs, in")
+	flag.BoolVar(&flagKeepDisk, "keep-disk", false, "keep the disk images of failed tests")
+	flag.StringVar(&flagJUnit, "junit", "", "write the results of the install tests as JUnit XML to this file")
+	flag.StringVar(&flagJSONReport, "json-report", "", "write a JSON summary of the install tests to this file")
+	flag.StringVar(&flagTagsInclude, "tags-include", "", "only run install tests with any of these comma separated tags, e.g. root,slow")
+	flag.StringVar(&flagTagsExclude, "tags-exclude", "", "don't run install tests with any of these comma separated tags, e.g. network")
+	flag.Float64Var(&flagThresholds.MinWriteMBps, "min-write-mbps", 0, "fail installs writing the image slower than this many MB/s")
+	flag.Float64Var(&flagThresholds.MinDownloadMBps, "min-download-mbps", 0, "fail installs downloading from the local server slower than this many MB/s")
 }
 
 func TestMain(m *testing.M) {
 	flag.Parse()
-	os.Exit(m.Run())
+
+	var err error
+	if tagsInclude, err = register.ParseTags(flagTagsInclude); err != nil {
+		fmt.Fprintf(os.Stderr, "-tags-include: %v\n", err)
+		os.Exit(2)
+	}
+	if tagsExclude, err = register.ParseTags(flagTagsExclude); err != nil {
+		fmt.Fprintf(os.Stderr, "-tags-exclude: %v\n", err)
+		os.Exit(2)
+	}
+
+	var output *report.Output
+	if flagJUnit != "" || flagJSONReport != "" {
+		if output, err = report.CaptureOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "capturing test output: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	code := m.Run()
+	if benchImage.dir != "" {
+		os.RemoveAll(benchImage.dir)
+	}
+
+	if output != nil {
+		output.Close()
+		if err := writeReports(output); err != nil {
+			fmt.Fprintf(os.Stderr, "writing reports: %v\n", err)
+			code = 1
+		}
+	}
+	os.Exit(code)
 }
 
 func TestCoreosInstall(t *testing.T) {
+	defer recordSetupFailure(t, time.Now())
+
+	capabilities := register.ProbeCapabilities()
+	if reason := capabilities.Missing(register.CapNetwork); reason != "" {
+		t.Skipf("the image the tests install can't be fetched: %s", reason)
+	}
+
 	// download an image to speed up most tests
 	localImagePath := util.FetchLocalImage(t)
 	defer os.RemoveAll(localImagePath)
@@ -51,16 +120,32 @@ func TestCoreosInstall(t *testing.T) {
 		BinaryPath:     flagBinaryPath,
 		LocalImagePath: filepath.Join(localImagePath, "coreos_production_image.bin.bz2"),
 		LocalAddress:   addr,
+		NspawnBoot:     flagNspawnBoot,
+		QEMUBoot:       flagQEMUBoot,
+		OVMFPath:       flagOVMFPath,
+		ArtifactDir:    flagArtifactDir,
+		KeepDisk:       flagKeepDisk,
+		BytesServed:    server.BytesServed,
+		Thresholds:     flagThresholds,
+		TagsInclude:    tagsInclude,
+		TagsExclude:    tagsExclude,
+		Capabilities:   capabilities,
+		Installed:      recordInstall,
 	}
 
-	networkUnit := util.CreateNetworkUnit(t)
-	if networkUnit != "" {
-		defer os.RemoveAll(networkUnit)
+	// only root can write to /run/systemd/network
+	if capabilities.Missing(register.CapRoot) == "" {
+		networkUnit := util.CreateNetworkUnit(t)
+		if networkUnit != "" {
+			defer os.RemoveAll(networkUnit)
+		}
+		ctx.NetworkUnit = true
 	}
 
 	for _, test := range register.Tests {
 		t.Run(test.Name, func(t *testing.T) {
 			test.Ctx = ctx
+			defer recordResult(t, test, time.Now())
 			test.Run(t)
 		})
 	}
@@ -0,0 +1,367 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package installer drives bin/coreos-install: it checks option
+// combinations before running anything, streams the output and turns the
+// known failure messages into typed errors.
+package installer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Options are the settings of a single coreos-install run. Empty fields
+// leave the coreos-install defaults alone.
+type Options struct {
+	// BinaryPath defaults to coreos-install from PATH.
+	BinaryPath string
+
+	Device  string
+	Version string
+	Board   string
+	Channel string
+	OEM     string
+	BaseURL string
+	KeyFile string
+
+	// ImageFile installs a local image instead of fetching one.
+	ImageFile string
+
+	// paths of the configs to install
+	CloudConfig    string
+	IgnitionConfig string
+
+	NetworkUnits bool
+	DryRun       bool
+	Verbose      bool
+
+	// ExtraArgs are passed before the flags generated from the options.
+	ExtraArgs []string
+
+	// Output, if set, is called with every line of output as it is
+	// written.
+	Output func(line string)
+	// Trace, if set, turns on -v and is called with every line of shell
+	// trace instead of mixing the trace into the output. It may be
+	// called concurrently with Output.
+	Trace func(line string)
+}
+
+// Validate reports option combinations coreos-install would reject or
+// silently ignore.
+func (opts Options) Validate() error {
+	if opts.Device == "" {
+		return fmt.Errorf("no target device")
+	}
+
+	if opts.ImageFile != "" {
+		// a local image is neither fetched nor verified
+		conflicts := []struct {
+			name  string
+			value string
+		}{
+			{"base URL", opts.BaseURL},
+			{"version", opts.Version},
+			{"channel", opts.Channel},
+			{"board", opts.Board},
+			{"key file", opts.KeyFile},
+			{"OEM", opts.OEM},
+		}
+		for _, c := range conflicts {
+			if c.value != "" {
+				return fmt.Errorf("the %s is ignored when installing a local image", c.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Args returns the command line arguments for opts.
+func (opts Options) Args() ([]string, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	args := append([]string{}, opts.ExtraArgs...)
+	args = append(args, "-d", opts.Device)
+
+	flags := []struct {
+		flag  string
+		value string
+	}{
+		{"-b", opts.BaseURL},
+		{"-f", opts.ImageFile},
+		{"-V", opts.Version},
+		{"-C", opts.Channel},
+		{"-B", opts.Board},
+		{"-o", opts.OEM},
+		{"-k", opts.KeyFile},
+	}
+	for _, f := range flags {
+		if f.value != "" {
+			args = append(args, f.flag, f.value)
+		}
+	}
+
+	if opts.NetworkUnits {
+		args = append(args, "-n")
+	}
+	if opts.IgnitionConfig != "" {
+		args = append(args, "-i", opts.IgnitionConfig)
+	}
+	if opts.CloudConfig != "" {
+		args = append(args, "-c", opts.CloudConfig)
+	}
+	if opts.DryRun {
+		args = append(args, "-y")
+	}
+	if opts.Verbose {
+		args = append(args, "-v")
+	}
+
+	return args, nil
+}
+
+// Command returns the command coreos-install runs as.
+func (opts Options) Command(ctx context.Context) (*exec.Cmd, error) {
+	args, err := opts.Args()
+	if err != nil {
+		return nil, err
+	}
+
+	binary := opts.BinaryPath
+	if binary == "" {
+		binary = "coreos-install"
+	}
+	return exec.CommandContext(ctx, binary, args...), nil
+}
+
+// Result describes a successful installation.
+type Result struct {
+	// Summary is the installed version, e.g.
+	// "CoreOS Container Linux stable 1465.7.0".
+	Summary string
+	Device  string
+	// Output holds every line written by coreos-install.
+	Output []string
+
+	// CPU time used by coreos-install and the commands it waited for,
+	// mostly the download, decompress and verify pipeline
+	UserTime   time.Duration
+	SystemTime time.Duration
+}
+
+var successRegexp = regexp.MustCompile(`^Success! (.*) is installed on (.*)$`)
+
+// Run runs coreos-install and waits for it to finish. Failures of
+// coreos-install itself are returned as *Error.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Trace != nil {
+		opts.Verbose = true
+	}
+	cmd, err := opts.Command(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// one pipe for both keeps stdout and stderr in order
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	traceDone := make(chan struct{})
+	if opts.Trace != nil {
+		traceR, traceW, err := os.Pipe()
+		if err != nil {
+			r.Close()
+			w.Close()
+			return nil, err
+		}
+		// coreos-install uses fd 3 itself
+		cmd.ExtraFiles = []*os.File{nil, traceW}
+		cmd.Env = append(os.Environ(), "BASH_XTRACEFD=4")
+		go func() {
+			defer close(traceDone)
+			defer traceR.Close()
+			scanner := bufio.NewScanner(traceR)
+			// the key is traced as a single assignment
+			scanner.Buffer(nil, 1024*1024)
+			for scanner.Scan() {
+				opts.Trace(scanner.Text())
+			}
+			// don't block coreos-install on an overlong line
+			io.Copy(ioutil.Discard, traceR)
+		}()
+	} else {
+		close(traceDone)
+	}
+
+	err = cmd.Start()
+	w.Close()
+	if opts.Trace != nil {
+		cmd.ExtraFiles[1].Close()
+	}
+	if err != nil {
+		r.Close()
+		<-traceDone
+		return nil, fmt.Errorf("starting %s: %v", cmd.Path, err)
+	}
+
+	res := &Result{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		res.Output = append(res.Output, line)
+		if opts.Output != nil {
+			opts.Output(line)
+		}
+		if match := successRegexp.FindStringSubmatch(line); match != nil {
+			res.Summary = match[1]
+			res.Device = match[2]
+		}
+	}
+	r.Close()
+
+	err = cmd.Wait()
+	<-traceDone
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, newError(err, res.Output)
+	}
+	res.UserTime = cmd.ProcessState.UserTime()
+	res.SystemTime = cmd.ProcessState.SystemTime()
+
+	// dry runs exit after printing the settings
+	if res.Summary == "" && !opts.DryRun {
+		return nil, &Error{Kind: Unknown, Message: "coreos-install exited without reporting success", Output: res.Output}
+	}
+
+	return res, nil
+}
+
+// Kind classifies installation failures.
+type Kind int
+
+const (
+	Unknown Kind = iota
+	NoDevice
+	NotDisk
+	NotWritable
+	InvalidCloudConfig
+	InvalidIgnitionConfig
+	UnreadableImage
+	MissingTool
+	VersionUnavailable
+	ImageUnavailable
+	SignatureUnavailable
+	DownloadFailed
+	BadSignature
+	NoSpace
+	WriteFailed
+)
+
+var kindNames = map[Kind]string{
+	Unknown:               "unknown",
+	NoDevice:              "no device",
+	NotDisk:               "not a disk",
+	NotWritable:           "not writable",
+	InvalidCloudConfig:    "invalid cloud-config",
+	InvalidIgnitionConfig: "invalid Ignition config",
+	UnreadableImage:       "unreadable image",
+	MissingTool:           "missing tool",
+	VersionUnavailable:    "version unavailable",
+	ImageUnavailable:      "image unavailable",
+	SignatureUnavailable:  "signature unavailable",
+	DownloadFailed:        "download failed",
+	BadSignature:          "bad signature",
+	NoSpace:               "no space left",
+	WriteFailed:           "write failed",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// the messages coreos-install fails with, most specific first
+var failures = []struct {
+	kind Kind
+	re   *regexp.Regexp
+}{
+	{NoSpace, regexp.MustCompile(`No space left on device`)},
+	{NoDevice, regexp.MustCompile(`No target block device provided`)},
+	{NotDisk, regexp.MustCompile(`Target block device \(.*\) is not a full disk`)},
+	{NotWritable, regexp.MustCompile(`Target block device \(.*\) is not writable`)},
+	{InvalidCloudConfig, regexp.MustCompile(`Cloud config file \(.*\) (does not exist|is not valid)`)},
+	{InvalidIgnitionConfig, regexp.MustCompile(`Ignition config file \(.*\) does not exist`)},
+	{UnreadableImage, regexp.MustCompile(`Could not read image file`)},
+	{MissingTool, regexp.MustCompile(`^Missing \w+!$`)},
+	{VersionUnavailable, regexp.MustCompile(`version\.txt unavailable`)},
+	{ImageUnavailable, regexp.MustCompile(`Image URL unavailable`)},
+	{SignatureUnavailable, regexp.MustCompile(`Image signature unavailable`)},
+	{BadSignature, regexp.MustCompile(`GPG signature verification failed`)},
+	{DownloadFailed, regexp.MustCompile(`Download of .* did not complete`)},
+	{WriteFailed, regexp.MustCompile(`Cannot expand .* to `)},
+}
+
+// Error is a failed coreos-install run.
+type Error struct {
+	Kind Kind
+	// Message is the line the failure was recognized by.
+	Message    string
+	ExitStatus int
+	Output     []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("coreos-install failed (%s): %s", e.Kind, e.Message)
+}
+
+func newError(err error, output []string) *Error {
+	e := &Error{Kind: Unknown, Message: err.Error(), ExitStatus: -1, Output: output}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			e.ExitStatus = status.ExitStatus()
+		}
+	}
+
+	for _, f := range failures {
+		for _, line := range output {
+			if f.re.MatchString(line) {
+				e.Kind = f.kind
+				e.Message = strings.TrimSpace(line)
+				return e
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,266 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package installer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArgs(t *testing.T) {
+	tests := []struct {
+		opts Options
+		args []string
+		err  string
+	}{
+		{
+			opts: Options{Device: "/dev/loop0"},
+			args: []string{"-d", "/dev/loop0"},
+		},
+		{
+			opts: Options{
+				Device:         "/dev/sda",
+				BaseURL:        "http://mirror/amd64-usr",
+				Version:        "1465.7.0",
+				Channel:        "stable",
+				Board:          "amd64-usr",
+				OEM:            "ami",
+				KeyFile:        "/tmp/key.asc",
+				NetworkUnits:   true,
+				IgnitionConfig: "/tmp/config.ign",
+				CloudConfig:    "/tmp/user_data",
+				DryRun:         true,
+			},
+			args: []string{"-d", "/dev/sda", "-b", "http://mirror/amd64-usr", "-V", "1465.7.0", "-C", "stable",
+				"-B", "amd64-usr", "-o", "ami", "-k", "/tmp/key.asc", "-n", "-i", "/tmp/config.ign", "-c", "/tmp/user_data", "-y"},
+		},
+		{
+			opts: Options{Device: "/dev/sda", ImageFile: "/tmp/image.bin.bz2", ExtraArgs: []string{"-v"}},
+			args: []string{"-v", "-d", "/dev/sda", "-f", "/tmp/image.bin.bz2"},
+		},
+		{
+			opts: Options{},
+			err:  "no target device",
+		},
+		{
+			opts: Options{Device: "/dev/sda", ImageFile: "/tmp/image.bin.bz2", BaseURL: "http://mirror"},
+			err:  "the base URL is ignored when installing a local image",
+		},
+		{
+			opts: Options{Device: "/dev/sda", ImageFile: "/tmp/image.bin.bz2", OEM: "packet"},
+			err:  "the OEM is ignored when installing a local image",
+		},
+		{
+			opts: Options{Device: "/dev/sda", ImageFile: "/tmp/image.bin.bz2", Version: "current"},
+			err:  "the version is ignored when installing a local image",
+		},
+	}
+
+	for _, test := range tests {
+		args, err := test.opts.Args()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%+v: expected error %q, received %v", test.opts, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.opts, err)
+		} else if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%+v: expected %q, received %q", test.opts, test.args, args)
+		}
+	}
+}
+
+// fakeInstaller writes a coreos-install replacement running script
+func fakeInstaller(t *testing.T, script string) (string, func()) {
+	dir, err := ioutil.TempDir("", "installer")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	path := filepath.Join(dir, "coreos-install")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/bash\n"+script), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("writing %s: %v", path, err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestRun(t *testing.T) {
+	binary, cleanup := fakeInstaller(t, `echo "args: $*"
+echo "Downloading the signature for http://mirror/1465.7.0/coreos_production_image.bin.bz2..."
+echo "warning from stderr" >&2
+echo "Success! CoreOS Container Linux stable 1465.7.0 is installed on $2"
+`)
+	defer cleanup()
+
+	var streamed []string
+	res, err := Run(context.Background(), Options{
+		BinaryPath: binary,
+		Device:     "/dev/loop3",
+		Channel:    "stable",
+		Output:     func(line string) { streamed = append(streamed, line) },
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	if res.Summary != "CoreOS Container Linux stable 1465.7.0" || res.Device != "/dev/loop3" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	expected := []string{
+		"args: -d /dev/loop3 -C stable",
+		"Downloading the signature for http://mirror/1465.7.0/coreos_production_image.bin.bz2...",
+		"warning from stderr",
+		"Success! CoreOS Container Linux stable 1465.7.0 is installed on /dev/loop3",
+	}
+	if !reflect.DeepEqual(streamed, expected) || !reflect.DeepEqual(res.Output, expected) {
+		t.Fatalf("unexpected output: expected %q, streamed %q, returned %q", expected, streamed, res.Output)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	binary, cleanup := fakeInstaller(t, `echo "Settings:"; echo "    DEVICE:   $2"`)
+	defer cleanup()
+
+	res, err := Run(context.Background(), Options{BinaryPath: binary, Device: "/dev/loop3", DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if res.Summary != "" || len(res.Output) != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestRunTrace(t *testing.T) {
+	binary, cleanup := fakeInstaller(t, `[ "$1" = -d -a "$3" = -v ] && set -x
+echo "Writing /tmp/image.bin.bz2..." >&3
+echo "Success! CoreOS Container Linux is installed on $2"
+`)
+	defer cleanup()
+
+	var trace []string
+	res, err := Run(context.Background(), Options{
+		BinaryPath: binary,
+		Device:     "/dev/loop3",
+		Trace:      func(line string) { trace = append(trace, line) },
+	})
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	// fd 3 is left to coreos-install, so the echo to it fails
+	expected := []string{"Success! CoreOS Container Linux is installed on /dev/loop3"}
+	if len(res.Output) < 1 || res.Output[len(res.Output)-1] != expected[0] {
+		t.Fatalf("unexpected output: %q", res.Output)
+	}
+	for _, line := range res.Output {
+		if strings.HasPrefix(line, "+") {
+			t.Errorf("trace in output: %q", line)
+		}
+	}
+	expectedTrace := []string{
+		"+ echo 'Writing /tmp/image.bin.bz2...'",
+		"+ echo 'Success! CoreOS Container Linux is installed on /dev/loop3'",
+	}
+	if !reflect.DeepEqual(trace, expectedTrace) {
+		t.Fatalf("unexpected trace: expected %q, received %q", expectedTrace, trace)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		script  string
+		kind    Kind
+		message string
+		status  int
+	}{
+		{
+			script:  `echo "$0: Target block device (/dev/sda1) is not a full disk." >&2; exit 1`,
+			kind:    NotDisk,
+			message: "is not a full disk.",
+			status:  1,
+		},
+		{
+			script:  `echo "Writing /tmp/image.bin.bz2..."; echo "dd: error writing '/dev/loop0': No space left on device" >&2; echo "Error: return code 1 from dd" >&2; exit 1`,
+			kind:    NoSpace,
+			message: "dd: error writing '/dev/loop0': No space left on device",
+			status:  1,
+		},
+		{
+			script:  `echo "0: Download of coreos_production_image.bin.bz2 did not complete" >&2; echo "1: GPG signature verification failed for coreos_production_image.bin.bz2" >&2; exit 1`,
+			kind:    BadSignature,
+			message: "1: GPG signature verification failed for coreos_production_image.bin.bz2",
+			status:  1,
+		},
+		{
+			script:  `echo "$0: version.txt unavailable: http://mirror/current/version.txt" >&2; exit 1`,
+			kind:    VersionUnavailable,
+			message: "version.txt unavailable",
+			status:  1,
+		},
+		{
+			script:  `echo 'Missing gpg!' >&2; exit 1`,
+			kind:    MissingTool,
+			message: "Missing gpg!",
+			status:  1,
+		},
+		{
+			script:  `echo "something else"; exit 3`,
+			kind:    Unknown,
+			message: "exit status 3",
+			status:  3,
+		},
+		{
+			script:  `echo "all done"`,
+			kind:    Unknown,
+			message: "coreos-install exited without reporting success",
+		},
+	}
+
+	for _, test := range tests {
+		binary, cleanup := fakeInstaller(t, test.script)
+		_, err := Run(context.Background(), Options{BinaryPath: binary, Device: "/dev/loop0"})
+		cleanup()
+
+		installErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: expected an *Error, received %v", test.script, err)
+			continue
+		}
+		if installErr.Kind != test.kind || !strings.Contains(installErr.Message, test.message) || installErr.ExitStatus != test.status {
+			t.Errorf("%s: expected %s error %q with status %d, received %s error %q with status %d",
+				test.script, test.kind, test.message, test.status, installErr.Kind, installErr.Message, installErr.ExitStatus)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	binary, cleanup := fakeInstaller(t, "exec sleep 60\n")
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := Run(ctx, Options{BinaryPath: binary, Device: "/dev/loop0"}); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, received %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics times the phases of a coreos-install run from its
+// output and works out how fast the image was downloaded and written.
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phase names, in the order coreos-install goes through them.
+const (
+	PhaseStart        = "start"
+	PhaseVersion      = "version"
+	PhaseSignature    = "signature"
+	PhaseDownload     = "download"
+	PhaseWriteLocal   = "write-local"
+	PhaseCloudConfig  = "cloud-config"
+	PhaseNetworkUnits = "network-units"
+	PhaseIgnition     = "ignition"
+	PhaseSuccess      = "success"
+)
+
+// phasePrefixes maps the lines coreos-install starts phases with to the
+// phases.
+var phasePrefixes = []struct {
+	prefix string
+	phase  string
+}{
+	{"Current version of CoreOS Container Linux", PhaseVersion},
+	{"Downloading the signature", PhaseSignature},
+	{"Downloading, writing and verifying", PhaseDownload},
+	{"Writing ", PhaseWriteLocal},
+	{"Installing cloud-config", PhaseCloudConfig},
+	{"Copying network units", PhaseNetworkUnits},
+	{"Installing Ignition config", PhaseIgnition},
+	{"Success!", PhaseSuccess},
+}
+
+// MB is the unit throughputs are given in.
+const MB = 1000 * 1000
+
+// Phase is a part of an install, lasting until the next one starts.
+type Phase struct {
+	Name string `json:"name"`
+	// StartSeconds is when the phase started, relative to the start of
+	// the install
+	StartSeconds float64 `json:"start_seconds"`
+	Seconds      float64 `json:"seconds"`
+}
+
+// Metrics describe a single install.
+type Metrics struct {
+	Test        string  `json:"test,omitempty"`
+	Device      string  `json:"device,omitempty"`
+	Phases      []Phase `json:"phases"`
+	WallSeconds float64 `json:"wall_seconds"`
+
+	// BytesWritten is what the device reports as written
+	BytesWritten int64 `json:"bytes_written"`
+	// BytesServed is what the local server sent, zero for installs from
+	// elsewhere
+	BytesServed int64 `json:"bytes_served"`
+
+	// throughputs of the phase writing the image, in MB/s
+	WriteMBps    float64 `json:"write_mbps"`
+	DownloadMBps float64 `json:"download_mbps"`
+}
+
+// Phase returns the phase with the given name, or nil if the install
+// didn't go through it.
+func (m *Metrics) Phase(name string) *Phase {
+	for i, phase := range m.Phases {
+		if phase.Name == name {
+			return &m.Phases[i]
+		}
+	}
+	return nil
+}
+
+// Recorder timestamps phases as lines of output arrive.
+type Recorder struct {
+	start  time.Time
+	phases []Phase
+	now    func() time.Time
+}
+
+// NewRecorder starts timing an install.
+func NewRecorder() *Recorder {
+	return newRecorder(time.Now)
+}
+
+func newRecorder(now func() time.Time) *Recorder {
+	return &Recorder{
+		start:  now(),
+		phases: []Phase{{Name: PhaseStart}},
+		now:    now,
+	}
+}
+
+// Line records a line of output, starting a new phase if it announces
+// one. It can be used as installer.Options.Output.
+func (r *Recorder) Line(line string) {
+	for _, p := range phasePrefixes {
+		if strings.HasPrefix(line, p.prefix) {
+			r.begin(p.phase)
+			return
+		}
+	}
+}
+
+func (r *Recorder) begin(name string) {
+	offset := r.now().Sub(r.start).Seconds()
+	last := &r.phases[len(r.phases)-1]
+	last.Seconds = offset - last.StartSeconds
+	r.phases = append(r.phases, Phase{Name: name, StartSeconds: offset})
+}
+
+// Finish ends the last phase and works out the throughputs from the
+// bytes written to the device and served during the install.
+func (r *Recorder) Finish(bytesWritten, bytesServed int64) *Metrics {
+	wall := r.now().Sub(r.start).Seconds()
+	phases := append([]Phase{}, r.phases...)
+	last := &phases[len(phases)-1]
+	last.Seconds = wall - last.StartSeconds
+
+	m := &Metrics{
+		Phases:       phases,
+		WallSeconds:  wall,
+		BytesWritten: bytesWritten,
+		BytesServed:  bytesServed,
+	}
+
+	// the image is downloaded, decompressed and written in one pipeline
+	write := m.Phase(PhaseDownload)
+	if write == nil {
+		write = m.Phase(PhaseWriteLocal)
+	}
+	if write != nil && write.Seconds > 0 {
+		m.WriteMBps = float64(bytesWritten) / MB / write.Seconds
+		m.DownloadMBps = float64(bytesServed) / MB / write.Seconds
+	}
+	return m
+}
+
+// Thresholds are the slowest installs allowed. Zero disables a threshold.
+type Thresholds struct {
+	MinWriteMBps    float64
+	MinDownloadMBps float64
+}
+
+// Check returns an error describing every threshold m falls below.
+// Throughputs which weren't measured aren't checked.
+func (th Thresholds) Check(m *Metrics) error {
+	var slow []string
+	if th.MinWriteMBps > 0 && m.BytesWritten > 0 && m.WriteMBps < th.MinWriteMBps {
+		slow = append(slow, fmt.Sprintf("wrote %.1f MB/s, expected at least %.1f MB/s", m.WriteMBps, th.MinWriteMBps))
+	}
+	if th.MinDownloadMBps > 0 && m.BytesServed > 0 && m.DownloadMBps < th.MinDownloadMBps {
+		slow = append(slow, fmt.Sprintf("downloaded %.1f MB/s, expected at least %.1f MB/s", m.DownloadMBps, th.MinDownloadMBps))
+	}
+	if len(slow) > 0 {
+		return fmt.Errorf("install too slow: %s", strings.Join(slow, ", "))
+	}
+	return nil
+}
+
+// sysBlock is where the statistics of block devices are found.
+var sysBlock = "/sys/class/block"
+
+// BytesWritten returns how much has been written to a block device since
+// it was set up, e.g. /dev/loop0.
+func BytesWritten(device string) (int64, error) {
+	path := filepath.Join(sysBlock, filepath.Base(device), "stat")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// the seventh field is the sectors written, which are always 512
+	// bytes in these statistics
+	fields := strings.Fields(string(data))
+	if len(fields) < 7 {
+		return 0, fmt.Errorf("%s has %d fields", path, len(fields))
+	}
+	sectors, err := strconv.ParseInt(fields[6], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return sectors * 512, nil
+}
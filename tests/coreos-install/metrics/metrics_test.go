@@ -0,0 +1,124 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	clock := time.Unix(0, 0)
+	r := newRecorder(func() time.Time { return clock })
+
+	for _, step := range []struct {
+		after time.Duration
+		line  string
+	}{
+		{1 * time.Second, "Current version of CoreOS Container Linux stable is 1465.7.0"},
+		{1 * time.Second, "Downloading the signature for https://stable.release.core-os.net/amd64-usr/1465.7.0/coreos_production_image.bin.bz2..."},
+		{2 * time.Second, "gpg: key 50E0885593D2DCB4 marked as ultimately trusted"},
+		{2 * time.Second, "Downloading, writing and verifying coreos_production_image.bin.bz2..."},
+		{20 * time.Second, "Installing cloud-config..."},
+		{1 * time.Second, "Success! CoreOS Container Linux stable 1465.7.0 is installed on /dev/loop0"},
+	} {
+		clock = clock.Add(step.after)
+		r.Line(step.line)
+	}
+	clock = clock.Add(3 * time.Second)
+
+	m := r.Finish(800*MB, 200*MB)
+
+	expected := []Phase{
+		{PhaseStart, 0, 1},
+		{PhaseVersion, 1, 1},
+		{PhaseSignature, 2, 4},
+		{PhaseDownload, 6, 20},
+		{PhaseCloudConfig, 26, 1},
+		{PhaseSuccess, 27, 3},
+	}
+	if !reflect.DeepEqual(m.Phases, expected) {
+		t.Errorf("recorded phases %+v, expected %+v", m.Phases, expected)
+	}
+	if m.WallSeconds != 30 {
+		t.Errorf("wall time %v, expected 30", m.WallSeconds)
+	}
+	if m.WriteMBps != 40 || m.DownloadMBps != 10 {
+		t.Errorf("throughputs %v and %v MB/s, expected 40 and 10", m.WriteMBps, m.DownloadMBps)
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	m := &Metrics{BytesWritten: 1, BytesServed: 1, WriteMBps: 40, DownloadMBps: 10}
+
+	tests := []struct {
+		th  Thresholds
+		err string
+	}{
+		{Thresholds{}, ""},
+		{Thresholds{MinWriteMBps: 40, MinDownloadMBps: 10}, ""},
+		{Thresholds{MinWriteMBps: 50}, "wrote 40.0 MB/s, expected at least 50.0 MB/s"},
+		{Thresholds{MinWriteMBps: 50, MinDownloadMBps: 20}, "MB/s, downloaded 10.0 MB/s"},
+	}
+	for _, test := range tests {
+		err := test.th.Check(m)
+		if test.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.th, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: expected error containing %q, received %v", test.th, test.err, err)
+		}
+	}
+
+	// nothing was downloaded from the local server
+	if err := (Thresholds{MinDownloadMBps: 20}).Check(&Metrics{BytesWritten: 1, WriteMBps: 40}); err != nil {
+		t.Errorf("unmeasured download checked: %v", err)
+	}
+}
+
+func TestBytesWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(orig string) { sysBlock = orig }(sysBlock)
+	sysBlock = dir
+
+	if err := os.Mkdir(filepath.Join(dir, "loop0"), 0755); err != nil {
+		t.Fatalf("creating loop0: %v", err)
+	}
+	stat := "     164        0     6418      100   123456        0  2097152     5000        0     1200     5100\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "loop0", "stat"), []byte(stat), 0644); err != nil {
+		t.Fatalf("writing stat: %v", err)
+	}
+
+	written, err := BytesWritten("/dev/loop0")
+	if err != nil {
+		t.Fatalf("reading bytes written: %v", err)
+	}
+	if written != 2097152*512 {
+		t.Errorf("read %d bytes written, expected %d", written, 2097152*512)
+	}
+
+	if _, err := BytesWritten("/dev/loop1"); err == nil {
+		t.Errorf("reading a missing device succeeded")
+	}
+}
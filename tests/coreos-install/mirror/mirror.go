@@ -0,0 +1,274 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mirror lays out Container Linux releases the way the release
+// servers do, so coreos-install can install from the tree with -b.
+//
+// A mirror holds one directory per board, each with one directory per
+// version and a current symlink to the newest version:
+//
+//	<board>/<version>/version.txt
+//	<board>/<version>/coreos_production_image.bin.bz2
+//	<board>/<version>/coreos_production_image.bin.bz2.sig
+//	<board>/<version>/coreos_production_<oem>_image.bin.bz2
+//	<board>/<version>/coreos_production_<oem>_image.bin.bz2.sig
+//	<board>/current -> <version>
+package mirror
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Current is the name of the link to the newest version of a board.
+const Current = "current"
+
+// Image is an image file of a release.
+type Image struct {
+	// OEM is the OEM id of an OEM image, empty for the generic image
+	OEM  string
+	Path string
+	// Signature is the detached signature of Path, ignored when the
+	// mirror is signed with its own key
+	Signature string
+}
+
+// Release is a version of Container Linux for one board.
+type Release struct {
+	Board      string
+	VersionTxt string
+	Images     []Image
+}
+
+// ImageName is the name coreos-install downloads for an OEM, or the
+// generic image if oem is empty.
+func ImageName(oem string) string {
+	if oem == "" {
+		return "coreos_production_image.bin.bz2"
+	}
+	return fmt.Sprintf("coreos_production_%s_image.bin.bz2", oem)
+}
+
+// ReadVersion returns the COREOS_VERSION of a version.txt.
+func ReadVersion(versionTxt string) (string, error) {
+	data, err := ioutil.ReadFile(versionTxt)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", versionTxt, err)
+	}
+	match := regexp.MustCompile(`(?m)^COREOS_VERSION=(.+)$`).FindSubmatch(data)
+	if match == nil {
+		return "", fmt.Errorf("%s has no COREOS_VERSION", versionTxt)
+	}
+	return strings.TrimSpace(string(match[1])), nil
+}
+
+// Signer signs images with a key of its own instead of the release key.
+type Signer struct {
+	entity *openpgp.Entity
+}
+
+// NewSigner reads an armored, unencrypted private key.
+func NewSigner(r io.Reader) (*Signer, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %v", err)
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			return nil, fmt.Errorf("signing key %s is encrypted", entity.PrimaryKey.KeyIdString())
+		}
+		return &Signer{entity: entity}, nil
+	}
+	return nil, fmt.Errorf("no private key found")
+}
+
+// KeyID is the long id of the signing key, for use with gpg.
+func (s *Signer) KeyID() string {
+	return s.entity.PrimaryKey.KeyIdString()
+}
+
+// WritePublicKey writes the armored public key, which coreos-install must
+// be given with -k to verify the images.
+func (s *Signer) WritePublicKey(w io.Writer) error {
+	wc, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.entity.Serialize(wc); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+// Sign writes a detached binary signature of the file at path.
+func (s *Signer) Sign(path, sigPath string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sig, err := os.Create(sigPath)
+	if err != nil {
+		return err
+	}
+	if err := openpgp.DetachSign(sig, s.entity, file, nil); err != nil {
+		sig.Close()
+		return fmt.Errorf("signing %s: %v", path, err)
+	}
+	return sig.Close()
+}
+
+// Add copies a release into the mirror at dir, signing its images with
+// signer if it isn't nil, and points current at the newest version of the
+// board. It returns the version added.
+func Add(dir string, release Release, signer *Signer) (string, error) {
+	if release.Board == "" {
+		return "", fmt.Errorf("no board given")
+	}
+	version, err := ReadVersion(release.VersionTxt)
+	if err != nil {
+		return "", err
+	}
+	if version == Current {
+		return "", fmt.Errorf("version %q is reserved", Current)
+	}
+
+	versionDir := filepath.Join(dir, release.Board, version)
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		return "", err
+	}
+	if err := copyFile(release.VersionTxt, filepath.Join(versionDir, "version.txt")); err != nil {
+		return "", err
+	}
+
+	seen := map[string]bool{}
+	for _, image := range release.Images {
+		name := ImageName(image.OEM)
+		if seen[name] {
+			return "", fmt.Errorf("more than one %s given", name)
+		}
+		seen[name] = true
+
+		target := filepath.Join(versionDir, name)
+		if err := copyFile(image.Path, target); err != nil {
+			return "", err
+		}
+
+		if signer != nil {
+			err = signer.Sign(target, target+".sig")
+		} else if image.Signature == "" {
+			err = fmt.Errorf("%s has no signature", image.Path)
+		} else {
+			err = copyFile(image.Signature, target+".sig")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return version, updateCurrent(filepath.Join(dir, release.Board))
+}
+
+// updateCurrent points the current link of a board at its newest version.
+func updateCurrent(boardDir string) error {
+	entries, err := ioutil.ReadDir(boardDir)
+	if err != nil {
+		return err
+	}
+
+	var newest string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == Current {
+			continue
+		}
+		if newest == "" || CompareVersions(entry.Name(), newest) > 0 {
+			newest = entry.Name()
+		}
+	}
+	if newest == "" {
+		return fmt.Errorf("no versions in %s", boardDir)
+	}
+
+	// replace the link atomically so the mirror can be served meanwhile
+	tmp := filepath.Join(boardDir, "."+Current)
+	os.Remove(tmp)
+	if err := os.Symlink(newest, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(boardDir, Current)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("updating %s link: %v", Current, err)
+	}
+	return nil
+}
+
+// CompareVersions compares dotted version numbers, returning -1, 0 or 1.
+// Components which aren't numbers are compared as strings.
+func CompareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		if i >= len(as) {
+			return -1
+		}
+		if i >= len(bs) {
+			return 1
+		}
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("copying %s: %v", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,240 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirror
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func writeFile(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+	return path
+}
+
+// release writes a version.txt, an image and its signature to dir.
+func release(t *testing.T, dir, version string) Release {
+	dir = filepath.Join(dir, version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("creating %s: %v", dir, err)
+	}
+	return Release{
+		Board:      "amd64-usr",
+		VersionTxt: writeFile(t, dir, "version.txt", fmt.Sprintf("COREOS_BUILD=1\nCOREOS_VERSION=%s\n", version)),
+		Images: []Image{
+			{
+				Path:      writeFile(t, dir, "image", "generic "+version),
+				Signature: writeFile(t, dir, "image.sig", "signature "+version),
+			},
+			{
+				OEM:       "packet",
+				Path:      writeFile(t, dir, "packet", "packet "+version),
+				Signature: writeFile(t, dir, "packet.sig", "signature packet "+version),
+			},
+		},
+	}
+}
+
+func newSigner(t *testing.T) *Signer {
+	entity, err := openpgp.NewEntity("Mirror", "", "mirror@example.com", nil)
+	if err != nil {
+		t.Fatalf("creating key: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("encoding key: %v", err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatalf("serializing key: %v", err)
+	}
+	w.Close()
+
+	signer, err := NewSigner(&buf)
+	if err != nil {
+		t.Fatalf("reading key: %v", err)
+	}
+	return signer
+}
+
+func TestImageName(t *testing.T) {
+	for oem, name := range map[string]string{
+		"":           "coreos_production_image.bin.bz2",
+		"packet":     "coreos_production_packet_image.bin.bz2",
+		"vmware_raw": "coreos_production_vmware_raw_image.bin.bz2",
+	} {
+		if got := ImageName(oem); got != name {
+			t.Errorf("ImageName(%q) = %s, expected %s", oem, got, name)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"1465.7.0", "1465.7.0", 0},
+		{"1465.7.0", "1520.3.0", -1},
+		{"1520.10.0", "1520.9.0", 1},
+		{"1520.0", "1520.0.0", -1},
+		{"1520.0.0+dev", "1520.0.0", 1},
+	} {
+		if cmp := CompareVersions(c.a, c.b); cmp != c.cmp {
+			t.Errorf("CompareVersions(%s, %s) = %d, expected %d", c.a, c.b, cmp, c.cmp)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	src, err := ioutil.TempDir("", "mirror-src")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(src)
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the newest version wins whatever the order they are added in
+	for _, version := range []string{"1520.9.0", "1520.10.0", "1465.7.0"} {
+		added, err := Add(dir, release(t, src, version), nil)
+		if err != nil {
+			t.Fatalf("adding %s: %v", version, err)
+		}
+		if added != version {
+			t.Fatalf("added version %s, expected %s", added, version)
+		}
+	}
+
+	expected := map[string]string{
+		"version.txt":                                "COREOS_BUILD=1\nCOREOS_VERSION=1520.10.0\n",
+		"coreos_production_image.bin.bz2":            "generic 1520.10.0",
+		"coreos_production_image.bin.bz2.sig":        "signature 1520.10.0",
+		"coreos_production_packet_image.bin.bz2":     "packet 1520.10.0",
+		"coreos_production_packet_image.bin.bz2.sig": "signature packet 1520.10.0",
+	}
+	for name, data := range expected {
+		path := filepath.Join(dir, "amd64-usr", Current, name)
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		if string(got) != data {
+			t.Errorf("%s contains %q, expected %q", path, got, data)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "amd64-usr", "."+Current)); !os.IsNotExist(err) {
+		t.Errorf("temporary link left behind: %v", err)
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	src, err := ioutil.TempDir("", "mirror-src")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(src)
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	unsigned := release(t, src, "1465.7.0")
+	unsigned.Images[0].Signature = ""
+	duplicate := release(t, src, "1465.7.0")
+	duplicate.Images[1].OEM = ""
+	noBoard := release(t, src, "1465.7.0")
+	noBoard.Board = ""
+	noVersion := release(t, src, "1465.7.0")
+	noVersion.VersionTxt = writeFile(t, src, "empty-version.txt", "COREOS_BUILD=1\n")
+
+	for name, r := range map[string]Release{
+		"unsigned":   unsigned,
+		"duplicate":  duplicate,
+		"no board":   noBoard,
+		"no version": noVersion,
+	} {
+		if _, err := Add(dir, r, nil); err == nil {
+			t.Errorf("%s: adding the release succeeded", name)
+		}
+	}
+}
+
+func TestAddSigned(t *testing.T) {
+	src, err := ioutil.TempDir("", "mirror-src")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(src)
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer := newSigner(t)
+	r := release(t, src, "1465.7.0")
+	// signatures given are replaced, so they needn't exist
+	r.Images[1].Signature = ""
+	if _, err := Add(dir, r, signer); err != nil {
+		t.Fatalf("adding release: %v", err)
+	}
+
+	var key bytes.Buffer
+	if err := signer.WritePublicKey(&key); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(&key)
+	if err != nil {
+		t.Fatalf("reading public key: %v", err)
+	}
+	if len(keyring) != 1 || keyring[0].PrivateKey != nil {
+		t.Fatalf("public key export contains %d keys or a private key", len(keyring))
+	}
+
+	for _, name := range []string{ImageName(""), ImageName("packet")} {
+		path := filepath.Join(dir, "amd64-usr", "1465.7.0", name)
+		image, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("opening %s: %v", path, err)
+		}
+		sig, err := os.Open(path + ".sig")
+		if err != nil {
+			image.Close()
+			t.Fatalf("opening %s.sig: %v", path, err)
+		}
+		_, err = openpgp.CheckDetachedSignature(keyring, image, sig)
+		image.Close()
+		sig.Close()
+		if err != nil {
+			t.Errorf("verifying %s: %v", path, err)
+		}
+	}
+}
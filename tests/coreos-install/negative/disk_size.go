@@ -32,6 +32,7 @@ func init() {
 		DiskSize:     2 * 1024 * 1024 * 1024,
 		UseLocalFile: true,
 		OutputRegexp: diskSize,
+		Tags:         []string{register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name:           "Disk Size too small - Remote",
@@ -39,6 +40,7 @@ func init() {
 		DiskSize:       2 * 1024 * 1024 * 1024,
 		UseLocalServer: true,
 		OutputRegexp:   diskSize,
+		Tags:           []string{register.TagRoot},
 	})
 }
 
@@ -0,0 +1,186 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package positive
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/init/tests/coreos-install/boot"
+	"github.com/coreos/init/tests/coreos-install/register"
+)
+
+func init() {
+	register.Register(register.Test{
+		Name:         "Boot - nspawn",
+		Func:         nspawnBootTest,
+		UseLocalFile: true,
+		Tags:         []string{register.TagRoot, register.TagBoot, register.TagSlow},
+	})
+	register.Register(register.Test{
+		Name:         "Boot - QEMU BIOS",
+		Func:         qemuBootTest(boot.BIOS),
+		UseLocalFile: true,
+		Tags:         []string{register.TagRoot, register.TagBoot, register.TagSlow},
+	})
+	register.Register(register.Test{
+		Name:         "Boot - QEMU UEFI",
+		Func:         qemuBootTest(boot.UEFI),
+		UseLocalFile: true,
+		Tags:         []string{register.TagRoot, register.TagBoot, register.TagSlow},
+	})
+}
+
+func nspawnBootTest(t *testing.T, test register.Test) {
+	if !test.Ctx.NspawnBoot {
+		t.Skip("boot tests are disabled, enable them with -nspawn-boot")
+	}
+	if _, err := exec.LookPath("systemd-nspawn"); err != nil {
+		t.Skip("systemd-nspawn not found")
+	}
+	if reason := test.Ctx.Capabilities.Missing(register.CapNamespaces); reason != "" {
+		t.Skip(reason)
+	}
+
+	diskFile, loopDevice := test.CreateDevice(t)
+	defer test.CleanupDisk(t, diskFile, loopDevice)
+
+	test.RunCoreOSInstall(t, loopDevice)
+
+	rootDir := test.MountPartitions(t, loopDevice)
+	defer test.UnmountPartitions(t, loopDevice)
+
+	report, err := boot.Nspawn(rootDir, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("booting with systemd-nspawn: %v", err)
+	}
+
+	if len(report.Failed) != 0 {
+		t.Log(report.Console)
+		t.Fatalf("failed units: %s", strings.Join(report.Failed, " "))
+	}
+
+	for _, unit := range []string{"issuegen.service", "motdgen.service", "sshd-keygen.service", "setup-nsswitch.service"} {
+		state := report.Units[unit]
+		if state.Result != "success" || state.ConditionResult != "yes" {
+			t.Errorf("%s didn't run successfully: %+v", unit, state)
+		}
+	}
+	// / isn't remounted inside a container
+	if state := report.Units["remount-root.service"]; state.ConditionResult != "no" {
+		t.Errorf("remount-root.service ran inside a container: %+v", state)
+	}
+
+	for _, file := range boot.Files {
+		if _, ok := report.Files[file]; !ok {
+			t.Errorf("%s wasn't generated", file)
+		}
+	}
+	if issue := report.Files["/run/issue"]; !strings.Contains(issue, "SSH host key: ") {
+		t.Errorf("/run/issue doesn't list the host keys: %q", issue)
+	}
+	if motd := report.Files["/run/coreos/motd"]; !strings.Contains(motd, "Container Linux") {
+		t.Errorf("unexpected /run/coreos/motd: %q", motd)
+	}
+}
+
+// consoleCheck is a command run on the serial console of a booted machine
+type consoleCheck struct {
+	command string
+	status  int
+	output  string
+}
+
+// bootQEMU installs the test's image, boots it in QEMU and runs fn with
+// the machine logged in on the serial console.
+func bootQEMU(t *testing.T, test register.Test, firmware boot.Firmware, fn func(*boot.Machine)) {
+	if !test.Ctx.QEMUBoot {
+		t.Skip("boot tests are disabled, enable them with -qemu-boot")
+	}
+	if _, err := exec.LookPath("qemu-system-x86_64"); err != nil {
+		t.Skip("qemu-system-x86_64 not found")
+	}
+
+	diskFile, loopDevice := test.CreateDevice(t)
+	defer test.CleanupDisk(t, diskFile, loopDevice)
+
+	test.RunCoreOSInstall(t, loopDevice)
+
+	rootDir := test.MountPartitions(t, loopDevice)
+	err := boot.EnableAutologin(filepath.Join(rootDir, "usr", "share", "oem"))
+	test.UnmountPartitions(t, loopDevice)
+	if err != nil {
+		t.Fatalf("enabling autologin: %v", err)
+	}
+
+	m, err := boot.QEMU(boot.QEMUOptions{
+		Disk:     diskFile,
+		Firmware: firmware,
+		OVMF:     test.Ctx.OVMFPath,
+	})
+	if err != nil {
+		t.Fatalf("starting qemu: %v", err)
+	}
+	defer func() {
+		if err := m.Shutdown(2 * time.Minute); err != nil {
+			t.Errorf("shutting down: %v", err)
+		}
+		test.WriteArtifact(t, "console.log", []byte(m.Console()))
+	}()
+
+	bootTime, err := m.WaitForLogin(20 * time.Minute)
+	if err != nil {
+		t.Fatalf("waiting for the autologin prompt: %v", err)
+	}
+	t.Logf("booted to a login shell in %v", bootTime)
+	test.WriteArtifact(t, "boot-time.txt", []byte(fmt.Sprintf("%.1f\n", bootTime.Seconds())))
+
+	fn(m)
+}
+
+func runConsoleChecks(t *testing.T, m *boot.Machine, checks []consoleCheck) {
+	for _, c := range checks {
+		out, status, err := m.Run(c.command, 5*time.Minute)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if out = strings.TrimSpace(out); status != c.status || out != c.output {
+			t.Errorf("%s: expected status %d and %q, received status %d and %q", c.command, c.status, c.output, status, out)
+		}
+	}
+}
+
+func qemuBootTest(firmware boot.Firmware) func(*testing.T, register.Test) {
+	return func(t *testing.T, test register.Test) {
+		efiStatus := 1
+		if firmware == boot.UEFI {
+			efiStatus = 0
+		}
+
+		bootQEMU(t, test, firmware, func(m *boot.Machine) {
+			runConsoleChecks(t, m, []consoleCheck{
+				{"systemctl is-system-running --wait", 0, "running"},
+				{"systemctl --failed --no-legend", 0, ""},
+				{"findmnt --noheadings --output SOURCE /usr", 0, "/dev/mapper/usr"},
+				{"grep -o coreos.autologin=ttyS0 /proc/cmdline", 0, "coreos.autologin=ttyS0"},
+				{"test -d /sys/firmware/efi", efiStatus, ""},
+			})
+		})
+	}
+}
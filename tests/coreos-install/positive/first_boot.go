@@ -0,0 +1,93 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package positive
+
+import (
+	"testing"
+
+	"github.com/coreos/init/tests/coreos-install/boot"
+	"github.com/coreos/init/tests/coreos-install/register"
+	"github.com/coreos/init/tests/coreos-install/util"
+)
+
+// public keys whose private halves were thrown away
+const (
+	firstBootCoreKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAKrDcqO25fnFUgs2sxtH1bm2eTfbrfVQDHjAXgg1dx7 core@coreos-install"
+	firstBootTesterKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIP1JGYc7USJezQkDVleOJ2ZKgTDED57X2F3LclIhxSvX tester@coreos-install"
+)
+
+func init() {
+	register.Register(register.Test{
+		Name: "First Boot - Ignition",
+		Func: firstBootTest("/var/lib/coreos-install-test/ignition", "ignition applied"),
+		IgnitionConfig: util.StringToPtr(`{
+			"ignition": {"version": "2.1.0"},
+			"storage": {
+				"files": [{
+					"filesystem": "root",
+					"path": "/var/lib/coreos-install-test/ignition",
+					"mode": 420,
+					"contents": {"source": "data:,ignition%20applied%0A"}
+				}]
+			},
+			"passwd": {
+				"users": [
+					{"name": "core", "sshAuthorizedKeys": ["` + firstBootCoreKey + `"]},
+					{"name": "tester", "sshAuthorizedKeys": ["` + firstBootTesterKey + `"]}
+				]
+			}
+		}`),
+		UseLocalFile: true,
+		Tags:         []string{register.TagRoot, register.TagBoot, register.TagSlow},
+	})
+	register.Register(register.Test{
+		Name: "First Boot - CloudConfig",
+		Func: firstBootTest("/var/lib/coreos-install-test/cloud-config", "cloud-config applied"),
+		CloudConfig: util.StringToPtr(`#cloud-config
+
+ssh_authorized_keys:
+  - "` + firstBootCoreKey + `"
+users:
+  - name: tester
+    ssh-authorized-keys:
+      - "` + firstBootTesterKey + `"
+write_files:
+  - path: /var/lib/coreos-install-test/cloud-config
+    permissions: "0644"
+    content: |
+      cloud-config applied
+`),
+		UseLocalFile: true,
+		Tags:         []string{register.TagRoot, register.TagBoot, register.TagSlow},
+	})
+}
+
+// firstBootTest boots the installed disk once and checks that the
+// config handed over by coreos-install wrote marker, created the tester
+// user and authorized the SSH keys.
+func firstBootTest(marker, contents string) func(*testing.T, register.Test) {
+	return func(t *testing.T, test register.Test) {
+		bootQEMU(t, test, boot.BIOS, func(m *boot.Machine) {
+			runConsoleChecks(t, m, []consoleCheck{
+				// cloud-config is applied by a unit after login
+				{"systemctl is-system-running --wait", 0, "running"},
+				{"cat " + marker, 0, contents},
+				{"getent passwd tester | cut -d: -f1,6", 0, "tester:/home/tester"},
+				{"grep -cxF '" + firstBootCoreKey + "' /home/core/.ssh/authorized_keys", 0, "1"},
+				{"sudo grep -cxF '" + firstBootTesterKey + "' /home/tester/.ssh/authorized_keys", 0, "1"},
+			})
+		})
+	}
+}
@@ -25,6 +25,7 @@ func init() {
 	register.Register(register.Test{
 		Name: "Base Test",
 		Func: baseTest,
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "Ignition Test",
@@ -33,6 +34,7 @@ func init() {
 			"ignition": {"version": "2.1.0"}
 		}`),
 		UseLocalServer: true,
+		Tags:           []string{register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "CloudConfig Test",
@@ -41,17 +43,20 @@ func init() {
 
 hostname: "coreos1"`),
 		UseLocalServer: true,
+		Tags:           []string{register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name:    "Alpha 1520.0",
 		Func:    baseTest,
 		Channel: util.StringToPtr("alpha"),
 		Version: util.StringToPtr("1520.0.0"),
+		Tags:    []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name:    "Channel Only",
 		Func:    baseTest,
 		Channel: util.StringToPtr("beta"),
+		Tags:    []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name:    "arm64-usr alpha 1367.5.0",
@@ -59,46 +64,55 @@ hostname: "coreos1"`),
 		Channel: util.StringToPtr("alpha"),
 		Version: util.StringToPtr("1367.5.0"),
 		Board:   util.StringToPtr("arm64-usr"),
+		Tags:    []string{register.TagNetwork, register.TagRoot, register.TagArm64},
 	})
 	register.Register(register.Test{
 		Name: "Version Only",
 		Func: pickVersion,
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "OEM - ami",
 		Func: baseTest,
 		OEM:  util.StringToPtr("ami"),
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "OEM - cloudstack",
 		Func: baseTest,
 		OEM:  util.StringToPtr("cloudstack"),
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "OEM - digitalocean",
 		Func: baseTest,
 		OEM:  util.StringToPtr("digitalocean"),
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "OEM - packet",
 		Func: baseTest,
 		OEM:  util.StringToPtr("packet"),
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "OEM - rackspace",
 		Func: baseTest,
 		OEM:  util.StringToPtr("rackspace"),
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name: "OEM - vmware_raw",
 		Func: baseTest,
 		OEM:  util.StringToPtr("vmware_raw"),
+		Tags: []string{register.TagNetwork, register.TagRoot},
 	})
 	register.Register(register.Test{
 		Name:           "Network Units Test",
 		Func:           baseTest,
 		UseLocalServer: true,
 		NetworkUnits:   true,
+		Tags:           []string{register.TagRoot},
 	})
 }
 
@@ -122,7 +136,7 @@ func pickVersion(t *testing.T, test register.Test) {
 	if version, ok := pinnedVersions[channel]; ok {
 		test.Version = util.StringToPtr(version)
 	} else {
-		t.Fatalf("unknown channel %s", channel)
+		t.Skipf("no version is pinned for the %s channel of this host", channel)
 	}
 
 	baseTest(t, test)
@@ -0,0 +1,75 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package positive
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/init/tests/coreos-install/image"
+	"github.com/coreos/init/tests/coreos-install/register"
+	"github.com/coreos/init/tests/coreos-install/util"
+)
+
+func init() {
+	register.Register(register.Test{
+		Name: "Local Image Contents",
+		Func: localImageTest,
+	})
+}
+
+// localImageTest checks that the downloaded image other tests install from
+// contains the release its version.txt describes, without installing it.
+func localImageTest(t *testing.T, test register.Test) {
+	versionPath := filepath.Join(filepath.Dir(test.Ctx.LocalImagePath), "version.txt")
+	versionTxt, err := ioutil.ReadFile(versionPath)
+	if err != nil {
+		t.Fatalf("reading %s: %v", versionPath, err)
+	}
+
+	img, err := image.Open(test.Ctx.LocalImagePath)
+	if err != nil {
+		t.Fatalf("opening %s: %v", test.Ctx.LocalImagePath, err)
+	}
+	defer img.Close()
+
+	for _, name := range []string{"EFI-SYSTEM", "USR-A", "USR-B", "OEM", "ROOT"} {
+		if _, err := img.Partition(name); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	info, err := img.Info()
+	if err != nil {
+		t.Fatalf("reading image release: %v", err)
+	}
+
+	if version := util.RegexpSearch(t, "version", "COREOS_VERSION=(.*)", versionTxt); info.Version != version {
+		t.Fatalf("expected version differs: expected %s, received %s", version, info.Version)
+	}
+
+	// the image was downloaded for the default board
+	_, board, _, err := util.GetDefaultChannelBoardVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Board != board {
+		t.Fatalf("expected board differs: expected %s, received %s", board, info.Board)
+	}
+	if info.OEM != "" {
+		t.Fatalf("generic image has OEM %s", info.OEM)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package positive
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/coreos/init/tests/coreos-install/installer"
+	"github.com/coreos/init/tests/coreos-install/mirror"
+	"github.com/coreos/init/tests/coreos-install/register"
+	"github.com/coreos/init/tests/coreos-install/util"
+)
+
+func init() {
+	register.Register(register.Test{
+		Name:    "Signed Mirror",
+		Func:    mirrorTest,
+		Version: util.StringToPtr(mirror.Current),
+		Tags:    []string{register.TagRoot},
+	})
+}
+
+// mirrorTest builds a mirror of the local image signed with a throwaway
+// key and installs from it the way datacenter installs do.
+func mirrorTest(t *testing.T, test register.Test) {
+	_, board, _, err := util.GetDefaultChannelBoardVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := newMirrorSigner(t)
+	var key bytes.Buffer
+	if err := signer.WritePublicKey(&key); err != nil {
+		t.Fatalf("writing public key: %v", err)
+	}
+	test.KeyFile = util.StringToPtr(test.WriteFile(t, "mirror-signing-key.asc", key.String()))
+
+	dir := filepath.Join(os.TempDir(), "mirror")
+	imageDir := filepath.Dir(test.Ctx.LocalImagePath)
+	version, err := mirror.Add(dir, mirror.Release{
+		Board:      board,
+		VersionTxt: filepath.Join(imageDir, "version.txt"),
+		Images:     []mirror.Image{{Path: test.Ctx.LocalImagePath}},
+	}, signer)
+	if err != nil {
+		t.Fatalf("building mirror: %v", err)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	test.BaseURL = util.StringToPtr(fmt.Sprintf("%s/%s", server.URL, board))
+
+	diskFile, loopDevice := test.CreateDevice(t)
+	defer test.CleanupDisk(t, diskFile, loopDevice)
+
+	opts := test.InstallOptions(t, loopDevice)
+	opts.DryRun = true
+	res, err := installer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	out := []byte(strings.Join(res.Output, "\n"))
+	util.RegexpSearch(t, "base URL", `BASEURL:\s+(`+regexp.QuoteMeta(*test.BaseURL)+`)\n`, out)
+
+	test.RunCoreOSInstall(t, loopDevice)
+
+	rootDir := test.MountPartitions(t, loopDevice)
+	defer test.UnmountPartitions(t, loopDevice)
+
+	// current must have been resolved to the version added
+	test.Version = &version
+	test.DefaultChecks(t, rootDir)
+}
+
+func newMirrorSigner(t *testing.T) *mirror.Signer {
+	entity, err := openpgp.NewEntity("coreos-install tests", "", "", nil)
+	if err != nil {
+		t.Fatalf("creating signing key: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("encoding signing key: %v", err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatalf("serializing signing key: %v", err)
+	}
+	w.Close()
+
+	signer, err := mirror.NewSigner(&buf)
+	if err != nil {
+		t.Fatalf("reading signing key: %v", err)
+	}
+	return signer
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package register
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Tags describe what a test needs or how expensive it is, for choosing
+// which tests run.
+const (
+	// fetches images from the release servers
+	TagNetwork = "network"
+	// creates loop devices and mounts them
+	TagRoot = "root"
+	// takes minutes rather than seconds
+	TagSlow = "slow"
+	// installs an arm64-usr image
+	TagArm64 = "arm64"
+	// installs an image with a btrfs ROOT
+	TagBtrfs = "btrfs"
+	// boots the installed disk
+	TagBoot = "boot"
+)
+
+// KnownTags are all the tags tests may have.
+var KnownTags = []string{TagNetwork, TagRoot, TagSlow, TagArm64, TagBtrfs, TagBoot}
+
+// Capability is something of the host tests may need.
+type Capability string
+
+const (
+	CapRoot           Capability = "root"
+	CapLoop           Capability = "loop devices"
+	CapLoopPartitions Capability = "losetup -P"
+	CapInstallTools   Capability = "install tools"
+	CapNamespaces     Capability = "namespaces"
+	CapBtrfs          Capability = "btrfs"
+	CapNetwork        Capability = "network"
+)
+
+// tagCapabilities are the capabilities the tests with a tag need.
+var tagCapabilities = map[string][]Capability{
+	TagNetwork: {CapNetwork},
+	TagRoot:    {CapRoot, CapLoop, CapLoopPartitions, CapInstallTools},
+	TagBtrfs:   {CapBtrfs},
+}
+
+// installTools are run by coreos-install and the helpers of this package.
+var installTools = []string{"losetup", "mount", "umount", "blkid", "blockdev", "udevadm", "bzip2", "wget", "gpg"}
+
+// releaseURL is fetched to check whether the release servers are reachable.
+const releaseURL = "https://stable.release.core-os.net/amd64-usr/current/version.txt"
+
+// Capabilities are what the host the tests run on can do.
+type Capabilities struct {
+	// missing maps what the host lacks to why
+	missing map[Capability]string
+}
+
+// ProbeCapabilities checks what the host can do.
+func ProbeCapabilities() *Capabilities {
+	c := &Capabilities{missing: map[Capability]string{}}
+
+	if os.Geteuid() != 0 {
+		c.missing[CapRoot] = "not running as root"
+	}
+
+	if _, err := os.Stat("/dev/loop-control"); err != nil {
+		c.missing[CapLoop] = fmt.Sprintf("no loop device support: %v", err)
+	}
+
+	if out, err := exec.Command("losetup", "--help").CombinedOutput(); err != nil {
+		c.missing[CapLoopPartitions] = fmt.Sprintf("running losetup: %v", err)
+	} else if !strings.Contains(string(out), "--partscan") {
+		c.missing[CapLoopPartitions] = "losetup doesn't support -P"
+	}
+
+	var notFound []string
+	for _, tool := range installTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			notFound = append(notFound, tool)
+		}
+	}
+	if len(notFound) > 0 {
+		c.missing[CapInstallTools] = fmt.Sprintf("%s not found", strings.Join(notFound, ", "))
+	}
+
+	if out, err := exec.Command("unshare", "--mount", "--uts", "--ipc", "--net", "--pid", "--fork", "true").CombinedOutput(); err != nil {
+		c.missing[CapNamespaces] = fmt.Sprintf("can't create namespaces: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	if data, err := ioutil.ReadFile("/proc/filesystems"); err != nil {
+		c.missing[CapBtrfs] = fmt.Sprintf("reading /proc/filesystems: %v", err)
+	} else if !regexp.MustCompile(`(?m)\sbtrfs$`).Match(data) {
+		c.missing[CapBtrfs] = "the kernel doesn't support btrfs"
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	if resp, err := client.Head(releaseURL); err != nil {
+		c.missing[CapNetwork] = fmt.Sprintf("can't reach the release servers: %v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			c.missing[CapNetwork] = fmt.Sprintf("can't reach the release servers: %s returned %s", releaseURL, resp.Status)
+		}
+	}
+
+	return c
+}
+
+// Missing returns why the host lacks any of caps, or an empty string if
+// it has them all. Hosts which weren't probed are assumed capable.
+func (c *Capabilities) Missing(caps ...Capability) string {
+	if c == nil {
+		return ""
+	}
+	var reasons []string
+	for _, cap := range caps {
+		if reason, ok := c.missing[cap]; ok {
+			reasons = append(reasons, fmt.Sprintf("needs %s, %s", cap, reason))
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// SkipReason returns why the test shouldn't run: because its tags aren't
+// selected or because the host can't run it. It returns an empty string
+// if the test should run.
+func (test Test) SkipReason() string {
+	if len(test.Ctx.TagsInclude) > 0 && !hasAny(test.Tags, test.Ctx.TagsInclude) {
+		return fmt.Sprintf("has none of the included tags %s", strings.Join(test.Ctx.TagsInclude, ","))
+	}
+	for _, tag := range test.Tags {
+		if hasAny([]string{tag}, test.Ctx.TagsExclude) {
+			return fmt.Sprintf("has the excluded tag %s", tag)
+		}
+	}
+
+	var caps []Capability
+	for _, tag := range test.Tags {
+		caps = append(caps, tagCapabilities[tag]...)
+	}
+	if reason := test.Ctx.Capabilities.Missing(caps...); reason != "" {
+		return reason
+	}
+
+	if test.NetworkUnits && !test.Ctx.NetworkUnit {
+		return "no network unit in /run/systemd/network to copy"
+	}
+	return ""
+}
+
+// ParseTags parses a comma separated list of known tags.
+func ParseTags(list string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !hasAny([]string{tag}, KnownTags) {
+			return nil, fmt.Errorf("unknown tag %q, known tags are %s", tag, strings.Join(KnownTags, ","))
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func hasAny(tags, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if tag == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package register
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags(" root, slow,,")
+	if err != nil {
+		t.Fatalf("parsing tags: %v", err)
+	}
+	if expected := []string{TagRoot, TagSlow}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected %q, received %q", expected, tags)
+	}
+
+	if tags, err := ParseTags(""); err != nil || tags != nil {
+		t.Errorf("parsing no tags: %q, %v", tags, err)
+	}
+	if _, err := ParseTags("root,fast"); err == nil {
+		t.Errorf("unknown tag accepted")
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	noNetwork := &Capabilities{missing: map[Capability]string{CapNetwork: "offline"}}
+
+	for _, tt := range []struct {
+		tags    []string
+		include []string
+		exclude []string
+		caps    *Capabilities
+		skip    string
+	}{
+		{tags: []string{TagRoot}},
+		{tags: []string{TagRoot}, include: []string{TagRoot, TagSlow}},
+		{tags: []string{TagRoot}, include: []string{TagSlow}, skip: "has none of the included tags slow"},
+		{tags: nil, include: []string{TagSlow}, skip: "has none of the included tags slow"},
+		{tags: []string{TagRoot, TagSlow}, exclude: []string{TagSlow}, skip: "has the excluded tag slow"},
+		{tags: []string{TagRoot}, exclude: []string{TagSlow}},
+		{tags: []string{TagNetwork, TagRoot}, caps: noNetwork, skip: "needs network, offline"},
+		{tags: []string{TagRoot}, caps: noNetwork},
+		// unprobed hosts are assumed capable
+		{tags: []string{TagNetwork}},
+	} {
+		test := Test{
+			Tags: tt.tags,
+			Ctx: Context{
+				TagsInclude:  tt.include,
+				TagsExclude:  tt.exclude,
+				Capabilities: tt.caps,
+			},
+		}
+		if skip := test.SkipReason(); skip != tt.skip {
+			t.Errorf("tags %q, include %q, exclude %q: expected %q, received %q", tt.tags, tt.include, tt.exclude, tt.skip, skip)
+		}
+	}
+	test := Test{NetworkUnits: true, Tags: []string{TagRoot}}
+	if skip := test.SkipReason(); skip != "no network unit in /run/systemd/network to copy" {
+		t.Errorf("network units test without a unit: received %q", skip)
+	}
+	test.Ctx.NetworkUnit = true
+	if skip := test.SkipReason(); skip != "" {
+		t.Errorf("network units test with a unit skipped: %q", skip)
+	}
+}
@@ -15,14 +15,20 @@
 package register
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/coreos/init/tests/coreos-install/inspect"
+	"github.com/coreos/init/tests/coreos-install/installer"
+	"github.com/coreos/init/tests/coreos-install/metrics"
 	"github.com/coreos/init/tests/coreos-install/util"
 )
 
@@ -44,7 +50,10 @@ type Test struct {
 	UseLocalFile   bool
 	UseLocalServer bool
 	OEM            *string
+	KeyFile        *string
 	NetworkUnits   bool
+	// Tags say what the test needs, see KnownTags
+	Tags []string
 
 	// used in negative tests to allow them to
 	// provide a regexp to validate the output
@@ -53,15 +62,60 @@ type Test struct {
 
 	// parameters provided by the test runner
 	Ctx Context
+
+	// shared by the copies of the test made while it runs
+	state *testState
+}
+
+// testState is what a running test collects for its failure artifacts.
+type testState struct {
+	mu sync.Mutex
+	// installLog is the output and shell trace of coreos-install runs
+	installLog []string
+	// keepTmpDir is set when the disk image is kept for debugging
+	keepTmpDir bool
 }
 
 type Context struct {
 	BinaryPath     string
 	LocalImagePath string
 	LocalAddress   string
+
+	// boot tests are opt-in as they need systemd-nspawn or QEMU
+	NspawnBoot bool
+	QEMUBoot   bool
+	OVMFPath   string
+
+	// where tests leave logs and other artifacts, none if empty
+	ArtifactDir string
+	// keep the disk images of failed tests
+	KeepDisk bool
+
+	// BytesServed returns how much the local server has sent so far, nil
+	// if there is none
+	BytesServed func() int64
+	// installs slower than these fail the test
+	Thresholds metrics.Thresholds
+
+	// only tests with any of TagsInclude, if given, and none of
+	// TagsExclude run
+	TagsInclude []string
+	TagsExclude []string
+	// tests the host can't run are skipped, nil runs them all
+	Capabilities *Capabilities
+	// /run/systemd/network has a unit for the tests of NetworkUnits
+	NetworkUnit bool
+
+	// Installed is called with the result of every successful install of
+	// a test, if set
+	Installed func(name string, res *installer.Result)
 }
 
 func (test Test) Run(t *testing.T) {
+	if reason := test.SkipReason(); reason != "" {
+		t.Skip(reason)
+	}
+
 	originalTmpDir := os.Getenv("TMPDIR")
 	defer os.Setenv("TMPDIR", originalTmpDir)
 
@@ -76,7 +130,14 @@ func (test Test) Run(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to create temp working dir in %s: %v", os.TempDir(), err)
 	}
-	defer test.RemoveAll(t, tmpDir)
+	test.state = &testState{}
+	defer func() {
+		if test.state.keepTmpDir {
+			t.Logf("kept %s", tmpDir)
+			return
+		}
+		test.RemoveAll(t, tmpDir)
+	}()
 
 	err = os.Setenv("TMPDIR", tmpDir)
 	if err != nil {
@@ -86,7 +147,7 @@ func (test Test) Run(t *testing.T) {
 	test.Func(t, test)
 }
 
-func (test Test) CreateDevice(t *testing.T) (string, string) {
+func (test Test) CreateDevice(t testing.TB) (string, string) {
 	diskFile, err := os.Create(filepath.Join(os.TempDir(), "coreos-install-disk"))
 	if err != nil {
 		t.Fatalf("failed to create disk file: %v", err)
@@ -108,7 +169,14 @@ func (test Test) CreateDevice(t *testing.T) (string, string) {
 	return diskFile.Name(), strings.TrimSpace(device)
 }
 
-func (test Test) CleanupDisk(t *testing.T, diskFile, loopDevice string) {
+func (test Test) CleanupDisk(t testing.TB, diskFile, loopDevice string) {
+	if t.Failed() {
+		test.SaveFailureArtifacts(t, loopDevice)
+		if test.Ctx.KeepDisk && test.state != nil {
+			test.state.keepTmpDir = true
+			t.Logf("kept disk image, reattach it with: losetup -P -f --show %s", diskFile)
+		}
+	}
 	util.MustRun(t, "losetup", "-d", loopDevice)
 }
 
@@ -134,71 +202,290 @@ func (test Test) UnmountPartitions(t *testing.T, loopDevice string) {
 	util.MustRun(t, "umount", fmt.Sprintf("%sp9", loopDevice))
 }
 
-func (test Test) GetInstallOptions(t *testing.T, loopDevice string, opts ...string) []string {
-	opts = append(opts, "-d", loopDevice)
+// InstallOptions returns the coreos-install options for the test.
+func (test Test) InstallOptions(t *testing.T, loopDevice string, opts ...string) installer.Options {
+	options := installer.Options{
+		BinaryPath:   test.Ctx.BinaryPath,
+		Device:       loopDevice,
+		NetworkUnits: test.NetworkUnits,
+		ExtraArgs:    opts,
+	}
 
 	if test.UseLocalServer {
-		opts = append(opts, "-b", test.Ctx.LocalAddress)
+		options.BaseURL = test.Ctx.LocalAddress
 	}
 
 	if test.UseLocalFile {
 		if test.Ctx.LocalImagePath == "" {
 			t.Fatalf("test specifies using local file which doesn't exist")
 		}
-		opts = append(opts, "-f", test.Ctx.LocalImagePath)
+		options.ImageFile = test.Ctx.LocalImagePath
 	}
 
 	if test.Version != nil {
-		opts = append(opts, "-V", *test.Version)
+		options.Version = *test.Version
 	}
 
 	if test.BaseURL != nil {
-		opts = append(opts, "-b", *test.BaseURL)
+		options.BaseURL = *test.BaseURL
 	}
 
 	if test.Channel != nil {
-		opts = append(opts, "-C", *test.Channel)
+		options.Channel = *test.Channel
 	}
 
 	if test.Board != nil {
-		opts = append(opts, "-B", *test.Board)
+		options.Board = *test.Board
 	}
 
 	if test.OEM != nil {
-		opts = append(opts, "-o", *test.OEM)
+		options.OEM = *test.OEM
 	}
 
-	if test.NetworkUnits {
-		opts = append(opts, "-n")
+	if test.KeyFile != nil {
+		options.KeyFile = *test.KeyFile
 	}
 
 	if test.IgnitionConfig != nil {
-		ignitionPath := test.WriteFile(t, "coreos-ignition-file", *test.IgnitionConfig)
-		opts = append(opts, "-i", ignitionPath)
+		options.IgnitionConfig = test.WriteFile(t, "coreos-ignition-file", *test.IgnitionConfig)
 	}
 
 	if test.CloudConfig != nil {
-		cloudinitPath := test.WriteFile(t, "coreos-cloudconfig-file", *test.CloudConfig)
-		opts = append(opts, "-c", cloudinitPath)
+		options.CloudConfig = test.WriteFile(t, "coreos-cloudconfig-file", *test.CloudConfig)
+	}
+
+	return options
+}
+
+func (test Test) GetInstallOptions(t *testing.T, loopDevice string, opts ...string) []string {
+	args, err := test.InstallOptions(t, loopDevice, opts...).Args()
+	if err != nil {
+		t.Fatalf("invalid install options: %v", err)
+	}
+	return args
+}
+
+func (test Test) RunCoreOSInstall(t *testing.T, loopDevice string, opts ...string) *installer.Result {
+	options := test.InstallOptions(t, loopDevice, opts...)
+	args, err := options.Args()
+	if err != nil {
+		t.Fatalf("invalid install options: %v", err)
+	}
+
+	t.Logf("running: %s %s", test.Ctx.BinaryPath, strings.Join(args, " "))
+
+	recorder := metrics.NewRecorder()
+	options.Output = recorder.Line
+	test.logInstall(&options)
+	writtenBefore, servedBefore := test.bytesWritten(t, loopDevice), test.bytesServed()
+
+	res, err := installer.Run(context.Background(), options)
+	if err != nil {
+		if installErr, ok := err.(*installer.Error); ok {
+			t.Log(strings.Join(installErr.Output, "\n"))
+		}
+		t.Fatalf("%s %s failed: %v", test.Ctx.BinaryPath, strings.Join(args, " "), err)
+	}
+	if res.Device != loopDevice {
+		t.Fatalf("coreos-install reported installing to %s instead of %s", res.Device, loopDevice)
 	}
 
-	return opts
+	if test.Ctx.Installed != nil {
+		test.Ctx.Installed(t.Name(), res)
+	}
+
+	m := recorder.Finish(test.bytesWritten(t, loopDevice)-writtenBefore, test.bytesServed()-servedBefore)
+	m.Test = t.Name()
+	m.Device = loopDevice
+	test.RecordMetrics(t, m)
+	return res
 }
 
-func (test Test) RunCoreOSInstall(t *testing.T, loopDevice string, opts ...string) {
-	options := test.GetInstallOptions(t, loopDevice, opts...)
+// RecordMetrics logs the timing of an install, saves it as metrics.json
+// and fails the test if the install was slower than the thresholds.
+func (test Test) RecordMetrics(t *testing.T, m *metrics.Metrics) {
+	var phases []string
+	for _, phase := range m.Phases {
+		phases = append(phases, fmt.Sprintf("%s %.1fs", phase.Name, phase.Seconds))
+	}
+	t.Logf("installed in %.1fs (%s), wrote %.1f MB/s, downloaded %.1f MB/s",
+		m.WallSeconds, strings.Join(phases, ", "), m.WriteMBps, m.DownloadMBps)
 
-	t.Logf("running: %s %s", test.Ctx.BinaryPath, strings.Join(options, " "))
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatalf("encoding metrics: %v", err)
+	}
+	test.WriteArtifact(t, "metrics.json", append(data, '\n'))
 
-	util.MustRun(t, test.Ctx.BinaryPath, options...)
+	if err := test.Ctx.Thresholds.Check(m); err != nil {
+		t.Error(err)
+	}
+}
+
+// bytesWritten returns how much has been written to the device, or zero
+// if that isn't known.
+func (test Test) bytesWritten(t *testing.T, device string) int64 {
+	written, err := metrics.BytesWritten(device)
+	if err != nil {
+		t.Logf("not measuring bytes written: %v", err)
+	}
+	return written
+}
+
+func (test Test) bytesServed() int64 {
+	if test.Ctx.BytesServed == nil {
+		return 0
+	}
+	return test.Ctx.BytesServed()
 }
 
 func (test Test) RunCoreOSInstallNegative(t *testing.T, loopDevice string, opts ...string) ([]byte, error) {
-	options := test.GetInstallOptions(t, loopDevice, opts...)
+	options := test.InstallOptions(t, loopDevice, opts...)
+	args, err := options.Args()
+	if err != nil {
+		t.Fatalf("invalid install options: %v", err)
+	}
+	test.logInstall(&options)
 
-	t.Logf("running: %s %s", test.Ctx.BinaryPath, strings.Join(options, " "))
+	t.Logf("running: %s %s", test.Ctx.BinaryPath, strings.Join(args, " "))
 
-	return exec.Command(test.Ctx.BinaryPath, options...).CombinedOutput()
+	res, err := installer.Run(context.Background(), options)
+	if err != nil {
+		if installErr, ok := err.(*installer.Error); ok {
+			return []byte(strings.Join(installErr.Output, "\n")), err
+		}
+		return nil, err
+	}
+	return []byte(strings.Join(res.Output, "\n")), nil
+}
+
+// logInstall keeps the output and shell trace of an install for the
+// failure artifacts.
+func (test Test) logInstall(options *installer.Options) {
+	if test.Ctx.ArtifactDir == "" || test.state == nil {
+		return
+	}
+
+	state := test.state
+	log := func(line string) {
+		state.mu.Lock()
+		state.installLog = append(state.installLog, line)
+		state.mu.Unlock()
+	}
+	output := options.Output
+	options.Output = func(line string) {
+		log(line)
+		if output != nil {
+			output(line)
+		}
+	}
+	options.Trace = log
+	options.Verbose = true
+
+	args, _ := options.Args()
+	log(fmt.Sprintf("$ %s %s", options.BinaryPath, strings.Join(args, " ")))
+}
+
+// SaveFailureArtifacts saves what is needed to debug a failed test: the
+// coreos-install output and trace, the state of the disk and the files
+// installed.
+func (test Test) SaveFailureArtifacts(t testing.TB, loopDevice string) {
+	if test.Ctx.ArtifactDir == "" {
+		return
+	}
+
+	if test.state != nil {
+		test.state.mu.Lock()
+		log := strings.Join(test.state.installLog, "\n")
+		test.state.mu.Unlock()
+		if log != "" {
+			test.WriteArtifact(t, "coreos-install.log", []byte(log+"\n"))
+		}
+	}
+
+	partitions, _ := filepath.Glob(loopDevice + "p*")
+	commands := []struct {
+		name    string
+		command string
+		args    []string
+	}{
+		{"sgdisk.txt", "sgdisk", []string{"-p", loopDevice}},
+		{"blkid.txt", "blkid", append([]string{loopDevice}, partitions...)},
+		{"lsblk.json", "lsblk", []string{"-J", "-o", "NAME,SIZE,TYPE,FSTYPE,LABEL,PARTLABEL,UUID,MOUNTPOINT", loopDevice}},
+	}
+	for _, c := range commands {
+		test.WriteArtifact(t, c.name, commandOutput(c.command, c.args...))
+	}
+
+	dmesg := strings.Split(strings.TrimRight(string(commandOutput("dmesg")), "\n"), "\n")
+	if len(dmesg) > dmesgLines {
+		dmesg = dmesg[len(dmesg)-dmesgLines:]
+	}
+	test.WriteArtifact(t, "dmesg.txt", []byte(strings.Join(dmesg, "\n")+"\n"))
+
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		mountinfo = []byte(err.Error() + "\n")
+	}
+	test.WriteArtifact(t, "mountinfo.txt", mountinfo)
+
+	test.saveFileListings(t, loopDevice)
+}
+
+// dmesgLines is how much of the kernel log is saved for failed tests.
+const dmesgLines = 200
+
+// saveFileListings saves listings of the ROOT and OEM partitions, if
+// they can be mounted.
+func (test Test) saveFileListings(t testing.TB, loopDevice string) {
+	var listing []byte
+	defer func() {
+		test.WriteArtifact(t, "files.txt", listing)
+	}()
+
+	table, err := inspect.ReadPartitionTable(loopDevice)
+	if err != nil {
+		listing = []byte(err.Error() + "\n")
+		return
+	}
+	dir, err := ioutil.TempDir("", "failure-mount")
+	if err != nil {
+		listing = []byte(err.Error() + "\n")
+		return
+	}
+	defer os.Remove(dir)
+
+	unmount, err := inspect.Mount(table, dir)
+	if err != nil {
+		listing = []byte(err.Error() + "\n")
+		return
+	}
+	defer func() {
+		if err := unmount(); err != nil {
+			t.Errorf("unmounting %s: %v", dir, err)
+		}
+	}()
+
+	for _, partition := range []struct {
+		label string
+		path  string
+	}{
+		{"ROOT", dir},
+		{"OEM", filepath.Join(dir, "usr", "share", "oem")},
+	} {
+		listing = append(listing, fmt.Sprintf("%s:\n", partition.label)...)
+		listing = append(listing, commandOutput("find", partition.path, "-xdev", "-printf", "%M %10s %P\n")...)
+	}
+}
+
+// commandOutput runs a command for failure artifacts, which include any
+// error rather than failing the test again.
+func commandOutput(command string, args ...string) []byte {
+	out, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		out = append(out, fmt.Sprintf("%s %s: %v\n", command, strings.Join(args, " "), err)...)
+	}
+	return out
 }
 
 func (test Test) RemoveAll(t *testing.T, path string) {
@@ -223,6 +510,46 @@ func (test Test) WriteFile(t *testing.T, name, data string) string {
 	return tmpFile.Name()
 }
 
+// WriteArtifact saves data as name in the artifact directory of the
+// running test, if artifacts were requested.
+func (test Test) WriteArtifact(t testing.TB, name string, data []byte) {
+	dir := test.Ctx.TestArtifactDir(t.Name())
+	if dir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Errorf("creating artifact dir %s: %v", dir, err)
+		return
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Errorf("writing artifact %s: %v", path, err)
+		return
+	}
+	t.Logf("saved %s", path)
+}
+
+// TestArtifactDir is where the test with the given full name saves its
+// artifacts, empty if artifacts weren't requested.
+func (ctx Context) TestArtifactDir(name string) string {
+	if ctx.ArtifactDir == "" {
+		return ""
+	}
+	return filepath.Join(ctx.ArtifactDir, artifactName(name))
+}
+
+// artifactName turns a test name into a single directory name
+func artifactName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
 func (test Test) ValidateIgnition(t *testing.T, rootDir, config string) {
 	oemPath := filepath.Join(rootDir, "usr", "share", "oem")
 
@@ -0,0 +1,101 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// headerRegexp matches the lines go test starts the output of a test with,
+// both when streaming it with -v and when printing it after the test.
+var headerRegexp = regexp.MustCompile(`^\s*(?:=== (?:RUN|CONT|PAUSE|NAME)|--- (?:PASS|FAIL|SKIP):)\s+(\S+)`)
+
+// Output keeps what go test prints for each test, as the testing package
+// doesn't give access to why a test failed.
+type Output struct {
+	mu    sync.Mutex
+	lines map[string][]string
+	test  string
+
+	stdout *os.File
+	pipe   *os.File
+	done   chan struct{}
+}
+
+// CaptureOutput passes os.Stdout through a pipe, keeping the log lines
+// of each test. It must be called before the tests run.
+func CaptureOutput() (*Output, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	o := newOutput()
+	o.stdout = os.Stdout
+	o.pipe = w
+	os.Stdout = w
+	go func() {
+		defer close(o.done)
+		o.read(io.TeeReader(r, o.stdout))
+		r.Close()
+	}()
+	return o, nil
+}
+
+func newOutput() *Output {
+	return &Output{
+		lines: map[string][]string{},
+		done:  make(chan struct{}),
+	}
+}
+
+// read attributes every indented line to the test whose header came last.
+func (o *Output) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		o.mu.Lock()
+		if match := headerRegexp.FindStringSubmatch(line); match != nil {
+			o.test = match[1]
+		} else if o.test != "" && strings.HasPrefix(line, "    ") {
+			o.lines[o.test] = append(o.lines[o.test], strings.TrimSpace(line))
+		}
+		o.mu.Unlock()
+	}
+	// keep passing output on after an overlong line
+	io.Copy(ioutil.Discard, r)
+}
+
+// Close restores os.Stdout once everything written has been read.
+func (o *Output) Close() error {
+	os.Stdout = o.stdout
+	err := o.pipe.Close()
+	<-o.done
+	return err
+}
+
+// Lines returns what was logged by a test, given by its full name.
+func (o *Output) Lines(test string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.lines[test]...)
+}
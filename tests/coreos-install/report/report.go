@@ -0,0 +1,207 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package report writes the results of the install suite as JUnit XML
+// and as a JSON summary for dashboards.
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Status is the outcome of a test.
+type Status string
+
+const (
+	Passed  Status = "passed"
+	Failed  Status = "failed"
+	Skipped Status = "skipped"
+)
+
+// Config is what a test installs, empty fields meaning the defaults of
+// coreos-install.
+type Config struct {
+	Channel string `json:"channel,omitempty"`
+	Board   string `json:"board,omitempty"`
+	Version string `json:"version,omitempty"`
+	OEM     string `json:"oem,omitempty"`
+	// Source is "local file", "local server" or "remote"
+	Source string `json:"source"`
+}
+
+// Result is the result of a single test.
+type Result struct {
+	Name    string  `json:"name"`
+	Config  Config  `json:"config"`
+	Status  Status  `json:"status"`
+	Seconds float64 `json:"seconds"`
+	// Failure is the last line the test logged, usually why it failed
+	Failure string `json:"failure,omitempty"`
+	// Log is everything the test logged, if it failed
+	Log []string `json:"log,omitempty"`
+	// Artifacts are the paths of the files the test saved
+	Artifacts []string `json:"artifacts,omitempty"`
+}
+
+// Summary is the JSON report of a run.
+type Summary struct {
+	Tests   int      `json:"tests"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Skipped int      `json:"skipped"`
+	Seconds float64  `json:"seconds"`
+	Results []Result `json:"results"`
+}
+
+// Summarize counts the results of a run.
+func Summarize(results []Result) Summary {
+	summary := Summary{Tests: len(results), Results: results}
+	if summary.Results == nil {
+		summary.Results = []Result{}
+	}
+	for _, result := range results {
+		switch result.Status {
+		case Passed:
+			summary.Passed++
+		case Failed:
+			summary.Failed++
+		case Skipped:
+			summary.Skipped++
+		}
+		summary.Seconds += result.Seconds
+	}
+	return summary
+}
+
+// WriteJSON writes the summary of a run.
+func WriteJSON(w io.Writer, results []Result) error {
+	data, err := json.MarshalIndent(Summarize(results), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name       string           `xml:"name,attr"`
+	Classname  string           `xml:"classname,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties,omitempty"`
+	Failure    *junitFailure    `xml:"failure,omitempty"`
+	Skipped    *struct{}        `xml:"skipped,omitempty"`
+	SystemOut  string           `xml:"system-out,omitempty"`
+}
+
+type junitProperties struct {
+	Properties []junitProperty `xml:"property"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the results of a run as a JUnit test suite. The
+// configuration of a test is given as properties and its artifacts as
+// attachments in the format of the Jenkins JUnit attachments plugin.
+func WriteJUnit(w io.Writer, suite string, results []Result) error {
+	summary := Summarize(results)
+	s := junitSuite{
+		Name:     suite,
+		Tests:    summary.Tests,
+		Failures: summary.Failed,
+		Skipped:  summary.Skipped,
+		Time:     seconds(summary.Seconds),
+	}
+
+	for _, result := range results {
+		c := junitCase{
+			Name:      result.Name,
+			Classname: suite,
+			Time:      seconds(result.Seconds),
+		}
+		for _, p := range []junitProperty{
+			{"channel", result.Config.Channel},
+			{"board", result.Config.Board},
+			{"version", result.Config.Version},
+			{"oem", result.Config.OEM},
+			{"source", result.Config.Source},
+		} {
+			if p.Value == "" {
+				continue
+			}
+			if c.Properties == nil {
+				c.Properties = &junitProperties{}
+			}
+			c.Properties.Properties = append(c.Properties.Properties, p)
+		}
+
+		switch result.Status {
+		case Failed:
+			c.Failure = &junitFailure{
+				Message: result.Failure,
+				Body:    strings.Join(result.Log, "\n"),
+			}
+		case Skipped:
+			c.Skipped = &struct{}{}
+		}
+
+		var out []string
+		for _, artifact := range result.Artifacts {
+			out = append(out, fmt.Sprintf("[[ATTACHMENT|%s]]", artifact))
+		}
+		c.SystemOut = strings.Join(out, "\n")
+
+		s.Cases = append(s.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitSuites{Suites: []junitSuite{s}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(s float64) string {
+	return fmt.Sprintf("%.3f", s)
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var results = []Result{
+	{
+		Name:    "TestCoreosInstall/Base_Test",
+		Config:  Config{Source: "remote"},
+		Status:  Passed,
+		Seconds: 61.5,
+	},
+	{
+		Name:      "TestCoreosInstall/OEM_-_packet",
+		Config:    Config{Channel: "stable", OEM: "packet", Source: "remote"},
+		Status:    Failed,
+		Seconds:   12,
+		Failure:   "register.go:263: coreos-install failed (download failed): 8: Download of coreos_production_packet_image.bin.bz2 did not complete",
+		Log:       []string{"register.go:251: running: coreos-install -d /dev/loop0 -o packet", "register.go:263: coreos-install failed (download failed): 8: Download of coreos_production_packet_image.bin.bz2 did not complete"},
+		Artifacts: []string{"/tmp/artifacts/TestCoreosInstall_OEM_-_packet/coreos-install.log"},
+	},
+	{
+		Name:   "TestCoreosInstall/QEMU_Boot",
+		Config: Config{Source: "local file"},
+		Status: Skipped,
+	},
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, results); err != nil {
+		t.Fatalf("writing JSON: %v", err)
+	}
+
+	var summary Summary
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatalf("parsing JSON: %v", err)
+	}
+	if summary.Tests != 3 || summary.Passed != 1 || summary.Failed != 1 || summary.Skipped != 1 || summary.Seconds != 73.5 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if !reflect.DeepEqual(summary.Results, results) {
+		t.Errorf("results changed: expected %+v, received %+v", results, summary.Results)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, "coreos-install", results); err != nil {
+		t.Fatalf("writing JUnit: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), xml.Header) {
+		t.Errorf("no XML header")
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("parsing XML: %v", err)
+	}
+	if len(suites.Suites) != 1 {
+		t.Fatalf("%d test suites written", len(suites.Suites))
+	}
+	suite := suites.Suites[0]
+	if suite.Name != "coreos-install" || suite.Tests != 3 || suite.Failures != 1 || suite.Skipped != 1 || suite.Time != "73.500" {
+		t.Errorf("unexpected suite: %+v", suite)
+	}
+
+	passed, failed, skipped := suite.Cases[0], suite.Cases[1], suite.Cases[2]
+	if passed.Failure != nil || passed.Skipped != nil || passed.Time != "61.500" {
+		t.Errorf("unexpected passed test: %+v", passed)
+	}
+	if skipped.Skipped == nil {
+		t.Errorf("skipped test not marked skipped: %+v", skipped)
+	}
+
+	if failed.Failure == nil || failed.Failure.Message != results[1].Failure ||
+		failed.Failure.Body != strings.Join(results[1].Log, "\n") {
+		t.Errorf("unexpected failure: %+v", failed.Failure)
+	}
+	expectedProperties := []junitProperty{{"channel", "stable"}, {"oem", "packet"}, {"source", "remote"}}
+	if failed.Properties == nil || !reflect.DeepEqual(failed.Properties.Properties, expectedProperties) {
+		t.Errorf("unexpected properties: expected %+v, received %+v", expectedProperties, failed.Properties)
+	}
+	if failed.SystemOut != "[[ATTACHMENT|/tmp/artifacts/TestCoreosInstall_OEM_-_packet/coreos-install.log]]" {
+		t.Errorf("unexpected attachments: %q", failed.SystemOut)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	// printed after the tests, as go test does without -v
+	afterwards := `--- FAIL: TestCoreosInstall (75.01s)
+    --- PASS: TestCoreosInstall/Base_Test (61.50s)
+    --- FAIL: TestCoreosInstall/OEM_-_packet (12.00s)
+        register.go:251: running: coreos-install -d /dev/loop0 -o packet
+        register.go:263: coreos-install failed: exit status 1
+            with a second line
+    --- SKIP: TestCoreosInstall/QEMU_Boot (0.00s)
+        boot.go:40: QEMU boot tests not requested
+FAIL
+`
+	// streamed while the tests run, as newer versions of go test do with -v
+	streamed := `=== RUN   TestCoreosInstall
+=== RUN   TestCoreosInstall/Base_Test
+--- PASS: TestCoreosInstall/Base_Test (61.50s)
+=== RUN   TestCoreosInstall/OEM_-_packet
+    register.go:251: running: coreos-install -d /dev/loop0 -o packet
+    register.go:263: coreos-install failed: exit status 1
+        with a second line
+--- FAIL: TestCoreosInstall/OEM_-_packet (12.00s)
+=== RUN   TestCoreosInstall/QEMU_Boot
+    boot.go:40: QEMU boot tests not requested
+--- SKIP: TestCoreosInstall/QEMU_Boot (0.00s)
+--- FAIL: TestCoreosInstall (75.01s)
+FAIL
+`
+
+	for _, output := range []string{afterwards, streamed} {
+		o := newOutput()
+		o.read(strings.NewReader(output))
+
+		expected := []string{
+			"register.go:251: running: coreos-install -d /dev/loop0 -o packet",
+			"register.go:263: coreos-install failed: exit status 1",
+			"with a second line",
+		}
+		if lines := o.Lines("TestCoreosInstall/OEM_-_packet"); !reflect.DeepEqual(lines, expected) {
+			t.Errorf("unexpected lines: expected %q, received %q", expected, lines)
+		}
+		if lines := o.Lines("TestCoreosInstall/Base_Test"); len(lines) != 0 {
+			t.Errorf("passed test logged %q", lines)
+		}
+		if lines := o.Lines("TestCoreosInstall/QEMU_Boot"); len(lines) != 1 {
+			t.Errorf("skipped test logged %q", lines)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/init/tests/coreos-install/installer"
+	"github.com/coreos/init/tests/coreos-install/register"
+	"github.com/coreos/init/tests/coreos-install/report"
+	"github.com/coreos/init/tests/coreos-install/util"
+)
+
+// results of the registered tests, in the order they ran
+var results []report.Result
+
+// recordResult records the result of a registered test when it finishes.
+func recordResult(t *testing.T, test register.Test, start time.Time) {
+	result := report.Result{
+		Name:    t.Name(),
+		Config:  testConfig(t.Name(), test),
+		Status:  report.Passed,
+		Seconds: time.Since(start).Seconds(),
+	}
+	if t.Failed() {
+		result.Status = report.Failed
+	} else if t.Skipped() {
+		result.Status = report.Skipped
+	}
+
+	if dir := test.Ctx.TestArtifactDir(t.Name()); dir != "" {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				result.Artifacts = append(result.Artifacts, path)
+			}
+			return nil
+		})
+	}
+
+	results = append(results, result)
+}
+
+// recordSetupFailure records a failure of the suite itself, so reports
+// of runs which didn't get to any test aren't empty.
+func recordSetupFailure(t *testing.T, start time.Time) {
+	if len(results) == 0 && t.Failed() {
+		results = append(results, report.Result{
+			Name:    t.Name(),
+			Status:  report.Failed,
+			Seconds: time.Since(start).Seconds(),
+		})
+	}
+}
+
+// installed holds what the last install of each test reported installing
+var installed = struct {
+	sync.Mutex
+	summaries map[string]string
+}{summaries: map[string]string{}}
+
+func recordInstall(name string, res *installer.Result) {
+	installed.Lock()
+	installed.summaries[name] = res.Summary
+	installed.Unlock()
+}
+
+// summaryRegexp matches the channel and version of an install summary, which
+// installs from a local file don't have.
+var summaryRegexp = regexp.MustCompile(`^CoreOS Container Linux ([a-z]+) ([0-9.]+)(?: \(\S+\))?$`)
+
+// testConfig returns what a test installed: what coreos-install reported,
+// or else what the test asked for, or else the defaults of coreos-install.
+func testConfig(name string, test register.Test) report.Config {
+	config := report.Config{Source: "remote"}
+	if test.UseLocalFile {
+		config.Source = "local file"
+	} else if test.UseLocalServer {
+		config.Source = "local server"
+	}
+
+	channel, board, version, err := util.GetDefaultChannelBoardVersion()
+	if err == nil {
+		config.Channel, config.Board, config.Version = channel, board, version
+	}
+
+	for _, field := range []struct {
+		value *string
+		dest  *string
+	}{
+		{test.Channel, &config.Channel},
+		{test.Board, &config.Board},
+		{test.Version, &config.Version},
+		{test.OEM, &config.OEM},
+	} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+
+	installed.Lock()
+	summary := installed.summaries[name]
+	installed.Unlock()
+	if match := summaryRegexp.FindStringSubmatch(summary); match != nil {
+		config.Channel, config.Version = match[1], match[2]
+	}
+	return config
+}
+
+// bookkeepingRegexp matches what register logs while saving artifacts
+// after a test failed.
+var bookkeepingRegexp = regexp.MustCompile(`^\S+\.go:\d+: (saved|kept) `)
+
+// failureLine guesses why a test failed: the last line it logged before
+// the artifacts were saved.
+func failureLine(log []string) string {
+	for i := len(log) - 1; i >= 0; i-- {
+		if !bookkeepingRegexp.MatchString(log[i]) {
+			return log[i]
+		}
+	}
+	return ""
+}
+
+// writeReports adds what failed tests logged to their results and writes
+// the reports requested.
+func writeReports(output *report.Output) error {
+	for i, result := range results {
+		if result.Status != report.Failed {
+			continue
+		}
+		results[i].Log = output.Lines(result.Name)
+		results[i].Failure = failureLine(results[i].Log)
+	}
+
+	reports := []struct {
+		path  string
+		write func(io.Writer) error
+	}{
+		{flagJUnit, func(w io.Writer) error { return report.WriteJUnit(w, "coreos-install", results) }},
+		{flagJSONReport, func(w io.Writer) error { return report.WriteJSON(w, results) }},
+	}
+	for _, r := range reports {
+		if r.path == "" {
+			continue
+		}
+		file, err := os.Create(r.path)
+		if err != nil {
+			return err
+		}
+		if err := r.write(file); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
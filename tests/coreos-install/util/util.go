@@ -25,7 +25,9 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TryRegexpSearch(name, pattern string, data []byte) (string, error) {
@@ -37,7 +39,7 @@ func TryRegexpSearch(name, pattern string, data []byte) (string, error) {
 	return string(match[1]), nil
 }
 
-func RegexpSearch(t *testing.T, itemName, pattern string, data []byte) string {
+func RegexpSearch(t testing.TB, itemName, pattern string, data []byte) string {
 	result, err := TryRegexpSearch(itemName, pattern, data)
 	if err != nil {
 		t.Fatal(err)
@@ -64,7 +66,7 @@ func RegexpSearchAll(t *testing.T, itemName, pattern string, data []byte) (ret [
 	return
 }
 
-func MustRun(t *testing.T, command string, opts ...string) []byte {
+func MustRun(t testing.TB, command string, opts ...string) []byte {
 	out, err := exec.Command(command, opts...).CombinedOutput()
 	if err != nil {
 		t.Log(string(out))
@@ -82,7 +84,7 @@ func StringToPtr(str string) *string {
 	return &str
 }
 
-func FetchLocalImage(t *testing.T) string {
+func FetchLocalImage(t testing.TB) string {
 	tmpPath := os.Getenv("TMPDIR")
 	if tmpPath == "" {
 		tmpPath = "/var/tmp"
@@ -217,7 +219,60 @@ Architecture=coreos-install`)
 }
 
 type HTTPServer struct {
+	// first to be 64-bit aligned for atomic operations
+	served  int64
 	FileDir string
+	// Limit is the bandwidth of each response in bytes per second, no
+	// limit if zero
+	Limit int64
+}
+
+// BytesServed returns the size of all responses sent so far.
+func (server *HTTPServer) BytesServed() int64 {
+	return atomic.LoadInt64(&server.served)
+}
+
+// countingWriter adds the size of a response to the served bytes of a
+// server.
+type countingWriter struct {
+	http.ResponseWriter
+	served *int64
+}
+
+func (w countingWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	atomic.AddInt64(w.served, int64(n))
+	return n, err
+}
+
+// limitedWriter slows a response down to limit bytes per second.
+type limitedWriter struct {
+	http.ResponseWriter
+	limit   int64
+	start   time.Time
+	written int64
+}
+
+func (w *limitedWriter) Write(data []byte) (int, error) {
+	var total int
+	for len(data) > 0 {
+		// small chunks keep the rate steady
+		chunk := data
+		if len(chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		total += n
+		w.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		data = data[n:]
+
+		due := w.start.Add(time.Duration(w.written * int64(time.Second) / w.limit))
+		time.Sleep(time.Until(due))
+	}
+	return total, nil
 }
 
 func (server *HTTPServer) Version(w http.ResponseWriter, r *http.Request) {
@@ -232,8 +287,9 @@ func (server *HTTPServer) Signature(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, filepath.Join(server.FileDir, "coreos_production_image.bin.bz2.sig"))
 }
 
-func (server *HTTPServer) Start(t *testing.T) string {
-	http.HandleFunc("/current/version.txt", server.Version)
+func (server *HTTPServer) Start(t testing.TB) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/current/version.txt", server.Version)
 
 	data, err := ioutil.ReadFile(filepath.Join(server.FileDir, "version.txt"))
 	if err != nil {
@@ -241,15 +297,21 @@ func (server *HTTPServer) Start(t *testing.T) string {
 	}
 	version := RegexpSearch(t, "version", "COREOS_VERSION=(.*)", data)
 
-	http.HandleFunc(fmt.Sprintf("/%s/coreos_production_image.bin.bz2", version), server.Image)
-	http.HandleFunc(fmt.Sprintf("/%s/coreos_production_image.bin.bz2.sig", version), server.Signature)
+	mux.HandleFunc(fmt.Sprintf("/%s/coreos_production_image.bin.bz2", version), server.Image)
+	mux.HandleFunc(fmt.Sprintf("/%s/coreos_production_image.bin.bz2.sig", version), server.Signature)
 
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatalf("creating listener: %v", err)
 	}
 
-	go http.Serve(listener, nil)
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = countingWriter{w, &server.served}
+		if server.Limit > 0 {
+			w = &limitedWriter{ResponseWriter: w, limit: server.Limit, start: time.Now()}
+		}
+		mux.ServeHTTP(w, r)
+	}))
 
 	return listener.Addr().String()
 }
@@ -0,0 +1,280 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sandbox runs the scripts in this repository against a private
+// view of the host filesystem. Commands run chrooted in an overlay of /
+// inside their own mount namespace, so files can be added, replaced or
+// removed anywhere without touching the host.
+package sandbox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// DefaultPath is the PATH commands run with. Stubs are installed into
+// /usr/local/bin so they take precedence over the real binaries.
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// the wrapper runs in the new mount namespace, before the chroot
+const wrapper = `set -e
+mount -t overlay overlay -o "lowerdir=/,upperdir=$SANDBOX_UPPER,workdir=$SANDBOX_WORK" "$SANDBOX_ROOT"
+mount --rbind /dev "$SANDBOX_ROOT/dev"
+for bind in $SANDBOX_BINDS; do
+	mkdir -p "$SANDBOX_ROOT${bind#*=}"
+	mount --bind "${bind%%=*}" "$SANDBOX_ROOT${bind#*=}"
+done
+cd "$SANDBOX_ROOT"
+unset SANDBOX_ROOT SANDBOX_UPPER SANDBOX_WORK SANDBOX_BINDS
+exec chroot . "$@"
+`
+
+// Sandbox is a private, writable view of the host filesystem.
+type Sandbox struct {
+	dir   string
+	upper string
+	binds map[string]string
+
+	// Env is appended to the environment of every command.
+	Env []string
+}
+
+// New creates a sandbox, skipping the test if the host can't provide
+// one (e.g. not running as root or no overlayfs).
+func New(t *testing.T) *Sandbox {
+	if os.Geteuid() != 0 {
+		t.Skip("sandbox requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatalf("creating sandbox dir: %v", err)
+	}
+
+	s := &Sandbox{
+		dir:   dir,
+		upper: filepath.Join(dir, "upper"),
+		binds: map[string]string{},
+	}
+	for _, d := range []string{"upper", "work", "root", "binds"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			s.Cleanup(t)
+			t.Fatalf("creating sandbox dir: %v", err)
+		}
+	}
+
+	if out, err := s.Command("true").CombinedOutput(); err != nil {
+		s.Cleanup(t)
+		t.Skipf("cannot create sandbox: %v: %s", err, out)
+	}
+
+	return s
+}
+
+// Cleanup removes everything written by the sandbox.
+func (s *Sandbox) Cleanup(t *testing.T) {
+	if err := os.RemoveAll(s.dir); err != nil {
+		t.Errorf("couldn't remove %s: %v", s.dir, err)
+	}
+}
+
+// Bind replaces the directory target with an empty one for all following
+// commands, e.g. to give them a private /run. It returns the host path
+// of the directory.
+func (s *Sandbox) Bind(t *testing.T, target string) string {
+	target = filepath.Clean(target)
+	if dir, ok := s.binds[target]; ok {
+		return dir
+	}
+
+	dir := filepath.Join(s.dir, "binds", strings.Replace(strings.Trim(target, "/"), "/", "-", -1))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("creating bind dir for %s: %v", target, err)
+	}
+	s.binds[target] = dir
+	return dir
+}
+
+// Path maps a path inside the sandbox to the host path holding it. Files
+// which were not written by the sandbox or its commands are not visible
+// through the returned path.
+func (s *Sandbox) Path(path string) string {
+	path = filepath.Clean("/" + path)
+
+	var best string
+	for target := range s.binds {
+		if (path == target || strings.HasPrefix(path, target+"/")) && len(target) > len(best) {
+			best = target
+		}
+	}
+	if best != "" {
+		return filepath.Join(s.binds[best], strings.TrimPrefix(path, best))
+	}
+	return filepath.Join(s.upper, path)
+}
+
+func (s *Sandbox) inUpper(path string) bool {
+	return strings.HasPrefix(s.Path(path), s.upper+"/")
+}
+
+// WriteFile creates path inside the sandbox, including its parents.
+func (s *Sandbox) WriteFile(t *testing.T, path, data string, mode os.FileMode) {
+	hostPath := s.Path(path)
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		t.Fatalf("creating parent of %s: %v", path, err)
+	}
+	if err := ioutil.WriteFile(hostPath, []byte(data), mode); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+	if err := os.Chmod(hostPath, mode); err != nil {
+		t.Fatalf("setting mode of %s: %v", path, err)
+	}
+}
+
+// Mkdir creates an empty directory at path, hiding anything the host has
+// there.
+func (s *Sandbox) Mkdir(t *testing.T, path string) {
+	hostPath := s.Path(path)
+	if err := os.RemoveAll(hostPath); err != nil {
+		t.Fatalf("removing %s: %v", path, err)
+	}
+	if err := os.MkdirAll(hostPath, 0755); err != nil {
+		t.Fatalf("creating %s: %v", path, err)
+	}
+	if s.inUpper(path) {
+		// an opaque directory doesn't show the lower directory contents
+		if err := syscall.Setxattr(hostPath, "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+			t.Fatalf("marking %s opaque: %v", path, err)
+		}
+	}
+}
+
+// Remove hides path inside the sandbox, whether it was written by the
+// sandbox or exists on the host.
+func (s *Sandbox) Remove(t *testing.T, path string) {
+	hostPath := s.Path(path)
+	if err := os.RemoveAll(hostPath); err != nil {
+		t.Fatalf("removing %s: %v", path, err)
+	}
+	if s.inUpper(path) {
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+			t.Fatalf("creating parent of %s: %v", path, err)
+		}
+		// overlayfs treats a 0:0 character device as a whiteout
+		if err := syscall.Mknod(hostPath, syscall.S_IFCHR, 0); err != nil {
+			t.Fatalf("creating whiteout for %s: %v", path, err)
+		}
+	}
+}
+
+// CopyTree copies the files below src into the sandbox at target, keeping
+// their modes. Directories are merged with what is already there.
+func (s *Sandbox) CopyTree(t *testing.T, src, target string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		s.Install(t, path, filepath.Join(target, rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("copying %s: %v", src, err)
+	}
+}
+
+// ReadFile reads path from inside the sandbox.
+func (s *Sandbox) ReadFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(s.Path(path))
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return string(data)
+}
+
+// Exists reports whether path was created inside the sandbox.
+func (s *Sandbox) Exists(t *testing.T, path string) bool {
+	info, err := os.Lstat(s.Path(path))
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		t.Fatalf("checking %s: %v", path, err)
+	}
+
+	if info.Mode()&os.ModeCharDevice != 0 {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Rdev == 0 {
+			// whiteout
+			return false
+		}
+	}
+	return true
+}
+
+// Install copies a file from the repository into the sandbox, keeping
+// its mode, e.g. a script to its install location.
+func (s *Sandbox) Install(t *testing.T, src, target string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatalf("reading %s: %v", src, err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("checking %s: %v", src, err)
+	}
+	s.WriteFile(t, target, string(data), info.Mode().Perm())
+}
+
+// Stub installs an executable shell script named name ahead of the real
+// binaries in PATH.
+func (s *Sandbox) Stub(t *testing.T, name, script string) {
+	s.WriteFile(t, filepath.Join("/usr/local/bin", name), "#!/bin/sh\n"+script, 0755)
+}
+
+// Command returns a command which runs name inside the sandbox.
+func (s *Sandbox) Command(name string, args ...string) *exec.Cmd {
+	var targets []string
+	for target := range s.binds {
+		targets = append(targets, target)
+	}
+	// mount parents before their children
+	sort.Strings(targets)
+
+	var binds []string
+	for _, target := range targets {
+		binds = append(binds, fmt.Sprintf("%s=%s", s.binds[target], target))
+	}
+
+	cmd := exec.Command("/bin/sh", append([]string{"-c", wrapper, "sandbox", name}, args...)...)
+	cmd.Env = append([]string{
+		"PATH=" + DefaultPath,
+		"SANDBOX_ROOT=" + filepath.Join(s.dir, "root"),
+		"SANDBOX_UPPER=" + s.upper,
+		"SANDBOX_WORK=" + filepath.Join(s.dir, "work"),
+		"SANDBOX_BINDS=" + strings.Join(binds, " "),
+	}, s.Env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Unshareflags: syscall.CLONE_NEWNS,
+	}
+	return cmd
+}
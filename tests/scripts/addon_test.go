@@ -0,0 +1,225 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scripts
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/coreos/init/tests/sandbox"
+)
+
+// virtfs@metadata.service mounts the addon here
+const addonPath = "/media/metadata"
+
+const authorizedKeys = ed25519Key + " core@qemu-host\n"
+
+// addonScript returns an addon executable which records its pid, so the
+// test can tell whether addon_run exec'd it, and exits with status.
+func addonScript(name string, status int) string {
+	return fmt.Sprintf(`#!/bin/sh
+echo $$ > /run/addon/%s.pid
+echo "hello from %s"
+exit %d
+`, name, name, status)
+}
+
+func deprecated(path, action string) string {
+	return "Warning: " + action + " " + path + " is deprecated!\n" +
+		"Warning: Please switch to using cloud config instead.\n"
+}
+
+type addonResult struct {
+	status int
+	stdout string
+	stderr string
+}
+
+// runAddon runs an addon script and returns its result and pid
+func runAddon(t *testing.T, s *sandbox.Sandbox, script string, args ...string) (addonResult, int) {
+	var stdout, stderr bytes.Buffer
+	cmd := s.Command("/usr/lib/coreos/"+script, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	res := addonResult{stdout: stdout.String(), stderr: stderr.String()}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		res.status = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		t.Fatalf("running %s: %v", script, err)
+	}
+	return res, cmd.Process.Pid
+}
+
+func TestAddon(t *testing.T) {
+	addKeys := []stubCall{{
+		Args: []string{"-a", "metadata", addonPath + "/authorized_keys"},
+	}}
+
+	tests := []struct {
+		name  string
+		files map[string]os.FileMode
+		// stub update-ssh-keys failing
+		keysFail bool
+
+		config    addonResult
+		keysCalls []stubCall
+		run       addonResult
+		// which addon executable addon_run exec'd
+		execd string
+	}{
+		{
+			name:      "authorized_keys",
+			files:     map[string]os.FileMode{"authorized_keys": 0644},
+			config:    addonResult{stderr: deprecated(addonPath+"/authorized_keys", "Loading")},
+			keysCalls: addKeys,
+		},
+		{
+			name:  "run",
+			files: map[string]os.FileMode{"run": 0755},
+			run:   addonResult{status: 3, stdout: "hello from run\n", stderr: deprecated(addonPath+"/run", "Executing")},
+			execd: "run",
+		},
+		{
+			name:  "run.sh",
+			files: map[string]os.FileMode{"run.sh": 0755},
+			run:   addonResult{status: 4, stdout: "hello from run.sh\n", stderr: deprecated(addonPath+"/run.sh", "Executing")},
+			execd: "run.sh",
+		},
+		{
+			name:  "run before run.sh",
+			files: map[string]os.FileMode{"run": 0755, "run.sh": 0755},
+			run:   addonResult{status: 3, stdout: "hello from run\n", stderr: deprecated(addonPath+"/run", "Executing")},
+			execd: "run",
+		},
+		{
+			name:  "run not executable",
+			files: map[string]os.FileMode{"run": 0644, "run.sh": 0755},
+			run:   addonResult{status: 4, stdout: "hello from run.sh\n", stderr: deprecated(addonPath+"/run.sh", "Executing")},
+			execd: "run.sh",
+		},
+		{
+			name:      "everything",
+			files:     map[string]os.FileMode{"authorized_keys": 0600, "run": 0755, "run.sh": 0755},
+			config:    addonResult{stderr: deprecated(addonPath+"/authorized_keys", "Loading")},
+			keysCalls: addKeys,
+			run:       addonResult{status: 3, stdout: "hello from run\n", stderr: deprecated(addonPath+"/run", "Executing")},
+			execd:     "run",
+		},
+		{
+			name:  "neither",
+			files: map[string]os.FileMode{"README": 0644, "run.sh": 0644},
+		},
+		{
+			name:      "update-ssh-keys fails",
+			files:     map[string]os.FileMode{"authorized_keys": 0644},
+			keysFail:  true,
+			config:    addonResult{status: 1, stderr: deprecated(addonPath+"/authorized_keys", "Loading")},
+			keysCalls: addKeys,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := sandbox.New(t)
+			defer s.Cleanup(t)
+
+			s.Install(t, "../../scripts/addon_config", "/usr/lib/coreos/addon_config")
+			s.Install(t, "../../scripts/addon_run", "/usr/lib/coreos/addon_run")
+			s.Bind(t, "/run")
+			s.Bind(t, addonPath)
+			s.Mkdir(t, "/run/addon")
+			recordingStub(t, s, "update-ssh-keys")
+			if test.keysFail {
+				s.Stub(t, "update-ssh-keys", "exit 1\n")
+			}
+
+			for name, mode := range test.files {
+				var data string
+				switch name {
+				case "authorized_keys":
+					data = authorizedKeys
+				case "run":
+					data = addonScript(name, 3)
+				case "run.sh":
+					data = addonScript(name, 4)
+				default:
+					data = "not an addon\n"
+				}
+				s.WriteFile(t, addonPath+"/"+name, data, mode)
+			}
+
+			config, _ := runAddon(t, s, "addon_config", addonPath)
+			if config != test.config {
+				t.Fatalf("unexpected addon_config result: expected %+v, received %+v", test.config, config)
+			}
+			if !test.keysFail {
+				if calls := stubCalls(t, s, "update-ssh-keys"); !reflect.DeepEqual(calls, test.keysCalls) {
+					t.Fatalf("unexpected update-ssh-keys calls: expected %q, received %q", test.keysCalls, calls)
+				}
+			}
+
+			run, pid := runAddon(t, s, "addon_run", addonPath)
+			if run != test.run {
+				t.Fatalf("unexpected addon_run result: expected %+v, received %+v", test.run, run)
+			}
+			for _, name := range []string{"run", "run.sh"} {
+				path := "/run/addon/" + name + ".pid"
+				if name != test.execd {
+					if s.Exists(t, path) {
+						t.Fatalf("%s was executed", name)
+					}
+					continue
+				}
+				// exec keeps the pid of addon_run
+				execPid, err := strconv.Atoi(strings.TrimSpace(s.ReadFile(t, path)))
+				if err != nil {
+					t.Fatalf("parsing %s: %v", path, err)
+				}
+				if execPid != pid {
+					t.Fatalf("%s ran as pid %d instead of replacing addon_run (pid %d)", name, execPid, pid)
+				}
+			}
+		})
+	}
+}
+
+func TestAddonMissingPath(t *testing.T) {
+	s := sandbox.New(t)
+	defer s.Cleanup(t)
+
+	for _, script := range []string{"addon_config", "addon_run"} {
+		s.Install(t, "../../scripts/"+script, "/usr/lib/coreos/"+script)
+
+		for _, args := range [][]string{nil, {""}} {
+			res, _ := runAddon(t, s, script, args...)
+			expected := addonResult{
+				status: 1,
+				stderr: "/usr/lib/coreos/" + script + ": missing addon path\n",
+			}
+			if res != expected {
+				t.Fatalf("%s %q: expected %+v, received %+v", script, args, expected, res)
+			}
+		}
+	}
+}
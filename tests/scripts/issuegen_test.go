@@ -0,0 +1,184 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scripts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coreos/init/tests/sandbox"
+	"github.com/coreos/init/tests/udev"
+)
+
+const (
+	issueHeader = "\nThis is \\n (\\s \\m \\r) \\t\n"
+	issueEOL    = "\n\x1b[31;1mCoreOS Container Linux is no longer maintained or updated.\nSee https://coreos.com/os/eol/\x1b[0m\n\n"
+	sshHostKeys = "SSH host key: SHA256:qTC8lOsVOwlyUbM6PeKYCGvWQVsAP9eBQFi6DTFkYnU (ED25519)\n"
+)
+
+func expectedIssue(notes ...string) string {
+	return issueHeader + strings.Join(notes, "") + issueEOL
+}
+
+func ifaceNote(iface string) string {
+	return iface + ": \\4{" + iface + "} \\6{" + iface + "}\n"
+}
+
+func newIssuegenSandbox(t *testing.T) *sandbox.Sandbox {
+	s := sandbox.New(t)
+	s.Install(t, "../../scripts/issuegen", "/usr/lib/coreos/issuegen")
+	s.Bind(t, "/run")
+	return s
+}
+
+// udevEvent runs the RUN commands 90-issuegen.rules generates for a
+// network interface event inside the sandbox.
+func udevEvent(t *testing.T, s *sandbox.Sandbox, e *udev.Evaluator, action, iface string) {
+	res, err := e.Eval(udev.Device{
+		Action:    action,
+		Kernel:    iface,
+		Subsystem: "net",
+		Env:       map[string]string{"INTERFACE": iface},
+	})
+	if err != nil {
+		t.Fatalf("evaluating udev rules: %v", err)
+	}
+
+	for _, run := range res.Run {
+		argv := strings.Fields(run)
+		if out, err := s.Command(argv[0], argv[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v: %s", run, err, out)
+		}
+	}
+}
+
+func TestIssuegenBoot(t *testing.T) {
+	s := newIssuegenSandbox(t)
+	defer s.Cleanup(t)
+
+	// issuegen.service runs without arguments
+	if out, err := s.Command("/usr/lib/coreos/issuegen").CombinedOutput(); err != nil {
+		t.Fatalf("issuegen failed: %v: %s", err, out)
+	}
+
+	if issue := s.ReadFile(t, "/run/issue"); issue != expectedIssue() {
+		t.Fatalf("unexpected /run/issue: expected %q, received %q", expectedIssue(), issue)
+	}
+	if s.Exists(t, "/run/issue.d") {
+		t.Fatalf("/run/issue.d was created without any interface")
+	}
+}
+
+func TestIssuegenUdev(t *testing.T) {
+	files, err := udev.LoadDir("../../udev/rules.d")
+	if err != nil {
+		t.Fatalf("loading udev rules: %v", err)
+	}
+	e := &udev.Evaluator{Files: files}
+
+	s := newIssuegenSandbox(t)
+	defer s.Cleanup(t)
+
+	// sshd-keygen.service runs before issuegen.service
+	s.WriteFile(t, "/run/issue.d/00_ssh_host_keys", sshHostKeys, 0644)
+
+	steps := []struct {
+		action string
+		iface  string
+		issue  string
+	}{
+		{
+			action: "add",
+			iface:  "eth0",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("eth0")),
+		},
+		{
+			action: "add",
+			iface:  "lo",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("eth0")),
+		},
+		{
+			action: "add",
+			iface:  "ens3",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("ens3"), ifaceNote("eth0")),
+		},
+		{
+			action: "add",
+			iface:  "eth1",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("ens3"), ifaceNote("eth0"), ifaceNote("eth1")),
+		},
+		{
+			action: "add",
+			iface:  "wlan0",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("ens3"), ifaceNote("eth0"), ifaceNote("eth1")),
+		},
+		{
+			action: "remove",
+			iface:  "eth0",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("ens3"), ifaceNote("eth1")),
+		},
+		{
+			action: "remove",
+			iface:  "eth0",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("ens3"), ifaceNote("eth1")),
+		},
+		{
+			action: "add",
+			iface:  "eth0",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("ens3"), ifaceNote("eth0"), ifaceNote("eth1")),
+		},
+		{
+			action: "remove",
+			iface:  "ens3",
+			issue:  expectedIssue(sshHostKeys, ifaceNote("eth0"), ifaceNote("eth1")),
+		},
+	}
+
+	for _, step := range steps {
+		udevEvent(t, s, e, step.action, step.iface)
+
+		if issue := s.ReadFile(t, "/run/issue"); issue != step.issue {
+			t.Fatalf("unexpected /run/issue after %s %s: expected %q, received %q", step.action, step.iface, step.issue, issue)
+		}
+	}
+
+	for _, iface := range []string{"eth0", "eth1"} {
+		path := "/run/issue.d/" + iface
+		if note := s.ReadFile(t, path); note != ifaceNote(iface) {
+			t.Fatalf("unexpected %s: expected %q, received %q", path, ifaceNote(iface), note)
+		}
+	}
+	for _, iface := range []string{"ens3", "lo", "wlan0"} {
+		if s.Exists(t, "/run/issue.d/"+iface) {
+			t.Fatalf("/run/issue.d/%s should not exist", iface)
+		}
+	}
+}
+
+func TestIssuegenIgnoresDirectories(t *testing.T) {
+	s := newIssuegenSandbox(t)
+	defer s.Cleanup(t)
+
+	s.WriteFile(t, "/run/issue.d/10_subdir/note", "should not be shown\n", 0644)
+
+	if out, err := s.Command("/usr/lib/coreos/issuegen", "add", "eth0").CombinedOutput(); err != nil {
+		t.Fatalf("issuegen failed: %v: %s", err, out)
+	}
+
+	expected := expectedIssue(ifaceNote("eth0"))
+	if issue := s.ReadFile(t, "/run/issue"); issue != expected {
+		t.Fatalf("unexpected /run/issue: expected %q, received %q", expected, issue)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scripts
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/init/tests/sandbox"
+)
+
+var flagUpdate bool
+
+func init() {
+	flag.BoolVar(&flagUpdate, "update", false, "rewrite golden files from the current output")
+}
+
+// the directories motdgen reads which are replaced by each fixture
+var motdgenDirs = []string{
+	"/usr/share/coreos",
+	"/etc/coreos",
+	"/etc/motd.d",
+}
+
+func TestMotdgen(t *testing.T) {
+	tests := []struct {
+		name string
+		// empty directories which can't be checked in as fixtures
+		emptyDirs []string
+	}{
+		{name: "stable"},
+		{name: "etc-override"},
+		{name: "etc-only"},
+		{name: "etc-without-group"},
+		{name: "no-group"},
+		{name: "ansi-bold"},
+		{name: "ansi-missing"},
+		{name: "motd-empty", emptyDirs: []string{"/etc/motd.d"}},
+		{name: "motd-no-conf"},
+		{name: "motd-ordering"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := filepath.Join("testdata", "motdgen", test.name)
+
+			s := sandbox.New(t)
+			defer s.Cleanup(t)
+
+			s.Install(t, "../../scripts/motdgen", "/usr/lib/coreos/motdgen")
+			s.Bind(t, "/run")
+
+			for _, dir := range motdgenDirs {
+				if _, err := os.Stat(filepath.Join(fixture, "root", dir)); err == nil {
+					s.Mkdir(t, dir)
+				} else {
+					s.Remove(t, dir)
+				}
+			}
+			for _, dir := range test.emptyDirs {
+				s.Mkdir(t, dir)
+			}
+			s.CopyTree(t, filepath.Join(fixture, "root"), "/")
+
+			if out, err := s.Command("/usr/lib/coreos/motdgen").CombinedOutput(); err != nil {
+				t.Fatalf("motdgen failed: %v: %s", err, out)
+			}
+
+			motd := s.ReadFile(t, "/run/coreos/motd")
+			golden := filepath.Join(fixture, "motd")
+			if flagUpdate {
+				if err := ioutil.WriteFile(golden, []byte(motd), 0644); err != nil {
+					t.Fatalf("updating %s: %v", golden, err)
+				}
+			}
+
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("reading %s: %v", golden, err)
+			}
+			if motd != string(expected) {
+				t.Fatalf("/run/coreos/motd differs from %s: expected %q, received %q", golden, expected, motd)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scripts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coreos/init/tests/sandbox"
+)
+
+const (
+	ed25519Key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHhXwRFZ5q7o8Yk0RcK5hWvFzQ9XF4ZtUGpZ8m6b3Xq9"
+	rsaKey     = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC7f3m0Qh2bP8C4dNx0cV6rVZk1yY9w4n8Xz1dRk2uJ0qY7tH3rW5vL6mN8pB9cD0eF1gH2iJ3kL4mN5oP6qR7sT8uV9wX0yZ1aB2cD3eF4gH5iJ6kL7mN8oP9qR0sT1uV2wX3yZ4aB5cD6eF7gH8iJ9kL0mN1oP2qR3sT4uV5wX6yZ7aB8cD9eF0gH1iJ2kL3mN4oP5qR6sT7uV8wX9yZ0aB1cD2eF3gH4iJ5kL6mN7oP8qR9sT0uV1wX2yZ3aB4cD5eF6gH7iJ8kL9mN0oP1qR2sT3uV4wX5yZ6aB7cD8eF9gH0iJ1kL2mN3oP4qR5sT6uV7wX8yZ9aB0cD1eF2gH3iJ4kL5mN6oP7qR8sT9uV0wX1yZ2aB3cD4eF5g=="
+	bootParams = "BOOT_IMAGE=/coreos/vmlinuz-a mount.usr=/dev/mapper/usr verity.usr=PARTUUID=7130c94a-213a-4e5a-8e26-6cce9662f132 rootflags=rw mount.usrflags=ro consoleblank=0 root=LABEL=ROOT console=ttyS0,115200n8 coreos.first_boot=detected"
+)
+
+// stubCall is one recorded invocation of a stub.
+type stubCall struct {
+	Args  []string
+	Stdin string
+}
+
+// recordingStub installs a stub for name which records its arguments and
+// standard input in /run/stubs/<name>, numbered so the calls sort in order.
+func recordingStub(t *testing.T, s *sandbox.Sandbox, name string) {
+	s.Stub(t, name, fmt.Sprintf(`set -e
+dir=/run/stubs/%s
+mkdir -p "$dir"
+n=0
+for f in "$dir"/*.args; do
+	if [ -e "$f" ]; then n=$((n + 1)); fi
+done
+n=$(printf '%%04d' "$n")
+printf '%%s\n' "$@" > "$dir/$n.args"
+cat > "$dir/$n.stdin"
+`, name))
+}
+
+// stubCalls returns the invocations recorded by recordingStub.
+func stubCalls(t *testing.T, s *sandbox.Sandbox, name string) []stubCall {
+	dir := s.Path("/run/stubs/" + name)
+	argFiles, err := filepath.Glob(filepath.Join(dir, "*.args"))
+	if err != nil {
+		t.Fatalf("listing stub calls: %v", err)
+	}
+	sort.Strings(argFiles)
+
+	var calls []stubCall
+	for _, argFile := range argFiles {
+		args, err := ioutil.ReadFile(argFile)
+		if err != nil {
+			t.Fatalf("reading %s: %v", argFile, err)
+		}
+		stdin, err := ioutil.ReadFile(strings.TrimSuffix(argFile, ".args") + ".stdin")
+		if err != nil {
+			t.Fatalf("reading stdin of %s: %v", argFile, err)
+		}
+		calls = append(calls, stubCall{
+			Args:  strings.Split(strings.TrimSuffix(string(args), "\n"), "\n"),
+			Stdin: string(stdin),
+		})
+	}
+	return calls
+}
+
+func TestSSHKeyProcCmdline(t *testing.T) {
+	procCmdline := []string{"-a", "proc-cmdline"}
+
+	tests := []struct {
+		name    string
+		cmdline string
+		calls   []stubCall
+	}{
+		{
+			name:    "ed25519 with comment",
+			cmdline: bootParams + ` sshkey="` + ed25519Key + ` core@example.com"`,
+			calls:   []stubCall{{procCmdline, ed25519Key + " core@example.com\n"}},
+		},
+		{
+			name:    "rsa with multi-word comment",
+			cmdline: `sshkey="` + rsaKey + ` Jane Doe <jane@example.com>" ` + bootParams,
+			calls:   []stubCall{{procCmdline, rsaKey + " Jane Doe <jane@example.com>\n"}},
+		},
+		{
+			name:    "key without comment",
+			cmdline: bootParams + ` sshkey="` + ed25519Key + `" quiet`,
+			calls:   []stubCall{{procCmdline, ed25519Key + "\n"}},
+		},
+		{
+			name:    "no sshkey",
+			cmdline: bootParams,
+		},
+		{
+			name:    "unquoted sshkey",
+			cmdline: bootParams + " sshkey=" + strings.Replace(ed25519Key, " ", "_", -1),
+		},
+		{
+			name:    "empty sshkey",
+			cmdline: bootParams + ` sshkey="" console=tty0`,
+		},
+		{
+			name:    "several sshkey parameters",
+			cmdline: bootParams + ` sshkey="` + ed25519Key + ` first@example.com" sshkey="` + rsaKey + ` second@example.com"`,
+			calls:   []stubCall{{procCmdline, ed25519Key + " first@example.com\n"}},
+		},
+		{
+			name:    "embedded spaces and equals signs",
+			cmdline: bootParams + ` sshkey="` + rsaKey + ` role=admin host = build01" coreos.autologin`,
+			calls:   []stubCall{{procCmdline, rsaKey + " role=admin host = build01\n"}},
+		},
+		{
+			name:    "key options",
+			cmdline: bootParams + ` sshkey="no-pty,from=10.0.0.0/8 ` + ed25519Key + ` backup@example.com"`,
+			calls:   []stubCall{{procCmdline, "no-pty,from=10.0.0.0/8 " + ed25519Key + " backup@example.com\n"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := sandbox.New(t)
+			defer s.Cleanup(t)
+
+			s.Install(t, "../../scripts/ssh-key-proc-cmdline", "/usr/lib/coreos/ssh-key-proc-cmdline")
+			s.Bind(t, "/run")
+			s.WriteFile(t, "/proc/cmdline", test.cmdline+"\n", 0444)
+			recordingStub(t, s, "update-ssh-keys")
+
+			if out, err := s.Command("/usr/lib/coreos/ssh-key-proc-cmdline").CombinedOutput(); err != nil {
+				t.Fatalf("ssh-key-proc-cmdline failed: %v: %s", err, out)
+			}
+
+			calls := stubCalls(t, s, "update-ssh-keys")
+			if !reflect.DeepEqual(calls, test.calls) {
+				t.Fatalf("unexpected update-ssh-keys calls: expected %q, received %q", test.calls, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scripts
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coreos/init/tests/coreos-install/util"
+	"github.com/coreos/init/tests/sandbox"
+)
+
+// fingerprint returns the "SHA256:... (TYPE)" part of ssh-keygen -l
+func fingerprint(t *testing.T, keyFile string) string {
+	fields := strings.Fields(string(util.MustRun(t, "ssh-keygen", "-l", "-f", keyFile)))
+	if len(fields) < 4 {
+		t.Fatalf("unexpected ssh-keygen -l output for %s: %q", keyFile, fields)
+	}
+	return fields[1] + " " + fields[len(fields)-1]
+}
+
+func TestSSHDKeygen(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+
+	s := sandbox.New(t)
+	defer s.Cleanup(t)
+
+	s.Install(t, "../../scripts/sshd_keygen", "/usr/lib/coreos/sshd_keygen")
+	sshDir := s.Bind(t, "/etc/ssh")
+	s.Bind(t, "/run")
+
+	// a valid key which must survive
+	validKey := filepath.Join(sshDir, "ssh_host_ed25519_key")
+	util.MustRun(t, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "root@existing", "-f", validKey)
+	validData, err := ioutil.ReadFile(validKey)
+	if err != nil {
+		t.Fatalf("reading %s: %v", validKey, err)
+	}
+	validFingerprint := fingerprint(t, validKey)
+
+	// an unclean shutdown left an empty private key next to the old
+	// public key
+	staleDir, err := ioutil.TempDir("", "stale-key")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(staleDir)
+	staleKey := filepath.Join(staleDir, "ssh_host_rsa_key")
+	util.MustRun(t, "ssh-keygen", "-q", "-t", "rsa", "-b", "2048", "-N", "", "-C", "root@stale", "-f", staleKey)
+	staleFingerprint := fingerprint(t, staleKey)
+	util.MustRun(t, "cp", staleKey+".pub", sshDir)
+	if err := ioutil.WriteFile(filepath.Join(sshDir, "ssh_host_rsa_key"), nil, 0600); err != nil {
+		t.Fatalf("writing empty rsa key: %v", err)
+	}
+
+	// the ecdsa key is missing entirely
+
+	// an empty public key alone must not be deleted by the cleanup
+	if err := ioutil.WriteFile(filepath.Join(sshDir, "ssh_host_empty_key.pub"), nil, 0644); err != nil {
+		t.Fatalf("writing empty public key: %v", err)
+	}
+
+	if out, err := s.Command("/usr/lib/coreos/sshd_keygen").CombinedOutput(); err != nil {
+		t.Fatalf("sshd_keygen failed: %v: %s", err, out)
+	}
+
+	data, err := ioutil.ReadFile(validKey)
+	if err != nil {
+		t.Fatalf("reading %s: %v", validKey, err)
+	}
+	if string(data) != string(validData) {
+		t.Fatalf("valid ed25519 key was regenerated")
+	}
+	if fp := fingerprint(t, validKey); fp != validFingerprint {
+		t.Fatalf("ed25519 fingerprint changed: expected %s, received %s", validFingerprint, fp)
+	}
+
+	rsaKey := filepath.Join(sshDir, "ssh_host_rsa_key")
+	info, err := os.Stat(rsaKey)
+	if err != nil {
+		t.Fatalf("empty rsa key was not regenerated: %v", err)
+	}
+	if info.Size() == 0 {
+		t.Fatalf("rsa key is still empty")
+	}
+	rsaFingerprint := fingerprint(t, rsaKey)
+	if rsaFingerprint == staleFingerprint {
+		t.Fatalf("rsa key fingerprint matches the stale key")
+	}
+	if pub := fingerprint(t, rsaKey+".pub"); pub != rsaFingerprint {
+		t.Fatalf("rsa public key doesn't match the regenerated private key: %s != %s", pub, rsaFingerprint)
+	}
+
+	if _, err := os.Stat(filepath.Join(sshDir, "ssh_host_ecdsa_key")); err != nil {
+		t.Fatalf("missing ecdsa key was not generated: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sshDir, "ssh_host_empty_key.pub")); err != nil {
+		t.Fatalf("empty public key was removed: %v", err)
+	}
+
+	// every private key is listed exactly once
+	keys, err := filepath.Glob(filepath.Join(sshDir, "ssh_host_*_key"))
+	if err != nil {
+		t.Fatalf("listing host keys: %v", err)
+	}
+	var expected []string
+	types := map[string]bool{}
+	for _, key := range keys {
+		fp := fingerprint(t, key)
+		keyType := strings.Fields(fp)[1]
+		if types[keyType] {
+			t.Fatalf("more than one %s host key", keyType)
+		}
+		types[keyType] = true
+		expected = append(expected, "SSH host key: "+fp)
+	}
+	for _, keyType := range []string{"(RSA)", "(ECDSA)", "(ED25519)"} {
+		if !types[keyType] {
+			t.Fatalf("no %s host key was generated", keyType)
+		}
+	}
+
+	issue := s.ReadFile(t, "/run/issue.d/00_ssh_host_keys")
+	if !strings.HasSuffix(issue, "\n") {
+		t.Fatalf("00_ssh_host_keys doesn't end in a newline: %q", issue)
+	}
+	lines := strings.Split(strings.TrimSuffix(issue, "\n"), "\n")
+
+	sort.Strings(expected)
+	sort.Strings(lines)
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected 00_ssh_host_keys: expected %q, received %q", expected, lines)
+	}
+}
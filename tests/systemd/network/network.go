@@ -0,0 +1,338 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package network parses the systemd-networkd .network and udev .link
+// files shipped in this repository and simulates which of them applies to
+// a synthetic interface. Like networkd and udev, the first file in lexical
+// order whose [Match] section matches wins.
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Setting is a single key=value line of a file.
+type Setting struct {
+	Section string
+	Key     string
+	Value   string
+	Line    int
+}
+
+// File is a parsed .network or .link file.
+type File struct {
+	Name     string
+	Settings []Setting
+}
+
+// Ext returns the type of the file, ".network" or ".link".
+func (f *File) Ext() string {
+	return filepath.Ext(f.Name)
+}
+
+// Get returns the values of key in section, in file order.
+func (f *File) Get(section, key string) []string {
+	var values []string
+	for _, s := range f.Settings {
+		if s.Section == section && s.Key == key {
+			values = append(values, s.Value)
+		}
+	}
+	return values
+}
+
+// Interface describes a network interface as seen when matching.
+type Interface struct {
+	Name       string
+	Driver     string
+	MACAddress string
+	Path       string
+	Type       string
+
+	// KernelCommandLine is the contents of /proc/cmdline.
+	KernelCommandLine string
+	// Virtualization is the systemd-detect-virt id, empty for none.
+	Virtualization string
+}
+
+// ParseFile parses the file at path.
+func ParseFile(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(filepath.Base(path), f)
+}
+
+// Parse parses a file read from r.
+func Parse(name string, r io.Reader) (*File, error) {
+	switch filepath.Ext(name) {
+	case ".network", ".link":
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type", name)
+	}
+
+	file := &File{Name: name}
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return nil, fmt.Errorf("%s:%d: invalid section header %q", name, lineno, line)
+			}
+			section = line[1 : len(line)-1]
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: missing '=' in %q", name, lineno, line)
+		}
+		if section == "" {
+			return nil, fmt.Errorf("%s:%d: assignment outside of a section", name, lineno)
+		}
+		file.Settings = append(file.Settings, Setting{
+			Section: section,
+			Key:     strings.TrimSpace(line[:eq]),
+			Value:   strings.TrimSpace(line[eq+1:]),
+			Line:    lineno,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", name, err)
+	}
+
+	return file, nil
+}
+
+// LoadDir parses all .network and .link files in dir, sorted by name.
+func LoadDir(dir string) ([]*File, error) {
+	var files []*File
+	for _, ext := range []string{".network", ".link"} {
+		paths, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			file, err := ParseFile(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+var matchKeys = []string{"MACAddress", "Path", "Driver", "Type", "Host", "Virtualization", "KernelCommandLine", "Architecture"}
+
+// known lists the sections and keys understood by networkd and udev.
+var known = map[string]map[string][]string{
+	".network": {
+		"Match": append([]string{"Name"}, matchKeys...),
+		"Link":  {"MACAddress", "MTUBytes", "ARP", "Unmanaged", "RequiredForOnline"},
+		"Network": {"Description", "DHCP", "DHCPServer", "LinkLocalAddressing", "IPv4LLRoute",
+			"IPv6Token", "LLMNR", "MulticastDNS", "DNSSEC", "DNSSECNegativeTrustAnchors", "LLDP",
+			"EmitLLDP", "BindCarrier", "Address", "Gateway", "DNS", "Domains", "NTP", "IPForward",
+			"IPMasquerade", "IPv6PrivacyExtensions", "IPv6AcceptRA", "IPv6DuplicateAddressDetection",
+			"IPv6HopLimit", "IPv4ProxyARP", "IPv6ProxyNDPAddress", "Bridge", "Bond", "VRF", "VLAN",
+			"IPVLAN", "MACVLAN", "VXLAN", "Tunnel", "ActiveSlave", "PrimarySlave"},
+		"Address": {"Address", "Peer", "Broadcast", "Label", "PreferredLifetime", "Scope",
+			"HomeAddress", "DuplicateAddressDetection", "ManageTemporaryAddress", "PrefixRoute"},
+		"Route": {"Gateway", "Destination", "Source", "Metric", "Scope", "PreferredSource",
+			"Table", "Protocol", "Type"},
+		"DHCP": {"UseDNS", "UseNTP", "UseMTU", "SendHostname", "UseHostname", "Hostname",
+			"UseDomains", "UseRoutes", "UseTimezone", "CriticalConnection", "ClientIdentifier",
+			"VendorClassIdentifier", "DUIDType", "DUIDRawData", "IAID", "RequestBroadcast",
+			"RouteMetric", "RouteTable", "ListenPort"},
+		"IPv6AcceptRA": {"UseDNS", "UseDomains", "RouteTable"},
+		"DHCPServer": {"PoolOffset", "PoolSize", "DefaultLeaseTimeSec", "MaxLeaseTimeSec",
+			"EmitDNS", "DNS", "EmitNTP", "NTP", "EmitRouter", "EmitTimezone", "Timezone"},
+	},
+	".link": {
+		"Match": append([]string{"OriginalName"}, matchKeys...),
+		"Link": {"Description", "Alias", "MACAddressPolicy", "MACAddress", "NamePolicy", "Name",
+			"MTUBytes", "BitsPerSecond", "Duplex", "AutoNegotiation", "WakeOnLan",
+			"TCPSegmentationOffload", "TCP6SegmentationOffload", "GenericSegmentationOffload",
+			"GenericReceiveOffload", "LargeReceiveOffload", "RxChannels", "TxChannels",
+			"OtherChannels", "CombinedChannels"},
+	},
+}
+
+// Check reports sections and keys of f which networkd or udev would
+// ignore.
+func Check(f *File) []error {
+	sections := known[f.Ext()]
+
+	var errs []error
+	reported := map[string]bool{}
+	for _, s := range f.Settings {
+		keys, ok := sections[s.Section]
+		if !ok {
+			if !reported[s.Section] {
+				reported[s.Section] = true
+				errs = append(errs, fmt.Errorf("%s:%d: unknown section [%s]", f.Name, s.Line, s.Section))
+			}
+			continue
+		}
+		if !contains(keys, s.Key) {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown key %s in section [%s]", f.Name, s.Line, s.Key, s.Section))
+		}
+	}
+	return errs
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns the first of files with extension ext, in lexical order,
+// which applies to iface, or nil if none does.
+func Select(files []*File, ext string, iface Interface) *File {
+	var candidates []*File
+	for _, f := range files {
+		if f.Ext() == ext {
+			candidates = append(candidates, f)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+
+	for _, f := range candidates {
+		if Matches(f, iface) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the [Match] section of f applies to iface. An
+// empty [Match] section matches every interface.
+func Matches(f *File, iface Interface) bool {
+	for _, s := range f.Settings {
+		if s.Section != "Match" {
+			continue
+		}
+
+		var ok bool
+		switch s.Key {
+		case "MACAddress":
+			ok = contains(strings.Fields(strings.ToLower(s.Value)), strings.ToLower(iface.MACAddress))
+		case "Name", "OriginalName":
+			ok = globMatch(s.Value, iface.Name)
+		case "Driver":
+			ok = globMatch(s.Value, iface.Driver)
+		case "Path":
+			ok = globMatch(s.Value, iface.Path)
+		case "Type":
+			ok = globMatch(s.Value, iface.Type)
+		case "KernelCommandLine":
+			ok = condition(s.Value, func(v string) bool {
+				return cmdlineMatch(v, iface.KernelCommandLine)
+			})
+		case "Virtualization":
+			ok = condition(s.Value, func(v string) bool {
+				return virtMatch(v, iface.Virtualization)
+			})
+		default:
+			// Host and Architecture depend on the machine, not the
+			// interface, and aren't used here
+			ok = false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// globMatch matches value against a whitespace separated list of shell
+// globs. Unlike path.Match, '*' also matches '/'.
+func globMatch(patterns, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, pattern := range strings.Fields(patterns) {
+		ok, err := path.Match(strings.Replace(pattern, "/", "\x00", -1), strings.Replace(value, "/", "\x00", -1))
+		if err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// condition evaluates a systemd condition value, which is negated by a
+// leading '!'.
+func condition(value string, match func(string) bool) bool {
+	if strings.HasPrefix(value, "!") {
+		return !match(value[1:])
+	}
+	return match(value)
+}
+
+// cmdlineMatch mirrors ConditionKernelCommandLine=: a value with '=' must
+// match a parameter exactly, otherwise it matches the parameter with or
+// without an assignment.
+func cmdlineMatch(value, cmdline string) bool {
+	for _, word := range strings.Fields(cmdline) {
+		if strings.Contains(value, "=") {
+			if word == value {
+				return true
+			}
+		} else if word == value || strings.HasPrefix(word, value+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+var containers = []string{"openvz", "lxc", "lxc-libvirt", "systemd-nspawn", "docker", "rkt", "container-other"}
+
+// virtMatch mirrors ConditionVirtualization=.
+func virtMatch(value, virt string) bool {
+	switch value {
+	case "yes":
+		return virt != ""
+	case "no":
+		return virt == ""
+	case "vm":
+		return virt != "" && !contains(containers, virt)
+	case "container":
+		return contains(containers, virt)
+	default:
+		return virt != "" && value == virt
+	}
+}
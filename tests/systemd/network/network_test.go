@@ -0,0 +1,319 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const networkDir = "../../../systemd/network"
+
+const (
+	diskCmdline  = "BOOT_IMAGE=/coreos/vmlinuz-a mount.usr=/dev/mapper/usr rootflags=rw root=LABEL=ROOT console=ttyS0,115200n8"
+	azureCmdline = diskCmdline + " coreos.oem.id=azure"
+	pxeCmdline   = "initrd=coreos_production_pxe_image.cpio.gz coreos.autologin coreos.config.url=http://10.0.0.1/pxe.ign"
+)
+
+func loadFiles(t *testing.T) []*File {
+	files, err := LoadDir(networkDir)
+	if err != nil {
+		t.Fatalf("loading %s: %v", networkDir, err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no files in %s", networkDir)
+	}
+	return files
+}
+
+func TestCorpus(t *testing.T) {
+	for _, f := range loadFiles(t) {
+		for _, err := range Check(f) {
+			t.Errorf("%v", err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f, err := Parse("typo.network", strings.NewReader(`# comment
+[Match]
+Driver=e1000
+Drvier=e1000
+
+[Network]
+DHCP=yes
+DHPC=yes
+
+[Nework]
+Address=10.0.0.2/24
+Gateway=10.0.0.1
+
+[Link]
+NamePolicy=kernel
+`))
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+
+	expected := []string{
+		"typo.network:4: unknown key Drvier in section [Match]",
+		"typo.network:8: unknown key DHPC in section [Network]",
+		"typo.network:11: unknown section [Nework]",
+		"typo.network:15: unknown key NamePolicy in section [Link]",
+	}
+	errs := Check(f)
+	var received []string
+	for _, err := range errs {
+		received = append(received, err.Error())
+	}
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected errors: expected %q, received %q", expected, received)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "foo.network",
+			input: "DHCP=yes\n",
+			err:   "foo.network:1: assignment outside of a section",
+		},
+		{
+			name:  "foo.network",
+			input: "[Network\nDHCP=yes\n",
+			err:   "foo.network:1: invalid section header \"[Network\"",
+		},
+		{
+			name:  "foo.link",
+			input: "[Link]\n\nNamePolicy\n",
+			err:   "foo.link:3: missing '=' in \"NamePolicy\"",
+		},
+		{
+			name:  "foo.netdev",
+			input: "[NetDev]\n",
+			err:   "foo.netdev: unsupported file type",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.name, strings.NewReader(test.input))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: expected error %q, received %v", test.input, test.err, err)
+		}
+	}
+}
+
+func TestSelectNetwork(t *testing.T) {
+	files := loadFiles(t)
+
+	tests := []struct {
+		name   string
+		iface  Interface
+		winner string
+	}{
+		{
+			name: "azure sr-iov vf",
+			iface: Interface{
+				Name:              "eth1",
+				Driver:            "mlx4_en",
+				MACAddress:        "00:0d:3a:1f:22:8b",
+				KernelCommandLine: azureCmdline,
+				Virtualization:    "microsoft",
+			},
+			winner: "yy-azure-sriov.network",
+		},
+		{
+			name: "azure synthetic nic",
+			iface: Interface{
+				Name:              "eth0",
+				Driver:            "hv_netvsc",
+				MACAddress:        "00:0d:3a:1f:22:8b",
+				KernelCommandLine: azureCmdline,
+				Virtualization:    "microsoft",
+			},
+			winner: "zz-default.network",
+		},
+		{
+			name: "mlx4 outside azure",
+			iface: Interface{
+				Name:              "enp4s0",
+				Driver:            "mlx4_en",
+				KernelCommandLine: diskCmdline,
+			},
+			winner: "zz-default.network",
+		},
+		{
+			name: "azure oem id as a prefix",
+			iface: Interface{
+				Name:              "eth1",
+				Driver:            "mlx4_en",
+				KernelCommandLine: diskCmdline + " coreos.oem.id=azurestack",
+			},
+			winner: "zz-default.network",
+		},
+		{
+			name: "pxe booted nic",
+			iface: Interface{
+				Name:              "eno1",
+				Driver:            "igb",
+				MACAddress:        "0c:c4:7a:aa:bb:cc",
+				KernelCommandLine: pxeCmdline,
+			},
+			winner: "yy-pxe.network",
+		},
+		{
+			name: "pxe booted vmware vm",
+			iface: Interface{
+				Name:              "ens192",
+				Driver:            "vmxnet3",
+				KernelCommandLine: pxeCmdline,
+				Virtualization:    "vmware",
+			},
+			winner: "yy-pxe.network",
+		},
+		{
+			name: "vmware vmxnet3",
+			iface: Interface{
+				Name:              "ens192",
+				Driver:            "vmxnet3",
+				MACAddress:        "00:50:56:aa:bb:cc",
+				KernelCommandLine: diskCmdline + " coreos.oem.id=vmware",
+				Virtualization:    "vmware",
+			},
+			winner: "yy-vmware.network",
+		},
+		{
+			name: "vmware e1000",
+			iface: Interface{
+				Name:              "ens33",
+				Driver:            "e1000",
+				KernelCommandLine: diskCmdline,
+				Virtualization:    "vmware",
+			},
+			winner: "yy-vmware.network",
+		},
+		{
+			name: "default",
+			iface: Interface{
+				Name:              "ens3",
+				Driver:            "virtio_net",
+				MACAddress:        "52:54:00:12:34:56",
+				KernelCommandLine: diskCmdline,
+				Virtualization:    "kvm",
+			},
+			winner: "zz-default.network",
+		},
+		{
+			name: "bare metal",
+			iface: Interface{
+				Name:              "eno1",
+				Driver:            "ixgbe",
+				KernelCommandLine: diskCmdline,
+			},
+			winner: "zz-default.network",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			winner := Select(files, ".network", test.iface)
+			if winner == nil {
+				t.Fatalf("no file matched, expected %s", test.winner)
+			}
+			if winner.Name != test.winner {
+				t.Fatalf("expected %s, received %s", test.winner, winner.Name)
+			}
+		})
+	}
+
+	// the only SR-IOV setting is not touching the interface at all
+	sriov := Select(files, ".network", tests[0].iface)
+	if unmanaged := sriov.Get("Link", "Unmanaged"); fmt.Sprint(unmanaged) != "[yes]" {
+		t.Fatalf("azure sr-iov vf is managed: Unmanaged=%q", unmanaged)
+	}
+}
+
+func TestSelectLink(t *testing.T) {
+	files := loadFiles(t)
+
+	tests := []struct {
+		driver string
+		winner string
+	}{
+		{driver: "virtio_net", winner: "98-virtio.link"},
+		{driver: "vmxnet3"},
+		{driver: "hv_netvsc"},
+	}
+
+	for _, test := range tests {
+		winner := Select(files, ".link", Interface{Name: "eth0", Driver: test.driver})
+		var name string
+		if winner != nil {
+			name = winner.Name
+		}
+		if name != test.winner {
+			t.Errorf("%s: expected %q, received %q", test.driver, test.winner, name)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		match string
+		iface Interface
+		ok    bool
+	}{
+		{"", Interface{}, true},
+		{"Driver=virtio_net", Interface{Driver: "virtio_net"}, true},
+		{"Driver=e1000 e1000e", Interface{Driver: "e1000e"}, true},
+		{"Driver=mlx4_*", Interface{Driver: "mlx4_en"}, true},
+		{"Driver=mlx4_*", Interface{}, false},
+		{"Name=en*", Interface{Name: "ens3"}, true},
+		{"Name=en*", Interface{Name: "eth0"}, false},
+		{"Path=pci-0000:00:*", Interface{Path: "pci-0000:00:03.0"}, true},
+		{"Path=*/virtio0", Interface{Path: "platform-a/virtio0"}, true},
+		{"MACAddress=52:54:00:12:34:56", Interface{MACAddress: "52:54:00:12:34:56"}, true},
+		{"MACAddress=52:54:00:12:34:56", Interface{MACAddress: "52:54:00:12:34:57"}, false},
+		{"KernelCommandLine=root", Interface{KernelCommandLine: "root=LABEL=ROOT"}, true},
+		{"KernelCommandLine=root", Interface{KernelCommandLine: "rootflags=rw"}, false},
+		{"KernelCommandLine=!root", Interface{KernelCommandLine: "rootflags=rw"}, true},
+		{"KernelCommandLine=coreos.autologin", Interface{KernelCommandLine: "coreos.autologin"}, true},
+		{"KernelCommandLine=coreos.oem.id=azure", Interface{KernelCommandLine: "coreos.oem.id=azure"}, true},
+		{"KernelCommandLine=coreos.oem.id=azure", Interface{KernelCommandLine: "coreos.oem.id=ec2"}, false},
+		{"Virtualization=vmware", Interface{Virtualization: "vmware"}, true},
+		{"Virtualization=!vmware", Interface{Virtualization: "kvm"}, true},
+		{"Virtualization=vm", Interface{Virtualization: "kvm"}, true},
+		{"Virtualization=vm", Interface{Virtualization: "docker"}, false},
+		{"Virtualization=container", Interface{Virtualization: "systemd-nspawn"}, true},
+		{"Virtualization=no", Interface{}, true},
+		{"Virtualization=yes", Interface{}, false},
+		{"Driver=virtio_net\nVirtualization=kvm", Interface{Driver: "virtio_net"}, false},
+	}
+
+	for _, test := range tests {
+		f, err := Parse("test.network", strings.NewReader("[Match]\n"+test.match+"\n"))
+		if err != nil {
+			t.Fatalf("parsing %q: %v", test.match, err)
+		}
+		if ok := Matches(f, test.iface); ok != test.ok {
+			t.Errorf("%q against %+v: expected %v, received %v", test.match, test.iface, test.ok, ok)
+		}
+	}
+}
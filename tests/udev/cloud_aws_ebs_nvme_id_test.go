@@ -0,0 +1,261 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udev
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const (
+	nvmeIDScript = "../../udev/bin/cloud_aws_ebs_nvme_id"
+	ebsModel     = "Amazon Elastic Block Store"
+
+	// The EBS block device name lives in the first 32 bytes of the
+	// vendor specific area of the Identify Controller data structure.
+	idCtrlSize    = 4096
+	bdevOffset    = 3072
+	bdevFieldSize = 32
+)
+
+// idCtrlPayload builds a raw id-ctrl payload with bdev stored in the
+// vendor specific area, space padded like EBS does.
+func idCtrlPayload(bdev string, pad byte) []byte {
+	payload := make([]byte, idCtrlSize)
+	copy(payload, "\x0f\x1d\x0f\x1d")
+	copy(payload[24:], ebsModel)
+
+	field := payload[bdevOffset : bdevOffset+bdevFieldSize]
+	for i := range field {
+		field[i] = pad
+	}
+	copy(field, bdev)
+	return payload
+}
+
+// nvmeStub writes an nvme(1) stub which serves payloads[<device basename>]
+// for "id-ctrl --raw-binary <device>" and logs its arguments.
+func nvmeStub(t *testing.T, payloads map[string][]byte) (string, string) {
+	dir, err := ioutil.TempDir("", "nvme-stub")
+	if err != nil {
+		t.Fatalf("creating stub dir: %v", err)
+	}
+
+	for name, payload := range payloads {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".bin"), payload, 0644); err != nil {
+			t.Fatalf("writing payload for %s: %v", name, err)
+		}
+	}
+
+	log := filepath.Join(dir, "nvme.log")
+	stub := `#!/bin/sh
+echo "$@" >> "` + log + `"
+[ "$1" = id-ctrl ] && [ "$2" = --raw-binary ] || exit 2
+exec cat "` + dir + `/$(basename "$3").bin"
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "nvme"), []byte(stub), 0755); err != nil {
+		t.Fatalf("writing nvme stub: %v", err)
+	}
+
+	return dir, log
+}
+
+func exitStatus(t *testing.T, err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	t.Fatalf("running %s: %v", nvmeIDScript, err)
+	return -1
+}
+
+func TestCloudAWSEBSNvmeID(t *testing.T) {
+	stubDir, log := nvmeStub(t, map[string][]byte{
+		"nvme0n1":     idCtrlPayload("/dev/xvda", ' '),
+		"nvme1n1":     idCtrlPayload("sdf", ' '),
+		"nvme2n1":     idCtrlPayload("", ' '),
+		"nvme3n1":     idCtrlPayload("", 0),
+		"nvme4n1":     idCtrlPayload("/dev/sdb  extra", ' '),
+		"nvme12n3p14": idCtrlPayload("xvdba", ' '),
+		"nvme5n1":     idCtrlPayload(strings.Repeat("x", bdevFieldSize+8), ' '),
+	})
+	defer os.RemoveAll(stubDir)
+
+	tests := []struct {
+		name    string
+		args    []string
+		noModel bool
+		stdout  string
+		status  int
+		nvmeLog string
+	}{
+		{
+			name:    "device name with /dev/ prefix",
+			args:    []string{"-d", "/dev/nvme0n1"},
+			stdout:  "xvda\n",
+			nvmeLog: "id-ctrl --raw-binary /dev/nvme0n1\n",
+		},
+		{
+			name:    "device name without prefix",
+			args:    []string{"-d", "/dev/nvme1n1"},
+			stdout:  "sdf\n",
+			nvmeLog: "id-ctrl --raw-binary /dev/nvme1n1\n",
+		},
+		{
+			name:    "space padded empty name",
+			args:    []string{"-d", "/dev/nvme2n1"},
+			status:  1,
+			nvmeLog: "id-ctrl --raw-binary /dev/nvme2n1\n",
+		},
+		{
+			name:    "zeroed name",
+			args:    []string{"-d", "/dev/nvme3n1"},
+			status:  1,
+			nvmeLog: "id-ctrl --raw-binary /dev/nvme3n1\n",
+		},
+		{
+			name:    "repeated spaces are squeezed",
+			args:    []string{"-d", "/dev/nvme4n1"},
+			stdout:  "sdb extra\n",
+			nvmeLog: "id-ctrl --raw-binary /dev/nvme4n1\n",
+		},
+		{
+			name:    "name is cut at the field size",
+			args:    []string{"-d", "/dev/nvme5n1"},
+			stdout:  strings.Repeat("x", bdevFieldSize) + "\n",
+			nvmeLog: "id-ctrl --raw-binary /dev/nvme5n1\n",
+		},
+		{
+			name:    "multi-digit partition device name",
+			args:    []string{"-d", "/dev/nvme12n3p14"},
+			stdout:  "xvdba\n",
+			nvmeLog: "id-ctrl --raw-binary /dev/nvme12n3p14\n",
+		},
+		{
+			name:    "missing ID_MODEL device name",
+			args:    []string{"-d", "/dev/nvme0n1"},
+			noModel: true,
+			stdout:  "Stopping due to non-matching ID_MODEL env variable\n",
+			status:  1,
+		},
+		{
+			name:   "namespace id",
+			args:   []string{"-n", "/dev/nvme0n1p1"},
+			stdout: "_NS_ID=1\n",
+		},
+		{
+			name:   "multi-digit namespace id",
+			args:   []string{"-n", "/dev/nvme12n3p14"},
+			stdout: "_NS_ID=3\n",
+		},
+		{
+			name:   "namespace id of a whole disk",
+			args:   []string{"-n", "/dev/nvme1n2"},
+			stdout: "_NS_ID=2\n",
+		},
+		{
+			name:    "missing ID_MODEL namespace id",
+			args:    []string{"-n", "/dev/nvme0n1p1"},
+			noModel: true,
+			stdout:  "Stopping due to non-matching ID_MODEL env variable\n",
+			status:  1,
+		},
+		{
+			name:   "help",
+			args:   []string{"-h"},
+			status: 0,
+		},
+		{
+			name:   "unknown option",
+			args:   []string{"-x"},
+			status: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(log, nil, 0644); err != nil {
+				t.Fatalf("truncating nvme log: %v", err)
+			}
+
+			env := []string{"PATH=" + stubDir + ":" + os.Getenv("PATH")}
+			if !test.noModel {
+				env = append(env, "ID_MODEL="+ebsModel)
+			}
+
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command(nvmeIDScript, test.args...)
+			cmd.Env = env
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+
+			status := exitStatus(t, cmd.Run())
+			if status != test.status {
+				t.Fatalf("unexpected exit status: expected %d, received %d (stderr: %s)", test.status, status, stderr.String())
+			}
+			if stdout.String() != test.stdout {
+				t.Fatalf("unexpected output: expected %q, received %q", test.stdout, stdout.String())
+			}
+
+			data, err := ioutil.ReadFile(log)
+			if err != nil {
+				t.Fatalf("reading nvme log: %v", err)
+			}
+			if string(data) != test.nvmeLog {
+				t.Fatalf("unexpected nvme invocation: expected %q, received %q", test.nvmeLog, data)
+			}
+		})
+	}
+}
+
+func TestCloudAWSEBSNvmeIDWrongModel(t *testing.T) {
+	stubDir, log := nvmeStub(t, map[string][]byte{
+		"nvme0n1": idCtrlPayload("/dev/xvda", ' '),
+	})
+	defer os.RemoveAll(stubDir)
+
+	for _, args := range [][]string{{"-d", "/dev/nvme0n1"}, {"-n", "/dev/nvme0n1p1"}} {
+		cmd := exec.Command(nvmeIDScript, args...)
+		cmd.Env = []string{
+			"PATH=" + stubDir + ":" + os.Getenv("PATH"),
+			"ID_MODEL=Amazon EC2 NVMe Instance Storage",
+		}
+		out, err := cmd.Output()
+		if status := exitStatus(t, err); status != 1 {
+			t.Fatalf("%s: unexpected exit status %d", strings.Join(args, " "), status)
+		}
+		if string(out) != "Stopping due to non-matching ID_MODEL env variable\n" {
+			t.Fatalf("%s: unexpected output %q", strings.Join(args, " "), out)
+		}
+	}
+
+	data, err := ioutil.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("reading nvme log: %v", err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("nvme was run for a non-EBS device: %q", data)
+	}
+}
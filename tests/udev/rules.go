@@ -0,0 +1,837 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package udev parses and evaluates the subset of the udev rules syntax
+// used by the rules shipped in this repository. It is not a complete
+// implementation of udev, just enough to pin down which properties and
+// symlinks a synthetic device ends up with.
+package udev
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Key is a single comparison or assignment in a rule, e.g.
+// ENV{DEVTYPE}=="disk" or SYMLINK+="disk/by-id/foo".
+type Key struct {
+	Name  string
+	Attr  string
+	Op    string
+	Value string
+}
+
+// Rule is a single (possibly continued) line of a rules file.
+type Rule struct {
+	Line int
+	Keys []Key
+
+	// Label is set if the rule is a LABEL="..." line.
+	Label string
+}
+
+// File is a parsed rules file. GOTO targets are resolved within a file.
+type File struct {
+	Name  string
+	Rules []Rule
+}
+
+var keyRegexp = regexp.MustCompile(`^([A-Z_]+)(?:\{([^}]*)\})?\s*(==|!=|\+=|-=|:=|=)\s*"`)
+
+// ParseFile parses the rules file at path.
+func ParseFile(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(filepath.Base(path), f)
+}
+
+// Parse parses a rules file read from r.
+func Parse(name string, r io.Reader) (*File, error) {
+	file := &File{Name: name}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		start := lineno
+		line := scanner.Text()
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			lineno++
+			line = strings.TrimSuffix(line, "\\") + scanner.Text()
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, start, err)
+		}
+		rule.Line = start
+		file.Rules = append(file.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", name, err)
+	}
+
+	labels := map[string]bool{}
+	for _, rule := range file.Rules {
+		if rule.Label != "" {
+			labels[rule.Label] = true
+		}
+	}
+	for _, rule := range file.Rules {
+		for _, key := range rule.Keys {
+			if key.Name == "GOTO" && !labels[key.Value] {
+				return nil, fmt.Errorf("%s:%d: GOTO %q has no matching LABEL", name, rule.Line, key.Value)
+			}
+		}
+	}
+
+	return file, nil
+}
+
+func parseRule(line string) (Rule, error) {
+	var rule Rule
+	for {
+		line = strings.TrimLeft(line, " \t,")
+		if line == "" {
+			break
+		}
+
+		match := keyRegexp.FindStringSubmatch(line)
+		if match == nil {
+			return rule, fmt.Errorf("invalid key at %q", line)
+		}
+		line = line[len(match[0]):]
+
+		end := strings.IndexByte(line, '"')
+		for end > 0 && line[end-1] == '\\' {
+			next := strings.IndexByte(line[end+1:], '"')
+			if next < 0 {
+				end = -1
+				break
+			}
+			end += next + 1
+		}
+		if end < 0 {
+			return rule, fmt.Errorf("unterminated value for %s", match[1])
+		}
+
+		key := Key{
+			Name:  match[1],
+			Attr:  match[2],
+			Op:    match[3],
+			Value: line[:end],
+		}
+		line = line[end+1:]
+
+		if err := checkKey(key); err != nil {
+			return rule, err
+		}
+		if key.Name == "LABEL" {
+			rule.Label = key.Value
+		}
+		rule.Keys = append(rule.Keys, key)
+	}
+
+	if len(rule.Keys) == 0 {
+		return rule, fmt.Errorf("empty rule")
+	}
+	return rule, nil
+}
+
+func checkKey(key Key) error {
+	isMatch := key.Op == "==" || key.Op == "!="
+
+	switch key.Name {
+	case "ACTION", "DEVPATH", "KERNEL", "SUBSYSTEM", "DRIVER", "RESULT",
+		"KERNELS", "SUBSYSTEMS", "DRIVERS", "TEST":
+		if !isMatch {
+			return fmt.Errorf("%s can only be matched", key.Name)
+		}
+	case "ATTR", "ATTRS":
+		if key.Attr == "" {
+			return fmt.Errorf("%s requires an attribute name", key.Name)
+		}
+		if key.Name == "ATTRS" && !isMatch {
+			return fmt.Errorf("ATTRS can only be matched")
+		}
+	case "ENV":
+		if key.Attr == "" {
+			return fmt.Errorf("ENV requires a property name")
+		}
+	case "PROGRAM":
+		if key.Op != "=" && key.Op != "==" {
+			return fmt.Errorf("PROGRAM has invalid operator %s", key.Op)
+		}
+	case "IMPORT":
+		if key.Attr != "program" {
+			return fmt.Errorf("unsupported IMPORT{%s}", key.Attr)
+		}
+	case "SYMLINK", "TAG", "RUN":
+		if isMatch {
+			return fmt.Errorf("matching %s is not supported", key.Name)
+		}
+	case "GOTO", "LABEL", "GROUP", "OWNER", "MODE", "OPTIONS":
+		if isMatch {
+			return fmt.Errorf("%s can only be assigned", key.Name)
+		}
+	default:
+		return fmt.Errorf("unsupported key %s", key.Name)
+	}
+	return nil
+}
+
+// Parent is a device further up the sysfs tree, searched by KERNELS,
+// SUBSYSTEMS, DRIVERS, ATTRS and $attr.
+type Parent struct {
+	Kernel    string
+	Subsystem string
+	Driver    string
+	Attrs     map[string]string
+}
+
+// Device is a synthetic device a uevent is evaluated against.
+type Device struct {
+	Action    string
+	DevPath   string
+	Kernel    string
+	Subsystem string
+	Driver    string
+
+	// Env holds the device properties, e.g. DEVTYPE or ID_MODEL.
+	Env map[string]string
+	// Attrs holds the sysfs attributes of the device itself. Attributes
+	// of other devices use the udev "[subsystem/sysname]attr" syntax.
+	Attrs map[string]string
+	// Parents are searched in order after the device itself.
+	Parents []Parent
+	// Files lists the paths which exist for TEST.
+	Files []string
+}
+
+// Program stubs out an external command run by PROGRAM or
+// IMPORT{program}. It receives the argv after substitution and the
+// device properties at the time of the call. A non-nil error makes the
+// key fail to match, just like a non-zero exit status.
+type Program func(argv []string, env map[string]string) (string, error)
+
+// Result is the outcome of processing a device through a rule set.
+type Result struct {
+	Env      map[string]string
+	Symlinks []string
+	Tags     []string
+	Run      []string
+	Group    string
+	Owner    string
+	Mode     string
+}
+
+// Evaluator applies a set of rules files to devices.
+type Evaluator struct {
+	Files []*File
+
+	// Programs maps the base name of argv[0] to a stub.
+	Programs map[string]Program
+}
+
+// LoadDir parses all *.rules files in dir, in lexical order.
+func LoadDir(dir string) ([]*File, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.rules"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var files []*File
+	for _, path := range paths {
+		file, err := ParseFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+type event struct {
+	dev     Device
+	env     map[string]string
+	result  string
+	escape  bool
+	res     *Result
+	progs   map[string]Program
+	matched *Parent
+}
+
+// Eval runs dev through all rules and returns the resulting properties,
+// symlinks, tags and RUN commands.
+func (e *Evaluator) Eval(dev Device) (*Result, error) {
+	ev := &event{
+		dev:   dev,
+		env:   map[string]string{},
+		res:   &Result{},
+		progs: e.Programs,
+	}
+	for k, v := range dev.Env {
+		ev.env[k] = v
+	}
+
+	for _, file := range e.Files {
+		label := ""
+		for _, rule := range file.Rules {
+			if label != "" {
+				if rule.Label == label {
+					label = ""
+				}
+				continue
+			}
+			if rule.Label != "" {
+				continue
+			}
+
+			target, err := ev.apply(rule)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file.Name, rule.Line, err)
+			}
+			label = target
+		}
+	}
+
+	ev.res.Env = ev.env
+	return ev.res, nil
+}
+
+// apply evaluates a single rule. Like udev, all plain matches are checked
+// before any program is run, and assignments only happen if every match
+// succeeded. It returns the GOTO target, if any.
+func (ev *event) apply(rule Rule) (string, error) {
+	ev.escape = false
+	ev.matched = nil
+
+	var parentKeys []Key
+	for _, key := range rule.Keys {
+		if key.Name == "PROGRAM" || key.Name == "IMPORT" || key.Name == "RESULT" || !isMatch(key) {
+			continue
+		}
+		if isParentKey(key) {
+			parentKeys = append(parentKeys, key)
+			continue
+		}
+		if !ev.match(key) {
+			return "", nil
+		}
+	}
+	if len(parentKeys) > 0 && !ev.matchParents(parentKeys) {
+		return "", nil
+	}
+
+	for _, key := range rule.Keys {
+		switch {
+		case key.Name == "PROGRAM":
+			out, err := ev.run(key.Value)
+			if err != nil {
+				return "", err
+			}
+			if out == nil {
+				return "", nil
+			}
+			ev.result = strings.TrimRight(*out, "\n")
+		case key.Name == "IMPORT":
+			out, err := ev.run(key.Value)
+			if err != nil {
+				return "", err
+			}
+			if out == nil {
+				return "", nil
+			}
+			ev.importProperties(*out)
+		case key.Name == "RESULT":
+			if globMatch(key.Value, ev.result) != (key.Op == "==") {
+				return "", nil
+			}
+		}
+	}
+
+	for _, key := range rule.Keys {
+		if key.Name == "OPTIONS" {
+			for _, opt := range strings.Split(key.Value, ",") {
+				switch strings.TrimSpace(opt) {
+				case "string_escape=replace":
+					ev.escape = true
+				case "string_escape=none":
+					ev.escape = false
+				}
+			}
+		}
+	}
+
+	target := ""
+	for _, key := range rule.Keys {
+		if isMatch(key) || key.Name == "PROGRAM" || key.Name == "IMPORT" {
+			continue
+		}
+
+		switch key.Name {
+		case "ENV":
+			value := ev.subst(key.Value)
+			if key.Op == "+=" && ev.env[key.Attr] != "" {
+				value = ev.env[key.Attr] + " " + value
+			}
+			if value == "" {
+				delete(ev.env, key.Attr)
+			} else {
+				ev.env[key.Attr] = value
+			}
+		case "SYMLINK":
+			ev.addSymlinks(key)
+		case "TAG":
+			ev.res.Tags = appendOrSet(ev.res.Tags, key.Op, ev.subst(key.Value))
+		case "RUN":
+			ev.res.Run = appendOrSet(ev.res.Run, key.Op, ev.subst(key.Value))
+		case "GROUP":
+			ev.res.Group = ev.subst(key.Value)
+		case "OWNER":
+			ev.res.Owner = ev.subst(key.Value)
+		case "MODE":
+			ev.res.Mode = ev.subst(key.Value)
+		case "GOTO":
+			target = key.Value
+		}
+	}
+
+	return target, nil
+}
+
+func isMatch(key Key) bool {
+	return key.Op == "==" || key.Op == "!="
+}
+
+func appendOrSet(list []string, op, value string) []string {
+	if op == "=" || op == ":=" {
+		list = nil
+	}
+	return append(list, value)
+}
+
+func (ev *event) match(key Key) bool {
+	want := key.Op == "=="
+
+	switch key.Name {
+	case "ACTION":
+		return globMatch(key.Value, ev.dev.Action) == want
+	case "DEVPATH":
+		return globMatch(key.Value, ev.dev.DevPath) == want
+	case "KERNEL":
+		return globMatch(key.Value, ev.dev.Kernel) == want
+	case "SUBSYSTEM":
+		return globMatch(key.Value, ev.dev.Subsystem) == want
+	case "DRIVER":
+		return globMatch(key.Value, ev.dev.Driver) == want
+	case "ENV":
+		return globMatch(key.Value, ev.env[key.Attr]) == want
+	case "ATTR":
+		value, ok := ev.dev.Attrs[key.Attr]
+		return (ok && attrMatch(key.Value, value)) == want
+	case "TEST":
+		path := ev.subst(key.Value)
+		for _, file := range ev.dev.Files {
+			if file == path {
+				return want
+			}
+		}
+		return !want
+	}
+	return false
+}
+
+// isParentKey reports whether key matches the device or one of its
+// parents.
+func isParentKey(key Key) bool {
+	switch key.Name {
+	case "KERNELS", "SUBSYSTEMS", "DRIVERS", "ATTRS":
+		return true
+	}
+	return false
+}
+
+// matchParents walks up from the device itself, like udev, looking for a
+// single device every one of keys matches. That device is the one $attr
+// reads from.
+func (ev *event) matchParents(keys []Key) bool {
+	self := Parent{
+		Kernel:    ev.dev.Kernel,
+		Subsystem: ev.dev.Subsystem,
+		Driver:    ev.dev.Driver,
+		Attrs:     ev.dev.Attrs,
+	}
+	devices := append([]Parent{self}, ev.dev.Parents...)
+
+	for i := range devices {
+		dev := &devices[i]
+		matched := true
+		for _, key := range keys {
+			if !parentMatch(key, dev) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			if i > 0 {
+				ev.matched = dev
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func parentMatch(key Key, dev *Parent) bool {
+	want := key.Op == "=="
+
+	switch key.Name {
+	case "KERNELS":
+		return globMatch(key.Value, dev.Kernel) == want
+	case "SUBSYSTEMS":
+		return globMatch(key.Value, dev.Subsystem) == want
+	case "DRIVERS":
+		return globMatch(key.Value, dev.Driver) == want
+	case "ATTRS":
+		value, ok := dev.Attrs[key.Attr]
+		return (ok && attrMatch(key.Value, value)) == want
+	}
+	return false
+}
+
+// attrMatch ignores trailing whitespace in sysfs values unless the
+// pattern itself ends in whitespace, as udev does.
+func attrMatch(pattern, value string) bool {
+	if !strings.HasSuffix(pattern, " ") {
+		value = strings.TrimRight(value, " \t\n")
+	}
+	return globMatch(pattern, value)
+}
+
+func (ev *event) run(command string) (*string, error) {
+	argv := splitCommand(ev.subst(command))
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty program")
+	}
+
+	prog, ok := ev.progs[filepath.Base(argv[0])]
+	if !ok {
+		return nil, fmt.Errorf("no stub for program %q", argv[0])
+	}
+
+	env := map[string]string{}
+	for k, v := range ev.env {
+		env[k] = v
+	}
+
+	out, err := prog(argv, env)
+	if err != nil {
+		return nil, nil
+	}
+	return &out, nil
+}
+
+func (ev *event) importProperties(out string) {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.Trim(parts[1], `"'`)
+		if value == "" {
+			delete(ev.env, parts[0])
+		} else {
+			ev.env[parts[0]] = value
+		}
+	}
+}
+
+func (ev *event) addSymlinks(key Key) {
+	value := ev.subst(key.Value)
+	if key.Op == "=" || key.Op == ":=" {
+		ev.res.Symlinks = nil
+	}
+
+	if ev.escape {
+		value = replaceChars(value, "/")
+		if value != "" {
+			ev.res.Symlinks = appendUnique(ev.res.Symlinks, value)
+		}
+		return
+	}
+
+	for _, link := range strings.Fields(replaceChars(value, "/ ")) {
+		ev.res.Symlinks = appendUnique(ev.res.Symlinks, link)
+	}
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// attr looks up a sysfs attribute for $attr, preferring the device
+// itself and then the parent selected by ATTRS.
+func (ev *event) attr(name string) string {
+	if value, ok := ev.dev.Attrs[name]; ok {
+		return value
+	}
+	if ev.matched != nil {
+		if value, ok := ev.matched.Attrs[name]; ok {
+			return value
+		}
+	}
+	for _, parent := range ev.dev.Parents {
+		if value, ok := parent.Attrs[name]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// number returns the kernel number, the trailing digits of the kernel
+// name (e.g. "2" for nvme0n1p2).
+func (ev *event) number() string {
+	kernel := ev.dev.Kernel
+	i := len(kernel)
+	for i > 0 && kernel[i-1] >= '0' && kernel[i-1] <= '9' {
+		i--
+	}
+	return kernel[i:]
+}
+
+var longSubst = map[string]byte{
+	"kernel":  'k',
+	"number":  'n',
+	"devpath": 'p',
+	"result":  'c',
+	"env":     'E',
+	"attr":    's',
+}
+
+// subst expands the udev % and $ format characters.
+func (ev *event) subst(value string) string {
+	var out bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '%' && c != '$' {
+			out.WriteByte(c)
+			continue
+		}
+		if i+1 >= len(value) {
+			out.WriteByte(c)
+			continue
+		}
+		if value[i+1] == c {
+			out.WriteByte(c)
+			i++
+			continue
+		}
+
+		var kind byte
+		if c == '$' {
+			j := i + 1
+			for j < len(value) && value[j] >= 'a' && value[j] <= 'z' {
+				j++
+			}
+			k, ok := longSubst[value[i+1:j]]
+			if !ok {
+				out.WriteByte(c)
+				continue
+			}
+			kind = k
+			i = j - 1
+		} else {
+			kind = value[i+1]
+			i++
+		}
+
+		arg := ""
+		if i+1 < len(value) && value[i+1] == '{' {
+			end := strings.IndexByte(value[i+1:], '}')
+			if end > 0 {
+				arg = value[i+2 : i+1+end]
+				i += end + 1
+			}
+		}
+
+		switch kind {
+		case 'k':
+			out.WriteString(ev.dev.Kernel)
+		case 'n':
+			out.WriteString(ev.number())
+		case 'p':
+			out.WriteString(ev.dev.DevPath)
+		case 'c':
+			out.WriteString(ev.result)
+		case 'E':
+			out.WriteString(ev.env[arg])
+		case 's':
+			attr := strings.TrimRight(ev.attr(arg), " \t\n")
+			out.WriteString(replaceChars(attr, " "))
+		default:
+			out.WriteByte(c)
+			out.WriteByte(kind)
+		}
+	}
+	return out.String()
+}
+
+// replaceChars mirrors udev's util_replace_chars: anything outside the
+// allowed set and the given extra characters becomes an underscore.
+func replaceChars(value, allow string) string {
+	var out bytes.Buffer
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+			out.WriteRune(r)
+		case strings.ContainsRune("#+-.:=@_", r), strings.ContainsRune(allow, r):
+			out.WriteRune(r)
+		case r > 0x7f:
+			out.WriteRune(r)
+		default:
+			out.WriteByte('_')
+		}
+	}
+	return out.String()
+}
+
+// splitCommand splits a PROGRAM value into argv, honouring single and
+// double quotes the way udev does.
+func splitCommand(command string) []string {
+	var argv []string
+	var cur bytes.Buffer
+	inArg := false
+	quote := byte(0)
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				argv = append(argv, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		argv = append(argv, cur.String())
+	}
+	return argv
+}
+
+// globMatch implements udev's fnmatch(3) based matching: "|" separates
+// alternatives, and "*" also matches "/".
+func globMatch(pattern, value string) bool {
+	for _, alt := range strings.Split(pattern, "|") {
+		if fnmatch(alt, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func fnmatch(pattern, value string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(value); i++ {
+				if fnmatch(pattern[1:], value[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+			pattern, value = pattern[1:], value[1:]
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 || len(value) == 0 {
+				return false
+			}
+			if !classMatch(pattern[1:end+1], value[0]) {
+				return false
+			}
+			pattern, value = pattern[end+2:], value[1:]
+		default:
+			if len(value) == 0 || pattern[0] != value[0] {
+				return false
+			}
+			pattern, value = pattern[1:], value[1:]
+		}
+	}
+	return len(value) == 0
+}
+
+func classMatch(class string, c byte) bool {
+	negate := false
+	if len(class) > 0 && (class[0] == '!' || class[0] == '^') {
+		negate = true
+		class = class[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if c >= class[i] && c <= class[i+2] {
+				matched = true
+			}
+			i += 2
+		} else if class[i] == c {
+			matched = true
+		}
+	}
+	return matched != negate
+}
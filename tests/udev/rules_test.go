@@ -0,0 +1,593 @@
+// Copyright 2017 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udev
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const rulesDir = "../../udev/rules.d"
+
+type ruleTest struct {
+	name     string
+	dev      Device
+	symlinks []string
+	env      map[string]string
+	run      []string
+}
+
+func evaluator(t *testing.T, programs map[string]Program) *Evaluator {
+	files, err := LoadDir(rulesDir)
+	if err != nil {
+		t.Fatalf("loading rules: %v", err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no rules found in %s", rulesDir)
+	}
+	return &Evaluator{Files: files, Programs: programs}
+}
+
+func runRuleTests(t *testing.T, e *Evaluator, tests []ruleTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := e.Eval(test.dev)
+			if err != nil {
+				t.Fatalf("evaluating rules: %v", err)
+			}
+
+			if !reflect.DeepEqual(res.Symlinks, test.symlinks) {
+				t.Errorf("symlinks differ: expected %q, received %q", test.symlinks, res.Symlinks)
+			}
+			if !reflect.DeepEqual(res.Run, test.run) {
+				t.Errorf("RUN differs: expected %q, received %q", test.run, res.Run)
+			}
+			for k, v := range test.env {
+				if res.Env[k] != v {
+					t.Errorf("ENV{%s} differs: expected %q, received %q", k, v, res.Env[k])
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		err   string
+	}{
+		{
+			name:  "missing label",
+			rules: `ACTION=="add", GOTO="nowhere"`,
+			err:   `GOTO "nowhere" has no matching LABEL`,
+		},
+		{
+			name:  "unterminated value",
+			rules: `KERNEL=="sd*`,
+			err:   "unterminated value",
+		},
+		{
+			name:  "assign match only key",
+			rules: `KERNEL="sda"`,
+			err:   "KERNEL can only be matched",
+		},
+		{
+			name:  "unsupported import",
+			rules: `IMPORT{builtin}="path_id"`,
+			err:   "unsupported IMPORT{builtin}",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse("test.rules", strings.NewReader(test.rules))
+			if err == nil {
+				t.Fatalf("parsing succeeded when it shouldn't have")
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("unexpected error: expected %q, received %q", test.err, err)
+			}
+		})
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{"sd*|vd*", "vdb1", true},
+		{"sd*|vd*", "xvda", false},
+		{"nvme[0-9]*n[0-9]*", "nvme12n3", true},
+		{"nvme[0-9]*n[0-9]*", "nvme0", false},
+		{"?*", "", false},
+		{"?*", "x", true},
+		{"", "", true},
+		{"/devices/*/net/*", "/devices/pci0000:00/virtio1/net/eth0", true},
+		{"{f8b3781a-*}", "{f8b3781a-1e82}", true},
+	}
+
+	for _, test := range tests {
+		if globMatch(test.pattern, test.value) != test.match {
+			t.Errorf("globMatch(%q, %q) should be %v", test.pattern, test.value, test.match)
+		}
+	}
+}
+
+func TestGoogle(t *testing.T) {
+	disk := func(kernel, devtype, model, serial string) Device {
+		return Device{
+			Action:    "add",
+			Kernel:    kernel,
+			Subsystem: "block",
+			Env: map[string]string{
+				"DEVTYPE":         devtype,
+				"ID_VENDOR":       "Google",
+				"ID_MODEL":        model,
+				"ID_SERIAL_SHORT": serial,
+			},
+		}
+	}
+
+	removed := disk("sda", "disk", "PersistentDisk", "persistent-disk-0")
+	removed.Action = "remove"
+	other := disk("sda", "disk", "PersistentDisk", "persistent-disk-0")
+	other.Env["ID_VENDOR"] = "QEMU"
+
+	runRuleTests(t, evaluator(t, nil), []ruleTest{
+		{
+			name:     "persistent disk",
+			dev:      disk("sda", "disk", "PersistentDisk", "persistent-disk-0"),
+			symlinks: []string{"disk/by-id/google-persistent-disk-0"},
+		},
+		{
+			name:     "persistent disk partition",
+			dev:      disk("sda9", "partition", "PersistentDisk", "persistent-disk-0"),
+			symlinks: []string{"disk/by-id/google-persistent-disk-0-part9"},
+		},
+		{
+			name:     "virtio ephemeral disk",
+			dev:      disk("vdb", "disk", "EphemeralDisk", "local-ssd-0"),
+			symlinks: []string{"disk/by-id/google-local-ssd-0"},
+		},
+		{
+			name:     "virtio ephemeral partition",
+			dev:      disk("vdb12", "partition", "EphemeralDisk", "local-ssd-0"),
+			symlinks: []string{"disk/by-id/google-local-ssd-0-part12"},
+		},
+		{
+			name: "missing serial",
+			dev:  disk("sdb", "disk", "PersistentDisk", ""),
+		},
+		{
+			name: "nvme kernel name",
+			dev:  disk("nvme0n1", "disk", "PersistentDisk", "persistent-disk-0"),
+		},
+		{
+			name: "remove",
+			dev:  removed,
+		},
+		{
+			name: "other vendor",
+			dev:  other,
+		},
+	})
+}
+
+// azureShell emulates readlink(1) on /sys/class/block for the Azure LUN
+// lookup, which runs "readlink <path>|cut -d: -f4" through /bin/sh.
+func azureShell(links map[string]string) Program {
+	re := regexp.MustCompile(`^readlink (\S+)\|cut -d: -f4$`)
+	return func(argv []string, env map[string]string) (string, error) {
+		if len(argv) != 3 || argv[1] != "-c" {
+			return "", fmt.Errorf("unexpected argv %q", argv)
+		}
+		match := re.FindStringSubmatch(argv[2])
+		if match == nil {
+			return "", fmt.Errorf("unexpected command %q", argv[2])
+		}
+		link, ok := links[match[1]]
+		if !ok {
+			return "\n", nil
+		}
+		fields := strings.Split(link, ":")
+		if len(fields) < 4 {
+			return link + "\n", nil
+		}
+		return fields[3] + "\n", nil
+	}
+}
+
+func TestAzure(t *testing.T) {
+	disk := func(kernel, devtype, deviceID string) Device {
+		return Device{
+			Action:    "add",
+			Kernel:    kernel,
+			Subsystem: "block",
+			Env: map[string]string{
+				"DEVTYPE":   devtype,
+				"ID_VENDOR": "Msft",
+				"ID_MODEL":  "Virtual_Disk",
+			},
+			Parents: []Parent{
+				{Attrs: map[string]string{"vendor": "Msft    "}},
+				{Driver: "hv_storvsc", Attrs: map[string]string{"device_id": deviceID}},
+			},
+		}
+	}
+
+	changed := disk("sda", "disk", "{00000000-0000-8899-0000-000000000000}")
+	changed.Action = "change"
+	other := disk("sda", "disk", "{00000000-0000-8899-0000-000000000000}")
+	other.Env["ID_MODEL"] = "QEMU_HARDDISK"
+
+	e := evaluator(t, map[string]Program{
+		"sh": azureShell(map[string]string{
+			"/sys/class/block/sdc/device":     "../../../3:0:1:0",
+			"/sys/class/block/sdc1/../device": "../../../3:0:1:0",
+			"/sys/class/block/sdd/device":     "../../../5:0:0:12",
+			"/sys/class/block/sdd3/../device": "../../../5:0:0:12",
+		}),
+	})
+
+	runRuleTests(t, e, []ruleTest{
+		{
+			name:     "os disk",
+			dev:      disk("sda", "disk", "{00000000-0000-8899-0000-000000000000}"),
+			symlinks: []string{"disk/azure/root"},
+			env:      map[string]string{"fabric_name": "root"},
+		},
+		{
+			name:     "os disk partition",
+			dev:      disk("sda9", "partition", "{00000000-0000-8899-0000-000000000000}"),
+			symlinks: []string{"disk/azure/root-part9"},
+		},
+		{
+			name:     "os disk change event",
+			dev:      changed,
+			symlinks: []string{"disk/azure/root"},
+		},
+		{
+			name:     "resource disk",
+			dev:      disk("sdb", "disk", "{00000000-0001-8899-0000-000000000000}"),
+			symlinks: []string{"disk/azure/resource"},
+		},
+		{
+			name:     "resource disk partition",
+			dev:      disk("sdb1", "partition", "{00000000-0001-8899-0000-000000000000}"),
+			symlinks: []string{"disk/azure/resource-part1"},
+		},
+		{
+			name:     "scsi1 data disk",
+			dev:      disk("sdc", "disk", "{f8b3781b-1e82-4818-a1c3-63d806ec15bb}"),
+			symlinks: []string{"disk/azure/scsi1/lun0"},
+			env:      map[string]string{"fabric_scsi_controller": "scsi1", "fabric_name": "scsi1/lun0"},
+		},
+		{
+			name:     "scsi1 data disk partition",
+			dev:      disk("sdc1", "partition", "{f8b3781b-1e82-4818-a1c3-63d806ec15bb}"),
+			symlinks: []string{"disk/azure/scsi1/lun0-part1"},
+		},
+		{
+			name:     "scsi3 data disk multi-digit lun",
+			dev:      disk("sdd", "disk", "{f8b3781d-1e82-4818-a1c3-63d806ec15bb}"),
+			symlinks: []string{"disk/azure/scsi3/lun12"},
+		},
+		{
+			name:     "scsi3 data disk partition",
+			dev:      disk("sdd3", "partition", "{f8b3781d-1e82-4818-a1c3-63d806ec15bb}"),
+			symlinks: []string{"disk/azure/scsi3/lun12-part3"},
+		},
+		{
+			name: "unknown controller",
+			dev:  disk("sde", "disk", "{f8b3781e-1e82-4818-a1c3-63d806ec15bb}"),
+		},
+		{
+			name: "not a hyper-v disk",
+			dev:  other,
+		},
+	})
+}
+
+// ebsNvmeID stubs udev/bin/cloud_aws_ebs_nvme_id, which is tested against
+// the real script separately. names maps a controller to the block
+// device name stored in its vendor specific id-ctrl data.
+func ebsNvmeID(names map[string]string) Program {
+	re := regexp.MustCompile(`^/dev/(nvme[0-9]+)n([0-9]+)(?:p[0-9]+)?$`)
+	return func(argv []string, env map[string]string) (string, error) {
+		if env["ID_MODEL"] != "Amazon Elastic Block Store" {
+			return "", fmt.Errorf("non-matching ID_MODEL")
+		}
+		if len(argv) != 3 {
+			return "", fmt.Errorf("unexpected argv %q", argv)
+		}
+		match := re.FindStringSubmatch(argv[2])
+		if match == nil {
+			return "", fmt.Errorf("unexpected device %q", argv[2])
+		}
+
+		switch argv[1] {
+		case "-d":
+			name, ok := names[match[1]]
+			if !ok {
+				return "", fmt.Errorf("no name for %s", match[1])
+			}
+			return name + "\n", nil
+		case "-n":
+			return "_NS_ID=" + match[2] + "\n", nil
+		}
+		return "", fmt.Errorf("unexpected option %q", argv[1])
+	}
+}
+
+func TestAWS(t *testing.T) {
+	nvme := func(kernel, devtype, model, serial string) Device {
+		return Device{
+			Action:    "add",
+			Kernel:    kernel,
+			Subsystem: "block",
+			Env: map[string]string{
+				"DEVTYPE":  devtype,
+				"ID_MODEL": strings.TrimSpace(model),
+			},
+			Parents: []Parent{
+				{Driver: "nvme", Attrs: map[string]string{
+					"model":  model,
+					"serial": serial,
+				}},
+			},
+		}
+	}
+
+	const ebs = "Amazon Elastic Block Store              "
+	e := evaluator(t, map[string]Program{
+		"cloud_aws_ebs_nvme_id": ebsNvmeID(map[string]string{
+			"nvme0":  "xvda",
+			"nvme1":  "sdf",
+			"nvme12": "xvdba",
+		}),
+	})
+
+	runRuleTests(t, e, []ruleTest{
+		{
+			name: "root volume",
+			dev:  nvme("nvme0n1", "disk", ebs, "vol0123456789abcdef0"),
+			symlinks: []string{
+				"disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0-ns-1",
+				"xvda",
+			},
+		},
+		{
+			name: "root volume partition",
+			dev:  nvme("nvme0n1p9", "partition", ebs, "vol0123456789abcdef0"),
+			symlinks: []string{
+				"disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0-ns-1-part9",
+				"xvda9",
+			},
+			env: map[string]string{"_NS_ID": "1"},
+		},
+		{
+			name: "data volume",
+			dev:  nvme("nvme1n1", "disk", ebs, "vol0fedcba9876543210"),
+			symlinks: []string{
+				"disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0fedcba9876543210-ns-1",
+				"sdf",
+			},
+		},
+		{
+			name: "multi-digit partition",
+			dev:  nvme("nvme12n3p14", "partition", ebs, "vol0aaaabbbbccccdddd"),
+			symlinks: []string{
+				"disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0aaaabbbbccccdddd-ns-3-part14",
+				"xvdba14",
+			},
+			env: map[string]string{"_NS_ID": "3"},
+		},
+		{
+			name: "missing serial",
+			dev:  nvme("nvme1n1", "disk", ebs, ""),
+		},
+		{
+			name: "instance storage",
+			dev:  nvme("nvme2n1", "disk", "Amazon EC2 NVMe Instance Storage        ", "AWS1234567890ABCDEF0"),
+		},
+		{
+			name: "unnamed volume",
+			dev:  nvme("nvme3n1", "disk", ebs, "vol01111222233334444"),
+			symlinks: []string{
+				"disk/by-id/nvme-Amazon_Elastic_Block_Store_vol01111222233334444-ns-1",
+			},
+		},
+	})
+}
+
+func TestNetGoogleCompat(t *testing.T) {
+	nic := func(action, devpath, vendor string) Device {
+		return Device{
+			Action:    action,
+			DevPath:   devpath,
+			Kernel:    "eth0",
+			Subsystem: "net",
+			Env:       map[string]string{"INTERFACE": "eth0"},
+			Attrs:     map[string]string{"[dmi/id]sys_vendor": vendor},
+		}
+	}
+
+	const gce = "/devices/pci0000:00/0000:00:04.0/virtio1/net/eth0"
+	tests := []struct {
+		name string
+		dev  Device
+		want string
+	}{
+		{"gce virtio nic", nic("add", gce, "Google"), "ens4v1"},
+		{"change event", nic("change", gce, "Google"), ""},
+		{"other slot", nic("add", "/devices/pci0000:00/0000:00:05.0/virtio2/net/eth0", "Google"), ""},
+		{"other vendor", nic("add", gce, "QEMU"), ""},
+	}
+
+	e := evaluator(t, nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := e.Eval(test.dev)
+			if err != nil {
+				t.Fatalf("evaluating rules: %v", err)
+			}
+			if res.Env["ID_NET_NAME"] != test.want {
+				t.Fatalf("ID_NET_NAME differs: expected %q, received %q", test.want, res.Env["ID_NET_NAME"])
+			}
+		})
+	}
+}
+
+func TestIssuegen(t *testing.T) {
+	nic := func(action, iface string) Device {
+		return Device{
+			Action:    action,
+			Kernel:    iface,
+			Subsystem: "net",
+			Env:       map[string]string{"INTERFACE": iface},
+		}
+	}
+
+	runRuleTests(t, evaluator(t, nil), []ruleTest{
+		{
+			name: "add ethernet",
+			dev:  nic("add", "eth0"),
+			run:  []string{"/usr/lib/coreos/issuegen add eth0"},
+		},
+		{
+			name: "add predictable name",
+			dev:  nic("add", "enp0s3"),
+			run:  []string{"/usr/lib/coreos/issuegen add enp0s3"},
+		},
+		{
+			name: "remove ethernet",
+			dev:  nic("remove", "eth0"),
+			run:  []string{"/usr/lib/coreos/issuegen remove eth0"},
+		},
+		{
+			name: "change ethernet",
+			dev:  nic("change", "eth0"),
+		},
+		{
+			name: "loopback",
+			dev:  nic("add", "lo"),
+		},
+		{
+			name: "wireless",
+			dev:  nic("add", "wlan0"),
+		},
+	})
+}
+
+func TestParentKeys(t *testing.T) {
+	file, err := Parse("parents.rules", strings.NewReader(`SUBSYSTEMS=="nvme", ATTRS{model}=="disk", ENV{model}="$attr{model}"
+KERNELS=="nvme0", DRIVERS=="nvme", ATTRS{serial}=="?*", ENV{serial}="$attr{serial}"
+`))
+	if err != nil {
+		t.Fatalf("parsing rules: %v", err)
+	}
+	e := &Evaluator{Files: []*File{file}}
+
+	dev := func(parents ...Parent) Device {
+		return Device{Action: "add", Kernel: "nvme0n1", Subsystem: "block", Parents: parents}
+	}
+	runRuleTests(t, e, []ruleTest{
+		{
+			name: "same parent",
+			dev: dev(
+				Parent{Kernel: "0000:00:04.0", Subsystem: "pci", Attrs: map[string]string{"model": "pci"}},
+				Parent{Kernel: "nvme0", Subsystem: "nvme", Driver: "nvme", Attrs: map[string]string{"model": "disk", "serial": "vol1"}},
+			),
+			env: map[string]string{"model": "disk", "serial": "vol1"},
+		},
+		{
+			name: "split across parents",
+			dev: dev(
+				Parent{Kernel: "nvme0", Subsystem: "nvme", Attrs: map[string]string{"serial": "vol1"}},
+				Parent{Kernel: "0000:00:04.0", Subsystem: "pci", Driver: "nvme", Attrs: map[string]string{"model": "disk"}},
+			),
+			env: map[string]string{"model": "", "serial": ""},
+		},
+	})
+}
+
+func TestMisc(t *testing.T) {
+	e := evaluator(t, nil)
+
+	t.Run("kvm", func(t *testing.T) {
+		res, err := e.Eval(Device{Action: "add", Kernel: "kvm", Subsystem: "misc"})
+		if err != nil {
+			t.Fatalf("evaluating rules: %v", err)
+		}
+		if res.Group != "kvm" || res.Mode != "0660" {
+			t.Fatalf("unexpected permissions: group %q, mode %q", res.Group, res.Mode)
+		}
+	})
+
+	t.Run("virtfs metadata", func(t *testing.T) {
+		res, err := e.Eval(Device{
+			Action:    "add",
+			Kernel:    "virtio2",
+			Subsystem: "virtio",
+			Driver:    "9pnet_virtio",
+			Attrs:     map[string]string{"mount_tag": "metadata"},
+		})
+		if err != nil {
+			t.Fatalf("evaluating rules: %v", err)
+		}
+		if !reflect.DeepEqual(res.Tags, []string{"systemd"}) {
+			t.Fatalf("unexpected tags: %q", res.Tags)
+		}
+		if res.Env["SYSTEMD_WANTS"] != "virtfs@metadata.service" {
+			t.Fatalf("unexpected SYSTEMD_WANTS: %q", res.Env["SYSTEMD_WANTS"])
+		}
+	})
+
+	t.Run("azure product uuid", func(t *testing.T) {
+		dev := Device{
+			Action:    "add",
+			Kernel:    "id",
+			Subsystem: "dmi",
+			Attrs: map[string]string{
+				"sys_vendor":   "Microsoft Corporation",
+				"product_name": "Virtual Machine",
+			},
+			Files: []string{"/sys/devices/virtual/dmi/id/product_uuid"},
+		}
+		res, err := e.Eval(dev)
+		if err != nil {
+			t.Fatalf("evaluating rules: %v", err)
+		}
+		expected := []string{"/bin/chmod 0444 /sys/devices/virtual/dmi/id/product_uuid"}
+		if !reflect.DeepEqual(res.Run, expected) {
+			t.Fatalf("RUN differs: expected %q, received %q", expected, res.Run)
+		}
+
+		dev.Attrs["product_name"] = "Surface Book"
+		res, err = e.Eval(dev)
+		if err != nil {
+			t.Fatalf("evaluating rules: %v", err)
+		}
+		if len(res.Run) != 0 {
+			t.Fatalf("unexpected RUN for non-VM: %q", res.Run)
+		}
+	})
+}